@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API v2, orientée ressources, servie par le même routeur que les anciennes routes :
+//
+//	GET    /api/v2/profiles                  liste paginée (admin), ?userType=2 filtre par type (moderator), voir pagination.go
+//	POST   /api/v2/profiles                  création
+//	GET    /api/v2/profiles/{email}          lecture
+//	PATCH  /api/v2/profiles/{email}          {"state": true}
+//	DELETE /api/v2/profiles/{email}
+//	PUT    /api/v2/profiles/{email}/image    multipart : image, remplace l'avatar
+//	GET    /api/v2/profiles/{email}/image    ?size=, Accept, comme /api/profiles/{email}/image
+//	DELETE /api/v2/profiles/{email}/image
+//
+// Les handlers sont ceux des anciennes routes, qui lisent l'email dans l'url quand il y est.
+// Les anciennes routes RPC (POST pour lire, email dans le corps) restent disponibles mais
+// annoncent leur remplaçante avec les headers Deprecation et Link.
+
+// Date à partir de laquelle les anciennes routes sont dépréciées (header Deprecation, RFC 9745)
+var apiV1DeprecatedAt = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+
+// deprecated ajoute à la réponse d'une ancienne route les headers Deprecation et Link vers la route
+// qui la remplace. Les variables de successor ("{email}", "{id}") sont remplacées par celles de l'url,
+// et "{email}" à défaut par l'email du corps de la requête.
+func deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link := successor
+		for name, value := range mux.Vars(r) {
+			link = strings.ReplaceAll(link, "{"+name+"}", url.PathEscape(value))
+		}
+		if strings.Contains(link, "{email}") {
+			email := targetEmail(r)
+			if email == "" {
+				link = "/api/v2/profiles" // profil inconnu : lien vers la collection
+			}
+			link = strings.ReplaceAll(link, "{email}", url.PathEscape(email))
+		}
+
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(apiV1DeprecatedAt.Unix(), 10))
+		w.Header().Set("Link", "<"+link+`>; rel="successor-version"`)
+		next(w, r)
+	}
+}
+
+// listProfilesPolicy : la liste complète est réservée aux admins, la liste filtrée par type
+// aux modérateurs (comme POST /api/getAllUsersState)
+func listProfilesPolicy(r *http.Request, caller Profile) bool {
+	if r.URL.Query().Get("userType") != "" {
+		return profileRole(caller) >= roleModerator
+	}
+	return profileRole(caller) >= roleAdmin
+}
+
+// RemoveAvatar supprime l'avatar du profil, et l'image correspondante de la galerie comme le fait
+// un remplacement par Put. Aucune autre image ne devient l'avatar.
+func (p profileImages) RemoveAvatar(ctx context.Context, email string) error {
+	avatar, err := p.store.GetProfileImage(ctx, email)
+	if err != nil {
+		return err
+	}
+	gallery, err := p.store.ListGalleryImages(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	err = p.store.PutProfileImage(ctx, email, ProfileImage{})
+	if err != nil {
+		return err
+	}
+	p.Remove(ctx, avatar)
+
+	// L'avatar est déjà retiré : removeEntry ne choisit pas de nouvel avatar
+	if entry, ok := findGalleryImage(gallery, avatar.GalleryID); ok {
+		return p.removeEntry(ctx, email, entry)
+	}
+	return nil
+}
+
+// Suppression de l'image d'un profil : DELETE /api/v2/profiles/{email}/image
+
+func (a *apiHandlers) DeleteProfileImage(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := a.images.RemoveAvatar(r.Context(), mux.Vars(r)["email"])
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "Image supprimée")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Erreurs renvoyées lors de la vérification d'un token
+var (
+	ErrInvalidToken = errors.New("token invalide")
+	ErrExpiredToken = errors.New("token expiré")
+)
+
+// Claims contenus dans le token de session
+type tokenClaims struct {
+	Subject   string  `json:"sub"` // email du profil
+	IssuedAt  float64 `json:"iat"` // en secondes, à la microseconde près (NumericDate fractionnaire)
+	ExpiresAt int64   `json:"exp"`
+	Type      string  `json:"typ,omitempty"` // usage du token, absent pour les tokens de session
+	ID        string  `json:"jti,omitempty"` // identifiant aléatoire des tokens à usage unique
+}
+
+// issuedAtMicro renvoie iat en microsecondes Unix. Un float64 garde la microseconde pour les dates
+// actuelles (écart entre deux valeurs voisines ≈ 0,24 µs), l'arrondi retrouve la valeur émise.
+func (c tokenClaims) issuedAtMicro() int64 {
+	return int64(math.Round(c.IssuedAt * 1e6))
+}
+
+// tokenIssuer signe et vérifie des JWT HS256 (HMAC-SHA256) avec une clé secrète.
+// Les tokens d'un autre usage (typ) signés avec la même clé sont refusés par Verify.
+type tokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+	typ    string
+	ids    bool // ajoute un jti à chaque token
+}
+
+func newTokenIssuer(secret string, ttl time.Duration) *tokenIssuer {
+	key := []byte(secret)
+	if len(key) == 0 {
+		// Sans secret configuré, les tokens ne survivent pas à un redémarrage du serveur
+		log.Println("ATTENTION : TOKEN_SECRET non défini, un secret aléatoire est utilisé")
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &tokenIssuer{secret: key, ttl: ttl}
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Issue crée un token signé pour cet email, valable ttl
+func (t *tokenIssuer) Issue(email string, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(t.ttl)
+	claims := tokenClaims{
+		Subject:   email,
+		IssuedAt:  float64(now.UnixMicro()) / 1e6,
+		ExpiresAt: expiresAt.Unix(),
+		Type:      t.typ,
+	}
+	if t.ids {
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		claims.ID = base64.RawURLEncoding.EncodeToString(id)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + t.sign(unsigned), expiresAt, nil
+}
+
+// Verify vérifie la signature et l'expiration du token et renvoie ses claims
+func (t *tokenIssuer) Verify(token string, now time.Time) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return tokenClaims{}, ErrInvalidToken
+	}
+
+	expected := t.sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return tokenClaims{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return tokenClaims{}, ErrInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" || claims.Type != t.typ {
+		return tokenClaims{}, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return tokenClaims{}, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func (t *tokenIssuer) sign(unsigned string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Connexion : vérifie l'email et le mot de passe puis renvoie un token de session
+
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type sessionResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expiresAt"` // RFC 3339
+}
+
+func (a *apiHandlers) Login(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var body loginRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Erreur lors de la lecture du corps de la requête")
+		return
+	}
+
+	profile, err := a.store.GetProfile(r.Context(), body.Email)
+	if err != nil && !errors.Is(err, ErrProfileNotFound) {
+		writeStoreError(w, err)
+		return
+	}
+
+	// Même réponse que l'email soit inconnu ou le mot de passe faux
+	notFound := errors.Is(err, ErrProfileNotFound)
+	hash := profile.Password
+	if notFound {
+		hash = a.passwords.DummyHash()
+	}
+	match, rehash, err := a.passwords.Verify(hash, body.Password)
+	if err != nil {
+		log.Println("ERREUR : vérification du mot de passe de", body.Email, ":", err)
+	}
+	if notFound || !match {
+		writeError(w, http.StatusUnauthorized, "Email ou mot de passe incorrect")
+		return
+	}
+
+	// Le hash stocké utilise un ancien algorithme ou un ancien coût : on le remplace
+	// maintenant que l'on connaît le mot de passe. Un échec n'empêche pas la connexion.
+	if rehash {
+		newHash, err := a.passwords.Hash(body.Password)
+		if err == nil {
+			err = a.store.UpdateProfilePassword(r.Context(), profile.Email, newHash, time.Time{})
+		}
+		if err != nil {
+			log.Println("ERREUR : mise à jour du hash de", profile.Email, ":", err)
+		} else {
+			log.Println("Hash du mot de passe mis à jour : ", profile.Email)
+		}
+	}
+
+	token, expiresAt, err := a.tokens.Issue(profile.Email, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Impossible de créer le token")
+		return
+	}
+
+	json.NewEncoder(w).Encode(sessionResponse{
+		Token:     token,
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// Profil de l'utilisateur connecté
+
+func (a *apiHandlers) Me(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	profile, _ := currentProfile(r.Context())
+	json.NewEncoder(w).Encode(profile)
+}
+
+type contextKey string
+
+const profileContextKey contextKey = "profile"
+
+// currentProfile renvoie le profil authentifié par le middleware, s'il y en a un
+func currentProfile(ctx context.Context) (Profile, bool) {
+	profile, ok := ctx.Value(profileContextKey).(Profile)
+	return profile, ok
+}
+
+// AuthMiddleware lit le header "Authorization: Bearer <token>" et met le profil correspondant
+// dans le contexte de la requête. Sans header la requête continue en anonyme,
+// avec un token invalide ou expiré elle est refusée.
+func (a *apiHandlers) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "Header Authorization invalide")
+			return
+		}
+
+		claims, err := a.tokens.Verify(token, time.Now())
+		if errors.Is(err, ErrExpiredToken) {
+			writeError(w, http.StatusUnauthorized, "Token expiré")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "Token invalide")
+			return
+		}
+
+		// Le profil a pu être supprimé depuis la création du token
+		profile, err := a.store.GetProfile(r.Context(), claims.Subject)
+		if errors.Is(err, ErrProfileNotFound) {
+			writeError(w, http.StatusUnauthorized, "Token invalide")
+			return
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		// Token émis avant un changement ou une réinitialisation du mot de passe, ou dans la même microseconde.
+		// Une connexion avec le nouveau mot de passe vient forcément après : elle attend l'écriture du hash.
+		if !profile.PasswordChangedAt.IsZero() && claims.issuedAtMicro() <= profile.PasswordChangedAt.UnixMicro() {
+			writeError(w, http.StatusUnauthorized, "Token révoqué par un changement de mot de passe")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), profileContextKey, profile)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAuth refuse les requêtes sans profil authentifié
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := currentProfile(r.Context()); !ok {
+			writeError(w, http.StatusUnauthorized, "Authentification requise")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore stocke les données binaires des images, à part des profils qui n'en gardent que la clé.
+// Les clés sont des chemins relatifs séparés par des "/" (ex : "images/3f2a.../original.png").
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete ne renvoie pas d'erreur si la clé n'existe pas
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+var ErrBlobNotFound = errors.New("données de l'image non trouvées")
+
+// Valeurs possibles de --blob-store
+const (
+	blobStoreFS = "fs"
+	blobStoreS3 = "s3"
+)
+
+// openBlobStore ouvre le stockage des images choisi avec --blob-store
+func openBlobStore(cfg config) (BlobStore, error) {
+	switch cfg.BlobStore {
+	case blobStoreFS:
+		return newFSBlobStore(cfg.BlobDir)
+	case blobStoreS3:
+		return newS3BlobStore(cfg)
+	}
+	return nil, fmt.Errorf("stockage d'images inconnu %q", cfg.BlobStore)
+}
+
+// validBlobKey refuse les clés qui sortiraient du dossier ou du préfixe du stockage
+func validBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("clé de stockage invalide %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("clé de stockage invalide %q", key)
+		}
+	}
+	return nil
+}
+
+// Implémentation de BlobStore sur le système de fichiers local, une clé = un fichier sous dir
+type fsBlobStore struct {
+	dir string
+}
+
+func newFSBlobStore(dir string) (*fsBlobStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("impossible de créer le dossier des images %s : %w", dir, err)
+	}
+	return &fsBlobStore{dir: dir}, nil
+}
+
+func (f *fsBlobStore) path(key string) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.dir, filepath.FromSlash(key)), nil
+}
+
+// Put écrit le fichier à côté puis le renomme : une lecture ne voit jamais un fichier à moitié écrit
+func (f *fsBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // sans effet une fois le fichier renommé
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *fsBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (f *fsBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// On retire les dossiers devenus vides, sans jamais remonter au-delà de dir
+	for dir := filepath.Dir(path); dir != f.dir && strings.HasPrefix(dir, f.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fsBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(f.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".blob-") {
+			return nil
+		}
+		rel, err := filepath.Rel(f.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return ctx.Err()
+	})
+	return keys, err
+}
@@ -1,28 +1,65 @@
 package main
 
 import (
+	"context"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"os"
-	"path"
-	"path/filepath"
+	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"gorm.io/gorm"
-
-	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm/clause"
 )
 
 type UserCockroach struct {
-	Email    string                `gorm:"type:VARCHAR(255);primaryKey" json:"email"`
-	Password string                `gorm:"type:VARCHAR(255);not null" json:"password"`
-	Picture  *ImageBinaryCockroach `json:"picture"`
-	State    bool                  `gorm:"type:BOOLEAN;default:true" json:"state"`
-	UserType int                   `gorm:"type:INTEGER;default:1" json:"userType"`
+	Email            string                `gorm:"type:VARCHAR(255);primaryKey;index:idx_user_created,priority:2" json:"email"`
+	Password         string                `gorm:"type:VARCHAR(255);not null" json:"password"`
+	Picture          *ImageBinaryCockroach `json:"picture"`                                   // données des images envoyées avant le BlobStore
+	PictureKey       string                `gorm:"type:VARCHAR(255)" json:"pictureKey"`       // clé de l'original dans le BlobStore
+	PictureExtension string                `gorm:"type:VARCHAR(255)" json:"pictureExtension"` // Value() ne stocke que les bytes, l'extension est gardée à part
+	PictureUpdatedAt *time.Time            `json:"pictureUpdatedAt"`
+	PictureGalleryID string                `gorm:"type:VARCHAR(64)" json:"pictureGalleryId"` // image de la galerie choisie comme avatar
+	State            bool                  `gorm:"type:BOOLEAN;default:true" json:"state"`
+	UserType         int                   `gorm:"type:INTEGER;default:1" json:"userType"`
+	// Date de création en nanosecondes Unix, 0 pour les profils d'avant. L'index (created_at, email) sert au tri par date.
+	CreatedAt int64 `gorm:"not null;default:0;autoCreateTime:false;index:idx_user_created,priority:1" json:"createdAt"`
+	// Dernier changement du mot de passe en nanosecondes Unix, 0 si le mot de passe n'a jamais changé
+	PasswordChangedAt int64 `gorm:"not null;default:0" json:"-"`
+}
+
+// Version réduite de l'image d'un profil, table "image_variant_cockroaches"
+type ImageVariantCockroach struct {
+	Email string `gorm:"type:VARCHAR(255);primaryKey"`
+	Name  string `gorm:"type:VARCHAR(32);primaryKey"` // nom de la variante, ex : "64"
+	Key   string `gorm:"type:VARCHAR(255)"`           // clé de la variante dans le BlobStore
+}
+
+// Image de la galerie d'un profil, table "gallery_image_cockroaches"
+type GalleryImageCockroach struct {
+	ID          string    `gorm:"type:VARCHAR(64);primaryKey"`
+	Email       string    `gorm:"type:VARCHAR(255);not null;index"`
+	Caption     string    `gorm:"type:TEXT"`
+	Position    int       `gorm:"not null"`
+	Key         string    `gorm:"type:VARCHAR(255);not null"` // clé de l'original dans le BlobStore
+	Extension   string    `gorm:"type:VARCHAR(255)"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime:false"`
+	VariantKeys string    `gorm:"type:TEXT"` // clés des variantes en JSON, indexées par nom
+}
+
+// Compteur de références d'une image du BlobStore, table "image_ref_cockroaches"
+type ImageRefCockroach struct {
+	BlobKey   string    `gorm:"type:VARCHAR(255);primaryKey"`
+	Refs      int       `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null"`
+}
+
+// Demande de réinitialisation de mot de passe, table "password_reset_cockroaches"
+type PasswordResetCockroach struct {
+	TokenHash string    `gorm:"type:VARCHAR(64);primaryKey"`
+	Email     string    `gorm:"type:VARCHAR(255);not null"`
+	ExpiresAt time.Time `gorm:"not null"`
 }
 
 // Définition d'un nouveau type pour représenter l'image sous forme de données binaires
@@ -56,466 +93,569 @@ func (i ImageBinaryCockroach) Value() (driver.Value, error) {
 	return i.Data, nil
 }
 
-var db = db_cockroach()
-
-// Création d'un utilisateur
-
-func CreateProfileCockroach(w http.ResponseWriter, r *http.Request) {
-
-	w.Header().Set("Content-Type", "application/json")
+// Implémentation de ProfileStore au-dessus de GORM
+type gormStore struct {
+	db *gorm.DB
+}
 
-	// Vérifier si la table "user_cockroaches" existe déjà
-	if !db.Migrator().HasTable(&UserCockroach{}) {
-		// AutoMigrate pour créer la table "user_cockroaches" dans la base de données
-		err := db.AutoMigrate(&UserCockroach{})
+func newGormStore(db *gorm.DB) (*gormStore, error) {
+	// AutoMigrate pour créer la table "user_cockroaches" dans la base de données
+	err := db.AutoMigrate(&UserCockroach{})
+	if err != nil {
+		return nil, fmt.Errorf("impossible de créer la table 'user_cockroaches': %w", err)
+	}
+	err = db.AutoMigrate(&PasswordResetCockroach{})
+	if err != nil {
+		return nil, fmt.Errorf("impossible de créer la table 'password_reset_cockroaches': %w", err)
+	}
+	err = db.AutoMigrate(&ImageVariantCockroach{})
+	if err != nil {
+		return nil, fmt.Errorf("impossible de créer la table 'image_variant_cockroaches': %w", err)
+	}
+	err = db.AutoMigrate(&ImageRefCockroach{})
+	if err != nil {
+		return nil, fmt.Errorf("impossible de créer la table 'image_ref_cockroaches': %w", err)
+	}
+	err = db.AutoMigrate(&GalleryImageCockroach{})
+	if err != nil {
+		return nil, fmt.Errorf("impossible de créer la table 'gallery_image_cockroaches': %w", err)
+	}
+	// Les variantes étaient stockées dans la table avant le BlobStore : la colonne NOT NULL empêcherait les insertions.
+	// Les variantes sans clé sont recalculées à la volée à partir de l'original.
+	if db.Migrator().HasColumn(&ImageVariantCockroach{}, "data") {
+		err = db.Migrator().DropColumn(&ImageVariantCockroach{}, "data")
 		if err != nil {
-			log.Fatalf("Impossible de créer la table 'user_cockroaches': %s", err.Error())
-			return
+			return nil, fmt.Errorf("impossible de migrer la table 'image_variant_cockroaches': %w", err)
 		}
-
-		fmt.Println("Table 'user_cockroaches' créée avec succès")
-	} else {
-		fmt.Println("La table 'user_cockroaches' existe déjà")
 	}
+	return &gormStore{db: db}, nil
+}
 
-	var person UserCockroach
-	err := json.NewDecoder(r.Body).Decode(&person)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Erreur lors de la lecture du corps de la requête"}`))
-		return
+func (u UserCockroach) toProfile() Profile {
+	return Profile{
+		Email:             u.Email,
+		Password:          u.Password,
+		State:             u.State,
+		UserType:          u.UserType,
+		CreatedAt:         createdAtTime(u.CreatedAt),
+		PasswordChangedAt: createdAtTime(u.PasswordChangedAt),
 	}
+}
 
-	// Vérification si l'e-mail est déjà utilisé
-	var result UserCockroach
-	err = db.Where("email = ?", person.Email).First(&result).Error
-	if err == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email déjà utilisé"}`))
-		return
-	}
+// Création d'un utilisateur
 
-	// Hashage du mot de passe
-	hashedPassword, err := hashPassword(person.Password)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Erreur lors du hashage du mot de passe"}`))
-		return
+// L'email est la clé primaire : c'est la base qui refuse un email déjà utilisé, même entre deux créations simultanées
+func (g *gormStore) CreateProfile(ctx context.Context, profile Profile) error {
+	err := g.db.WithContext(ctx).Model(&UserCockroach{}).Create(profileColumns(profile)).Error
+	if isDuplicateKey(err) {
+		return ErrEmailAlreadyUsed
 	}
-	person.Password = hashedPassword
+	return err
+}
 
-	// Vérification du type d'utilisateur
-	if person.UserType != 1 && person.UserType != 2 && person.UserType != 3 {
-		person.UserType = 1
+// CreateInBatches fait tous les lots dans une transaction : en cas d'erreur, aucun profil n'est inséré
+func (g *gormStore) CreateProfiles(ctx context.Context, profiles []Profile) (int, error) {
+	rows := make([]map[string]interface{}, 0, len(profiles))
+	for _, profile := range profiles {
+		rows = append(rows, profileColumns(profile))
+	}
+	err := g.db.WithContext(ctx).Model(&UserCockroach{}).CreateInBatches(rows, 100).Error
+	if isDuplicateKey(err) {
+		return 0, ErrEmailAlreadyUsed
 	}
-
-	err = db.Create(&person).Error
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Erreur lors de la création du profil"}`))
-		return
+		return 0, err
 	}
+	return len(profiles), nil
+}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(person)
-
+// isDuplicateKey reconnaît la violation d'une clé unique. Avec TranslateError, GORM renvoie ErrDuplicatedKey
+// pour CockroachDB ; le driver SQLite ne traduit que les index UNIQUE, pas la clé primaire.
+func isDuplicateKey(err error) bool {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique)
 }
 
-func CreateHTMLPageCockroach(w http.ResponseWriter, r *http.Request) {
+// Création via une map : avec une struct, GORM remplacerait un State à false par le default:true
+func profileColumns(profile Profile) map[string]interface{} {
+	return map[string]interface{}{
+		"email":      profile.Email,
+		"password":   profile.Password,
+		"state":      profile.State,
+		"user_type":  profile.UserType,
+		"created_at": createdAtNanos(profile.CreatedAt),
+	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
+// Récupération d'un utilisateur avec son email
 
-	var body UserCockroach
-	err := json.NewDecoder(r.Body).Decode(&body)
+func (g *gormStore) GetProfile(ctx context.Context, email string) (Profile, error) {
+	user, err := g.findUser(ctx, email)
 	if err != nil {
-		fmt.Println(err)
+		return Profile{}, err
 	}
+	return user.toProfile(), nil
+}
 
-	// On récupère les informations de l'utilisateur et on crée la page HTML
-	var user UserCockroach
-	err = db.Where("email = ?", body.Email).First(&user).Error
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email non trouvé"}`))
-		return
-	}
+// Récupération de tous les utilisateurs
 
-	// On crée le fichier HTML
-	file, err := os.Create("./html_pages/" + user.Email + ".html")
+func (g *gormStore) ListProfiles(ctx context.Context) ([]Profile, error) {
+	var users []UserCockroach
+	err := g.db.WithContext(ctx).Omit("picture").Find(&users).Error
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer file.Close()
+	return usersToProfiles(users), nil
+}
 
-	// On écrit le contenu du fichier HTML
-	_, err = io.WriteString(file, "<html><head><title>Page de profil</title></head><body><h1>Page de profil</h1><p>Email : "+user.Email+"</p><p>Etat : "+fmt.Sprint(user.State)+"</p><p>Type d'utilisateur : "+fmt.Sprint(user.UserType)+"</p><img src='../images/"+user.Email+user.Picture.FileExtension+"' /></body></html>")
+func (g *gormStore) ListProfilesByType(ctx context.Context, userType int) ([]Profile, error) {
+	var users []UserCockroach
+	err := g.db.WithContext(ctx).Omit("picture").Where("user_type = ?", userType).Find(&users).Error
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	// On met un message de succès
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Fichier HTML créé avec succès, dans le répertoire html_pages"}`))
-
+	return usersToProfiles(users), nil
 }
 
-// Récupération d'un utilisateur avec son email
-
-func GetUserProfileCockroach(w http.ResponseWriter, r *http.Request) {
-
-	w.Header().Set("Content-Type", "application/json")
-
-	// Lire le corps de la requête pour obtenir les données
-	body, err := ioutil.ReadAll(r.Body)
+// Pagination par clé (keyset) : la page suivante reprend après le dernier (created_at, email) lu,
+// sans OFFSET. Une ligne de plus que la limite est lue pour savoir s'il reste une page.
+func (g *gormStore) ListProfilesPage(ctx context.Context, query ProfileQuery) (ProfilePage, error) {
+	var users []UserCockroach
+	err := g.profilesQuery(ctx, query).Limit(query.Limit + 1).Find(&users).Error
 	if err != nil {
-		// Gérer l'erreur de lecture du corps de la requête
-		http.Error(w, "ERREUR : erreur lors de la lecture de la requête", http.StatusBadRequest)
-		return
+		return ProfilePage{}, err
 	}
 
-	// Définir une struct pour extraire les données du corps de la requête
-	type RequestData struct {
-		Email string `json:"email"`
+	page := ProfilePage{Profiles: usersToProfiles(users)}
+	if len(page.Profiles) > query.Limit {
+		page.Profiles = page.Profiles[:query.Limit]
+		page.Next = cursorOf(page.Profiles[query.Limit-1])
 	}
+	return page, nil
+}
 
-	// Décoder le corps de la requête dans la struct RequestData
-	var requestData RequestData
-	err = json.Unmarshal(body, &requestData)
+// Les lignes sont lues une à une avec Rows, sans charger le résultat en mémoire
+func (g *gormStore) StreamProfiles(ctx context.Context, query ProfileQuery, fn func(Profile) error) error {
+	query.After = nil
+	db := g.profilesQuery(ctx, query)
+	rows, err := db.Rows()
 	if err != nil {
-		// Gérer l'erreur de décodage du corps de la requête
-		http.Error(w, "ERREUR : erreur lors du décodage de la requête", http.StatusBadRequest)
-		return
+		return err
 	}
+	defer rows.Close()
 
-	var user UserCockroach
-	err = db.Where("email = ?", requestData.Email).First(&user).Error
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(`{"Erreur": "Utilisateur non trouvé"}`))
-		} else {
-			log.Fatal(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"Erreur": "Erreur lors de la récupération du profil d'utilisateur"}`))
+	for rows.Next() {
+		var user UserCockroach
+		err := db.ScanRows(rows, &user)
+		if err != nil {
+			return err
+		}
+		err = fn(user.toProfile())
+		if err != nil {
+			return err
 		}
-		return
 	}
-
-	json.NewEncoder(w).Encode(user)
-
+	return rows.Err()
 }
 
-// Update d'un utilisateur sur son état
-
-func UpdateProfileCockroach(w http.ResponseWriter, r *http.Request) {
-
-	w.Header().Set("Content-Type", "application/json")
-
-	type updateBody struct {
-		Email string `json:"email"` // l'email de l'utilisateur pour le trouver et le modifier
-		State bool   `json:"state"` // le nouvel état de l'utilisateur qui sera mis à jour
+// profilesQuery sélectionne les profils filtrés et triés de la requête, à partir de query.After,
+// sans le mot de passe ni les images
+func (g *gormStore) profilesQuery(ctx context.Context, query ProfileQuery) *gorm.DB {
+	db := g.db.WithContext(ctx).Model(&UserCockroach{}).Select("email", "state", "user_type", "created_at")
+	if query.State != nil {
+		db = db.Where("state = ?", *query.State)
 	}
-
-	var requestData updateBody
-	e := json.NewDecoder(r.Body).Decode(&requestData)
-	if e != nil {
-
-		fmt.Print(e)
+	if query.UserType != nil {
+		db = db.Where("user_type = ?", *query.UserType)
 	}
 
-	var user UserCockroach
-	err := db.Where("email = ?", requestData.Email).First(&user).Error
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(`{"Erreur": "Utilisateur non trouvé"}`))
+	cmp, dir := ">", "ASC"
+	if query.Descending {
+		cmp, dir = "<", "DESC"
+	}
+	if after := query.After; after != nil {
+		if query.Sort == sortByCreated {
+			db = db.Where("(created_at "+cmp+" ? OR (created_at = ? AND email "+cmp+" ?))", after.CreatedAt, after.CreatedAt, after.Email)
 		} else {
-			log.Fatal(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"Erreur": "Erreur lors de la recherche de l'utilisateur à mettre à jour"}`))
+			db = db.Where("email "+cmp+" ?", after.Email)
 		}
-		return
 	}
-
-	user.State = requestData.State
-
-	err = db.Save(&user).Error
-	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Erreur lors de la mise à jour du profil d'utilisateur"}`))
-		return
+	if query.Sort == sortByCreated {
+		db = db.Order("created_at " + dir)
 	}
-
-	w.Write([]byte(`{"Message": "Profil d'utilisateur mis à jour avec succès"}`))
+	return db.Order("email " + dir)
 }
 
-func UploadProfileImageCockroach(w http.ResponseWriter, r *http.Request) {
+func (g *gormStore) CountProfiles(ctx context.Context) (int, error) {
+	var count int64
+	err := g.db.WithContext(ctx).Model(&UserCockroach{}).Count(&count).Error
+	return int(count), err
+}
 
-	w.Header().Set("Content-Type", "multipart/form-data")
+// Update d'un utilisateur sur son état
 
-	// Parse le corps de la requête pour récupérer le formulaire multipart
-	err := r.ParseMultipartForm(16 << 20) // taille maximale du fichier : 16 Mo
+func (g *gormStore) UpdateProfileState(ctx context.Context, email string, state bool) (Profile, error) {
+	user, err := g.findUser(ctx, email)
 	if err != nil {
-		http.Error(w, "Erreur lors de la lecture du formulaire", http.StatusBadRequest)
-		return
+		return Profile{}, err
 	}
 
-	// On lit le fichier image envoyé
-	file, handler, err := r.FormFile("image")
+	err = g.db.WithContext(ctx).Model(&user).Update("state", state).Error
 	if err != nil {
-		fmt.Println("Erreur : récupération du fichier impossible")
-		fmt.Println(err)
-		return
-	}
-	defer file.Close()
-
-	// On vérifie que le fichier est bien une image
-	if handler.Header.Get("Content-Type") != "image/jpeg" && handler.Header.Get("Content-Type") != "image/png" && handler.Header.Get("Content-Type") != "image/jpg" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Le fichier n'est pas une image"}`))
-		return
-	}
-
-	// Lire les bytes de l'image
-	var imageBytes []byte
-	buf := make([]byte, 1024) // créer un tampon de 1 Ko pour lire les données du fichier par morceaux
-	for {
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			fmt.Println("Erreur : lecture des bytes de l'image impossible")
-			fmt.Println(err)
-			return
-		}
-		if n == 0 {
-			break
-		}
-		imageBytes = append(imageBytes, buf[:n]...)
+		return Profile{}, err
 	}
+	user.State = state
+	return user.toProfile(), nil
+}
 
-	fileName := handler.Filename
-	fileExtension := filepath.Ext(fileName)
-
-	fmt.Println("Extension  : ", fileExtension)
+// Changement du mot de passe d'un utilisateur, passwordHash est déjà haché
 
-	// Créer un nouveau modèle UserCockroach avec les données de l'image
-	imageBinary := ImageBinaryCockroach{
-		Data:          imageBytes,
-		FileExtension: fileExtension,
+func (g *gormStore) UpdateProfilePassword(ctx context.Context, email string, passwordHash string, changedAt time.Time) error {
+	columns := map[string]interface{}{"password": passwordHash}
+	if changedAt.IsZero() {
+		return g.updatePassword(g.db.WithContext(ctx), email, columns)
 	}
+	columns["password_changed_at"] = createdAtNanos(changedAt)
+	return g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := g.updatePassword(tx, email, columns)
+		if err != nil {
+			return err
+		}
+		return tx.Where("email = ?", email).Delete(&PasswordResetCockroach{}).Error
+	})
+}
 
-	fmt.Println("L'extension de l'image qu'on veut enregistrer est : ", imageBinary.FileExtension)
-
-	// On récupère l'email de l'utilisateur
-	email := r.FormValue("email")
-	// Si l'email n'existe pas dans la table user_cockroach, on renvoie une erreur
-	var user UserCockroach
-	result := db.Where("email = ?", email).First(&user)
-	if result.Error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email non trouvé"}`))
-		return
+func (g *gormStore) updatePassword(db *gorm.DB, email string, columns map[string]interface{}) error {
+	res := db.Model(&UserCockroach{}).Where("email = ?", email).Updates(columns)
+	if res.Error != nil {
+		return res.Error
 	}
-
-	// On met à jour l'image de l'utilisateur
-	user.Picture = &imageBinary
-
-	result = db.Save(&user)
-	if result.Error != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Échec de la mise à jour de l'image de l'utilisateur"}`))
-		return
+	if res.RowsAffected == 0 {
+		return ErrProfileNotFound
 	}
-
-	// on envoie un message de succès
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Image envoyée"}`))
+	return nil
 }
 
-func GetProfileImageCockroach(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	type response struct {
-		Email string `json:"email"`
-	}
-
-	// Récupérer l'email de l'utilisateur
-	var body response
-	err := json.NewDecoder(r.Body).Decode(&body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email non trouvé"}`))
-		return
-	}
+// Suppression d'un utilisateur
 
-	email := body.Email
+func (g *gormStore) DeleteProfile(ctx context.Context, email string) error {
+	return g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("email = ?", email).Delete(&UserCockroach{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrProfileNotFound
+		}
+		err := tx.Where("email = ?", email).Delete(&ImageVariantCockroach{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("email = ?", email).Delete(&PasswordResetCockroach{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("email = ?", email).Delete(&GalleryImageCockroach{}).Error
+	})
+}
 
-	// Rechercher l'utilisateur dans la base de données
-	var userCockroach UserCockroach
-	err = db.Where("email = ?", email).First(&userCockroach).Error
+// Supprime les tables des profils, des images, des compteurs de références et des réinitialisations
+// de mot de passe puis les recrée
+func (g *gormStore) DeleteAllProfiles(ctx context.Context) error {
+	tables := []interface{}{&UserCockroach{}, &ImageVariantCockroach{}, &GalleryImageCockroach{}, &ImageRefCockroach{}, &PasswordResetCockroach{}}
+	err := g.db.WithContext(ctx).Migrator().DropTable(tables...)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Utilisateur non trouvé"}`))
-		return
+		return err
 	}
+	return g.db.WithContext(ctx).AutoMigrate(tables...)
+}
 
-	// Récupérer les données d'image
-	imageBinary := userCockroach.Picture
-	imageBytes := imageBinary.Data
-
-	// Récupérer l'extension du fichier
-	fileExtension := imageBinary.FileExtension
-	fmt.Println("Extension du fichier image à charger :", fileExtension)
-
-	// Créer le nom du fichier
-	fileName := userCockroach.Email + fileExtension
-	cleanFileName := filepath.Clean(fileName)
+// L'image et ses variantes sont remplacées dans la même transaction
+func (g *gormStore) PutProfileImage(ctx context.Context, email string, image ProfileImage) error {
+	return g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// picture est vidée : les données des images d'avant le BlobStore ne servent plus
+		res := tx.Model(&UserCockroach{}).Where("email = ?", email).Updates(map[string]interface{}{
+			"picture":            nil,
+			"picture_key":        image.Key,
+			"picture_extension":  image.Extension,
+			"picture_updated_at": image.UpdatedAt,
+			"picture_gallery_id": image.GalleryID,
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrProfileNotFound
+		}
 
-	// Créer le fichier dans l'arborescence du projet
-	filePath := path.Join("./images", cleanFileName) // Chemin du fichier dans l'arborescence du projet
-	fmt.Println("Chemin du dossier images :", path.Dir(filePath))
+		err := tx.Where("email = ?", email).Delete(&ImageVariantCockroach{}).Error
+		if err != nil {
+			return err
+		}
+		for name, key := range image.Variants {
+			err = tx.Create(&ImageVariantCockroach{Email: email, Name: name, Key: key}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	// Créer le fichier
-	file, err := os.Create(filePath)
+func (g *gormStore) GetProfileImage(ctx context.Context, email string) (ProfileImage, error) {
+	user, err := g.findUser(ctx, email)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Impossible de créer le fichier d'image"}`))
-		fmt.Println(err)
-		return
+		return ProfileImage{}, err
+	}
+	legacy := user.Picture != nil && len(user.Picture.Data) > 0
+	if user.PictureKey == "" && !legacy {
+		return ProfileImage{}, ErrImageNotFound
+	}
+	image := ProfileImage{
+		Key:       user.PictureKey,
+		Extension: user.PictureExtension,
+		GalleryID: user.PictureGalleryID,
+	}
+	if legacy {
+		image.Data = user.Picture.Data
+	}
+	if user.PictureUpdatedAt != nil {
+		image.UpdatedAt = *user.PictureUpdatedAt
 	}
-	defer file.Close()
 
-	// Écrire les données d'image dans le fichier
-	_, err = file.Write(imageBytes)
+	var variants []ImageVariantCockroach
+	err = g.db.WithContext(ctx).Where("email = ?", email).Find(&variants).Error
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Impossible d'écrire les données d'image dans le fichier"}`))
-		fmt.Println(err)
-		return
+		return ProfileImage{}, err
+	}
+	if len(variants) > 0 {
+		image.Variants = make(map[string]string, len(variants))
+		for _, variant := range variants {
+			// Les variantes d'avant le BlobStore n'ont pas de clé, elles sont recalculées
+			if variant.Key != "" {
+				image.Variants[variant.Name] = variant.Key
+			}
+		}
 	}
-
-	// On met un message de succès
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Image créée"}`))
+	return image, nil
 }
 
-// Suppression d'un utilisateur
-
-func DeleteProfileCockroach(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	// Lire le corps de la requête pour obtenir les données
-	body, err := ioutil.ReadAll(r.Body)
+func (g *gormStore) ListGalleryImages(ctx context.Context, email string) ([]GalleryImage, error) {
+	_, err := g.findUser(ctx, email)
 	if err != nil {
-		http.Error(w, "ERREUR : erreur lors de la lecture de la requête", http.StatusBadRequest)
-		return
+		return nil, err
 	}
 
-	// Définir une struct pour extraire les données du corps de la requête
-	type RequestData struct {
-		Email string `json:"email"`
-	}
-
-	// Décoder le corps de la requête dans la struct RequestData
-	var requestData RequestData
-	err = json.Unmarshal(body, &requestData)
+	var rows []GalleryImageCockroach
+	err = g.db.WithContext(ctx).Where("email = ?", email).Order("position, id").Find(&rows).Error
 	if err != nil {
-		http.Error(w, "ERREUR : erreur lors du décodage de la requête", http.StatusBadRequest)
-		return
+		return nil, err
+	}
+	images := make([]GalleryImage, 0, len(rows))
+	for _, row := range rows {
+		image := GalleryImage{
+			ID:       row.ID,
+			Caption:  row.Caption,
+			Position: row.Position,
+			Image:    ProfileImage{Key: row.Key, Extension: row.Extension, UpdatedAt: row.UpdatedAt},
+		}
+		if row.VariantKeys != "" {
+			err = json.Unmarshal([]byte(row.VariantKeys), &image.Image.Variants)
+			if err != nil {
+				return nil, fmt.Errorf("variantes de l'image %s illisibles : %w", row.ID, err)
+			}
+		}
+		images = append(images, image)
 	}
+	return images, nil
+}
 
-	var user UserCockroach
-	err = db.Where("email = ?", requestData.Email).First(&user).Error
+// La limite est vérifiée dans l'INSERT lui-même (INSERT ... SELECT ... WHERE nombre < limite) : une seule
+// instruction, atomique sous SQLite comme sous CockroachDB, là où un comptage suivi d'un ajout laisserait
+// passer deux envois simultanés.
+func (g *gormStore) AddGalleryImage(ctx context.Context, email string, image GalleryImage, maxImages int) error {
+	_, err := g.findUser(ctx, email)
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(`{"Erreur": "Utilisateur non trouvé"}`))
-		} else {
-			log.Fatal(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"Erreur": "Erreur lors de la recherche de l'utilisateur à supprimer"}`))
-		}
-		return
+		return err
 	}
 
-	err = db.Delete(&user).Error
+	variants, err := json.Marshal(image.Image.Variants)
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Erreur lors de la suppression de l'utilisateur"}`))
-		return
+		return err
+	}
+	row := GalleryImageCockroach{
+		ID:          image.ID,
+		Email:       email,
+		Caption:     image.Caption,
+		Position:    image.Position,
+		Key:         image.Image.Key,
+		Extension:   image.Image.Extension,
+		UpdatedAt:   image.Image.UpdatedAt,
+		VariantKeys: string(variants),
+	}
+	if maxImages <= 0 {
+		return g.db.WithContext(ctx).Create(&row).Error
+	}
+
+	res := g.db.WithContext(ctx).Exec(`INSERT INTO gallery_image_cockroaches
+		("id", "email", "caption", "position", "key", "extension", "updated_at", "variant_keys")
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE (SELECT COUNT(*) FROM gallery_image_cockroaches WHERE "email" = ?) < ?`,
+		row.ID, row.Email, row.Caption, row.Position, row.Key, row.Extension, row.UpdatedAt, row.VariantKeys,
+		email, maxImages)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrGalleryFull
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Utilisateur supprimé"}`))
+	return nil
 }
 
-// Récupération de tous les utilisateurs
+func (g *gormStore) UpdateGalleryImage(ctx context.Context, email string, image GalleryImage) error {
+	res := g.db.WithContext(ctx).Model(&GalleryImageCockroach{}).Where("email = ? AND id = ?", email, image.ID).
+		UpdateColumns(map[string]interface{}{"caption": image.Caption, "position": image.Position})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return g.galleryNotFound(ctx, email)
+	}
+	return nil
+}
 
-func GetAllUsersCockroach(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func (g *gormStore) DeleteGalleryImage(ctx context.Context, email string, id string) error {
+	res := g.db.WithContext(ctx).Where("email = ? AND id = ?", email, id).Delete(&GalleryImageCockroach{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return g.galleryNotFound(ctx, email)
+	}
+	return nil
+}
 
-	var users []UserCockroach
-	err := db.Find(&users).Error
+// galleryNotFound distingue un profil absent d'une image absente de la galerie
+func (g *gormStore) galleryNotFound(ctx context.Context, email string) error {
+	_, err := g.findUser(ctx, email)
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Erreur lors de la récupération des utilisateurs"}`))
-		return
+		return err
 	}
+	return ErrImageNotFound
+}
 
-	json.NewEncoder(w).Encode(users)
+// L'upsert incrémente le compteur en une seule requête, sans lecture préalable
+func (g *gormStore) AcquireBlob(ctx context.Context, key string, now time.Time) error {
+	return g.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "blob_key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"refs":       gorm.Expr(`"image_ref_cockroaches"."refs" + 1`),
+			"updated_at": now,
+		}),
+	}).Create(&ImageRefCockroach{BlobKey: key, Refs: 1, UpdatedAt: now}).Error
 }
 
-func getAllUsersTypeCockroach(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func (g *gormStore) ReleaseBlob(ctx context.Context, key string, now time.Time) (int, error) {
+	var remaining int
+	err := g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&ImageRefCockroach{}).Where("blob_key = ? AND refs > 0", key).UpdateColumn("refs", gorm.Expr("refs - 1")).Error
+		if err != nil {
+			return err
+		}
 
-	// On récupère le UserType à filtrer depuis le corps de la requête
-	var requestBody struct {
-		UserType int `json:"user_type"`
-	}
+		var ref ImageRefCockroach
+		err = tx.Where("blob_key = ?", key).First(&ref).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ref.Refs > 0 {
+			remaining = ref.Refs
+			return nil
+		}
+		// Date de libération, pour le délai de grâce du ramasse-miettes
+		return tx.Model(&ImageRefCockroach{}).Where("blob_key = ? AND refs <= 0", key).UpdateColumn("updated_at", now).Error
+	})
+	return remaining, err
+}
 
-	err := json.NewDecoder(r.Body).Decode(&requestBody)
+func (g *gormStore) ListBlobRefs(ctx context.Context) ([]BlobRef, error) {
+	var rows []ImageRefCockroach
+	err := g.db.WithContext(ctx).Find(&rows).Error
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Requête JSON invalide"}`))
-		return
+		return nil, err
+	}
+	refs := make([]BlobRef, 0, len(rows))
+	for _, row := range rows {
+		refs = append(refs, BlobRef{Key: row.BlobKey, Count: row.Refs, UpdatedAt: row.UpdatedAt})
 	}
+	return refs, nil
+}
 
-	// On récupère tous les utilisateurs avec le UserType spécifié
-	var users []UserCockroach
-	err = db.Where("user_type = ?", requestBody.UserType).Find(&users).Error
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Erreur lors de la récupération des utilisateurs"}`))
-		return
+func (g *gormStore) SetBlobRef(ctx context.Context, ref BlobRef) error {
+	if ref.Count <= 0 {
+		return g.db.WithContext(ctx).Where("blob_key = ?", ref.Key).Delete(&ImageRefCockroach{}).Error
 	}
+	return g.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "blob_key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"refs", "updated_at"}),
+	}).Create(&ImageRefCockroach{BlobKey: ref.Key, Refs: ref.Count, UpdatedAt: ref.UpdatedAt}).Error
+}
 
-	// On retourne les utilisateurs en JSON
-	json.NewEncoder(w).Encode(users)
+func (g *gormStore) CreatePasswordReset(ctx context.Context, reset PasswordReset) error {
+	return g.db.WithContext(ctx).Create(&PasswordResetCockroach{
+		TokenHash: reset.TokenHash,
+		Email:     reset.Email,
+		ExpiresAt: reset.ExpiresAt,
+	}).Error
 }
 
-func DropTableAndRecreateCockroach(w http.ResponseWriter, r *http.Request) {
-	// Supprimer la table "users"
-	err := db.Migrator().DropTable("user_cockroaches")
+func (g *gormStore) ConsumePasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error) {
+	var reset PasswordResetCockroach
+	err := g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("token_hash = ?", tokenHash).First(&reset).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrResetNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		// Si une autre requête a supprimé la ligne entre temps, le token a déjà servi
+		res := tx.Where("token_hash = ?", tokenHash).Delete(&PasswordResetCockroach{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrResetNotFound
+		}
+		return nil
+	})
 	if err != nil {
-		return
+		return PasswordReset{}, err
 	}
-	fmt.Println("Table 'users' supprimée avec succès")
+	return PasswordReset{TokenHash: reset.TokenHash, Email: reset.Email, ExpiresAt: reset.ExpiresAt}, nil
+}
 
-	// Recréer la table "users"
-	err = db.AutoMigrate(&UserCockroach{})
-	if err != nil {
-		return
+func (g *gormStore) findUser(ctx context.Context, email string) (UserCockroach, error) {
+	var user UserCockroach
+	err := g.db.WithContext(ctx).Where("email = ?", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return UserCockroach{}, ErrProfileNotFound
 	}
-	fmt.Println("Table 'users' recréée avec succès")
+	return user, err
 }
 
-func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14) // on hash le mot de passe avec bcrypt
-	return string(bytes), err
+func usersToProfiles(users []UserCockroach) []Profile {
+	profiles := make([]Profile, 0, len(users))
+	for _, user := range users {
+		profiles = append(profiles, user.toProfile())
+	}
+	return profiles
 }
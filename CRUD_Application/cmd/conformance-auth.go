@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+)
+
+// conformanceAuthSteps couvre la connexion, le changement et la réinitialisation du mot de passe
+func conformanceAuthSteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "connexion",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.login("a", conformanceEmailA, "secret")
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "connexion d'un user",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.login("c", conformanceEmailC, "secret")
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "connexion avec un mauvais mot de passe",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/login", map[string]interface{}{"email": conformanceEmailA, "password": "faux"})
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "connexion avec un email inconnu",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/login", map[string]interface{}{"email": "inconnu@example.com", "password": "secret"})
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "profil connecté",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("GET", "/api/me", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("email", conformanceEmailA)),
+		},
+		{
+			name: "token invalide",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.withToken("pas.un.token").json("GET", "/api/me", nil)
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "changer son mot de passe sans être connecté",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/changePassword", map[string]interface{}{"oldPassword": "secret", "newPassword": "nouveau"})
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "changer son mot de passe avec un mauvais ancien mot de passe",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").json("POST", "/api/changePassword", map[string]interface{}{"oldPassword": "faux", "newPassword": "nouveau"})
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "changer son mot de passe",
+			do: func(c *conformanceClient) (observation, error) {
+				c.tokens["c:avant"] = c.tokens["c"]
+				return c.as("c").json("POST", "/api/changePassword", map[string]interface{}{"oldPassword": "secret", "newPassword": "nouveau"})
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "le token d'avant le changement de mot de passe est révoqué",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c:avant").json("GET", "/api/me", nil)
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "l'ancien mot de passe ne fonctionne plus",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/login", map[string]interface{}{"email": conformanceEmailC, "password": "secret"})
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "connexion avec le nouveau mot de passe",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.login("c", conformanceEmailC, "nouveau")
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "demander une réinitialisation",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/requestPasswordReset", map[string]interface{}{"email": conformanceEmailC})
+			},
+			expect: expectStatus(http.StatusAccepted),
+		},
+		{
+			name: "demander une réinitialisation pour un email inconnu",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/requestPasswordReset", map[string]interface{}{"email": "inconnu@example.com"})
+			},
+			expect: expectStatus(http.StatusAccepted),
+		},
+		{
+			name: "réinitialiser avec un token invalide",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/resetPassword", map[string]interface{}{"token": "pas-un-token", "newPassword": "reinitialise"})
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+		{
+			name: "réinitialiser avec le token reçu",
+			do: func(c *conformanceClient) (observation, error) {
+				token, err := c.notifiedResetToken(conformanceEmailC)
+				if err != nil {
+					return observation{}, err
+				}
+				c.tokens["reset"] = token
+				return c.json("POST", "/api/resetPassword", map[string]interface{}{"token": token, "newPassword": "reinitialise"})
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "le token de réinitialisation ne sert qu'une fois",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/resetPassword", map[string]interface{}{"token": c.tokens["reset"], "newPassword": "encore"})
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+		{
+			name: "connexion avec le mot de passe réinitialisé",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.login("c", conformanceEmailC, "reinitialise")
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "le nouveau token fonctionne après la réinitialisation",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").json("GET", "/api/me", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("email", conformanceEmailC)),
+		},
+		{
+			name: "demander une réinitialisation puis changer son mot de passe",
+			do: func(c *conformanceClient) (observation, error) {
+				obs, err := c.json("POST", "/api/requestPasswordReset", map[string]interface{}{"email": conformanceEmailC})
+				if err != nil || obs.Status != http.StatusAccepted {
+					return obs, err
+				}
+				return c.as("c").json("POST", "/api/changePassword", map[string]interface{}{"oldPassword": "reinitialise", "newPassword": "secret"})
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "le changement de mot de passe annule la réinitialisation en cours",
+			do: func(c *conformanceClient) (observation, error) {
+				token, err := c.notifiedResetToken(conformanceEmailC)
+				if err != nil {
+					return observation{}, err
+				}
+				return c.json("POST", "/api/resetPassword", map[string]interface{}{"token": token, "newPassword": "encore"})
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+		{
+			name: "connexion après le changement",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.login("c", conformanceEmailC, "secret")
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+	}
+}
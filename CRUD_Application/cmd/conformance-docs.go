@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+)
+
+// conformanceDocsSteps vérifie la documentation de l'API et la couverture de la spécification
+func conformanceDocsSteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "documentation de l'API",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.withToken("").json("GET", "/api/docs", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectContains(`<script src="docs/app.js">`)),
+		},
+		{
+			name: "chaque route appelée par la suite est dans la spécification OpenAPI",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.withToken("").undocumentedCalls()
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody("")),
+		},
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+)
+
+// conformanceGallerySteps couvre la galerie de C et le choix de l'avatar
+func conformanceGallerySteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "l'image envoyée est dans la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").gallery(conformanceEmailC)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody("*")),
+		},
+		{
+			name: "ajouter une image à la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").galleryUpload(conformanceEmailC, "paysage", false, "paysage.png", "image/png", conformanceLargePNG)
+			},
+			expect: expectStatus(http.StatusCreated),
+		},
+		{
+			name: "ajouter une image principale à la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").galleryUpload(conformanceEmailC, "photo", true, "photo.jpg", "image/jpeg", conformancePhotoJPEG)
+			},
+			expect: expectAll(expectStatus(http.StatusCreated), expectMetadataReport(6, "comment", "exif", "gps", "xmp")),
+		},
+		{
+			name: "lister la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").gallery(conformanceEmailC)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(" | paysage | *photo")),
+		},
+		{
+			name: "ajouter une image à une galerie pleine",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").galleryUpload(conformanceEmailC, "de trop", false, "paysage.png", "image/png", conformanceLargePNG)
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+		{
+			name: "l'avatar est l'image principale",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").image(conformanceEmailC, "original", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageSize(20, 40)),
+		},
+		{
+			name: "légender une image de la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").updateGalleryImage(conformanceEmailC, "", map[string]interface{}{"caption": "animation"})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("caption", "animation"), expectField("primary", false)),
+		},
+		{
+			name: "réordonner la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				c.tokens["gallery:animation"] = c.tokens["gallery:"]
+				return c.as("c").reorderGallery(conformanceEmailC, "photo", "paysage", "animation")
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody("*photo | paysage | animation")),
+		},
+		{
+			name: "réordonner avec une liste incomplète",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").reorderGallery(conformanceEmailC, "photo", "photo", "paysage")
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+		{
+			name: "télécharger la variante 64px d'une image de la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").json("GET", "/api/profiles/"+conformanceEmailC+"/images/"+c.tokens["gallery:paysage"]+"?size=64", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageSize(64, 32)),
+		},
+		{
+			name: "supprimer l'image principale de la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").json("DELETE", "/api/profiles/"+conformanceEmailC+"/images/"+c.tokens["gallery:photo"], nil)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "la première image restante devient l'avatar",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").image(conformanceEmailC, "original", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(describeImage("image/png", conformanceLargePNG))),
+		},
+		{
+			name: "choisir une autre image principale",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").updateGalleryImage(conformanceEmailC, "animation", map[string]interface{}{"primary": true})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("primary", true)),
+		},
+		{
+			name: "lister la galerie après suppression",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").gallery(conformanceEmailC)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody("paysage | *animation")),
+		},
+		{
+			name: "supprimer une image absente de la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").json("DELETE", "/api/profiles/"+conformanceEmailC+"/images/"+c.tokens["gallery:photo"], nil)
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// PNG de 1x1 pixel transparent, encodé au démarrage pour être valide au décodage
+var conformancePNG = func() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	return buf.Bytes()
+}()
+
+// PNG de 300x150 pixels en dégradé, pour vérifier les variantes réduites
+var conformanceLargePNG = func() []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 150))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 150; y++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}()
+
+// GIF de 30x30 pixels sur une palette de deux couleurs, stocké en PNG à l'envoi
+var conformanceGIF = func() []byte {
+	img := image.NewPaletted(image.Rect(0, 0, 30, 30), color.Palette{color.Black, color.White})
+	for x := 0; x < 30; x++ {
+		for y := 0; y < 30; y++ {
+			img.SetColorIndex(x, y, uint8((x/5+y/5)%2))
+		}
+	}
+	var buf bytes.Buffer
+	gif.Encode(&buf, img, nil)
+	return buf.Bytes()
+}()
+
+// JPEG de 40x20 pixels comme en produit un téléphone tenu verticalement : bloc EXIF avec
+// Orientation = 6 (rotation de 90° à appliquer) et coordonnées GPS, bloc XMP et commentaire
+var conformancePhotoJPEG = func() []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 6), G: uint8(y * 12), B: 64, A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, img, nil)
+
+	// IFD0 big-endian avec deux entrées : Orientation (0x0112) et pointeur GPS (0x8825)
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x02")
+	tiff = append(tiff, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00)
+	tiff = append(tiff, 0x88, 0x25, 0x00, 0x04, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00)
+	tiff = append(tiff, 0x00, 0x00, 0x00, 0x00)
+
+	segment := func(marker byte, payload []byte) []byte {
+		out := []byte{0xFF, marker, 0, 0}
+		binary.BigEndian.PutUint16(out[2:], uint16(len(payload)+2))
+		return append(out, payload...)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encoded.Bytes()[:2])
+	buf.Write(segment(0xE1, append([]byte("Exif\x00\x00"), tiff...)))
+	buf.Write(segment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")))
+	buf.Write(segment(0xFE, []byte("Pris au 48.8584,2.2945")))
+	buf.Write(encoded.Bytes()[2:])
+	return buf.Bytes()
+}()
+
+// conformancePNGHeader renvoie la signature et l'en-tête IHDR d'un PNG aux dimensions annoncées, sans pixels
+func conformancePNGHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 6 // 8 bits par canal, RGBA
+
+	var buf bytes.Buffer
+	buf.Write(conformancePNG[:8])
+	binary.Write(&buf, binary.BigEndian, uint32(13))
+	buf.Write(ihdr)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf.Bytes()
+}
+
+// conformanceImageSteps couvre l'envoi et le téléchargement de l'image de profil : validation,
+// variantes, métadonnées et conversions
+func conformanceImageSteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "télécharger l'image d'un profil sans image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("POST", "/api/getProfileImage", map[string]interface{}{"email": conformanceEmailB})
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "envoyer une image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").upload(conformanceEmailA, "avatar.png", "image/png", conformancePNG)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "envoyer un fichier qui n'est pas une image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").upload(conformanceEmailA, "avatar.png", "image/png", []byte("pas une image"))
+			},
+			expect: expectAll(expectStatus(http.StatusUnsupportedMediaType), expectField("code", imageErrUnsupportedFormat)),
+		},
+		{
+			name: "envoyer une image avec une extension qui ne correspond pas",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").upload(conformanceEmailA, "avatar.jpg", "image/jpeg", conformancePNG)
+			},
+			expect: expectAll(expectStatus(http.StatusUnprocessableEntity), expectField("code", imageErrExtensionMismatch)),
+		},
+		{
+			name: "envoyer une image trop grande (bombe de décompression)",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").upload(conformanceEmailA, "avatar.png", "image/png", conformancePNGHeader(50000, 50000))
+			},
+			expect: expectAll(expectStatus(http.StatusUnprocessableEntity), expectField("code", imageErrDimensions)),
+		},
+		{
+			name: "envoyer une image tronquée",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").upload(conformanceEmailA, "avatar.png", "image/png", conformancePNG[:45])
+			},
+			expect: expectAll(expectStatus(http.StatusUnprocessableEntity), expectField("code", imageErrCorrupt)),
+		},
+		{
+			name: "envoyer une image pour un profil inconnu",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").upload("inconnu@example.com", "avatar.png", "image/png", conformancePNG)
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "télécharger l'image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("POST", "/api/getProfileImage", map[string]interface{}{"email": conformanceEmailA})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(describeImage("image/png", conformancePNG))),
+		},
+		{
+			name: "télécharger l'image par son url",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(describeImage("image/png", conformancePNG))),
+		},
+		{
+			name: "image inchangée (If-None-Match)",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "", map[string]string{"If-None-Match": c.tokens["etag"]})
+			},
+			expect: expectStatus(http.StatusNotModified),
+		},
+		{
+			name: "télécharger une partie de l'image (Range)",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "", map[string]string{"Range": "bytes=0-3"})
+			},
+			expect: expectAll(expectStatus(http.StatusPartialContent), expectBody(describeImage("image/png", conformancePNG[:4]))),
+		},
+		{
+			name: "télécharger l'image d'un profil inconnu par son url",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").image("inconnu@example.com", "", nil)
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "envoyer une grande image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").upload(conformanceEmailA, "paysage.png", "image/png", conformanceLargePNG)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "télécharger la variante 64px",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "64", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageSize(64, 32)),
+		},
+		{
+			name: "télécharger la variante 256px",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "256", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageSize(256, 128)),
+		},
+		{
+			name: "télécharger l'original",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "original", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(describeImage("image/png", conformanceLargePNG))),
+		},
+		{
+			name: "envoyer une photo avec métadonnées EXIF",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").upload(conformanceEmailC, "photo.jpg", "image/jpeg", conformancePhotoJPEG)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectMetadataReport(6, "comment", "exif", "gps", "xmp")),
+		},
+		{
+			name: "télécharger la photo redressée",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").image(conformanceEmailC, "original", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageSize(20, 40)),
+		},
+		{
+			name: "télécharger la variante 64px de la photo redressée",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").image(conformanceEmailC, "64", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageSize(20, 40)),
+		},
+		{
+			name: "télécharger en WebP (Accept d'un navigateur)",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "original", map[string]string{"Accept": "image/avif,image/webp,image/*,*/*;q=0.8"})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageType("image/webp"), expectImageSize(300, 150)),
+		},
+		{
+			name: "télécharger la variante 64px en WebP",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "64", map[string]string{"Accept": "image/webp"})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageType("image/webp"), expectImageSize(64, 32)),
+		},
+		{
+			name: "télécharger une image PNG en JPEG",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "original", map[string]string{"Accept": "image/jpeg"})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageType("image/jpeg"), expectImageSize(300, 150)),
+		},
+		{
+			name: "télécharger sans accepter d'image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "original", map[string]string{"Accept": "text/html"})
+			},
+			expect: expectAll(expectStatus(http.StatusNotAcceptable), expectField("code", "not_acceptable")),
+		},
+		{
+			name: "envoyer un GIF",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").upload(conformanceEmailC, "animation.gif", "image/gif", conformanceGIF)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectConvertedFrom("gif")),
+		},
+		{
+			name: "le GIF est servi en PNG",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").image(conformanceEmailC, "original", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageType("image/png"), expectImageSize(30, 30)),
+		},
+		{
+			name: "télécharger une taille inconnue",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").image(conformanceEmailA, "100", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusBadRequest), expectField("code", "unknown_variant")),
+		},
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+)
+
+// conformanceImportExportSteps couvre l'export des profils et l'import en masse
+func conformanceImportExportSteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "exporter les profils en NDJSON",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").export("format=ndjson&userType=1&sort=-createdAt")
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(
+				`{"email":"`+conformanceEmailE+`","state":false,"userType":1,"createdAt":"(date)"}`+"\n"+
+					`{"email":"`+conformanceEmailC+`","state":true,"userType":1,"createdAt":"(date)"}`)),
+		},
+		{
+			name: "exporter les profils actifs en CSV",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").export("format=csv&userType=1&state=true")
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody("email,state,userType,createdAt\n"+conformanceEmailC+",true,1,(date)")),
+		},
+		{
+			name: "exporter dans un format inconnu",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").export("format=xml")
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+		{
+			name: "exporter tous les profils sans être admin",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").export("format=csv")
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "importer des profils sans être admin",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").importProfiles("", "text/csv", "email,password\n"+conformanceEmailF+",secret\n")
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "simuler un import CSV avec des lignes invalides",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").importProfiles("?dryRun=true", "text/csv", "email,userType,password,state\n"+
+					conformanceEmailF+",2,secret,true\n"+
+					"pas-un-email,1,secret,true\n"+
+					conformanceEmailF+",1,secret,true\n"+
+					conformanceEmailC+",1,secret,true\n"+
+					conformanceEmailG+",4,secret,true\n"+
+					conformanceEmailG+",1,,true\n")
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("dryRun", true), expectField("accepted", 1), expectField("rejected", 5),
+				expectContains(`"reason":"email invalide"`), expectContains(`"reason":"email en double, déjà à la ligne 2"`),
+				expectContains(`"reason":"email déjà utilisé"`), expectContains(`"reason":"userType doit être entre 1 et 3"`),
+				expectContains(`"reason":"mot de passe manquant"`)),
+		},
+		{
+			name: "la simulation n'a rien importé",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("GET", "/api/v2/profiles/"+conformanceEmailF, nil)
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "importer des profils en NDJSON",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").importProfiles("", "application/x-ndjson",
+					`{"email":"`+conformanceEmailF+`","password":"importe","state":true,"userType":2}`+"\n"+
+						"pas du json\n"+
+						`{"email":"`+conformanceEmailG+`","password":"importe"}`+"\n")
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("accepted", 2), expectField("rejected", 1), expectContains(`"reason":"JSON invalide"`)),
+		},
+		{
+			name: "se connecter avec un profil importé",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.login("f", conformanceEmailF, "importe")
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "lire un profil importé",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("f").json("GET", "/api/me", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("userType", 2), expectField("state", true)),
+		},
+		{
+			name: "supprimer les profils importés",
+			do: func(c *conformanceClient) (observation, error) {
+				obs, err := c.as("admin").json("DELETE", "/api/v2/profiles/"+conformanceEmailF, nil)
+				if err != nil || obs.Status != http.StatusOK {
+					return obs, err
+				}
+				return c.as("admin").json("DELETE", "/api/v2/profiles/"+conformanceEmailG, nil)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// conformancePageSteps couvre les pages HTML des profils et l'échappement des emails
+func conformancePageSteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "page d'un profil inactif",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.page(conformanceEmailC)
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "activer un profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("PUT", "/api/updateProfile", map[string]interface{}{"email": conformanceEmailC, "state": true})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("state", true)),
+		},
+		{
+			name: "page d'un profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.page(conformanceEmailC)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectContains("<dd>"+conformanceEmailC+"</dd>"), expectContains("<figcaption>paysage</figcaption>")),
+		},
+		{
+			name: "image de la page sans être connecté",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.withToken("").json("GET", c.tokens["page:image"], nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageSize(30, 30)),
+		},
+		{
+			name: "lien d'image signé pour un autre profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.withToken("").json("GET", "/api/profiles/"+conformanceEmailB+"/image?sig="+url.QueryEscape(c.tokens["page:sig"]), nil)
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "un token de session ne sert pas de lien d'image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.withToken("").json("GET", "/api/profiles/"+conformanceEmailC+"/image?sig="+url.QueryEscape(c.tokens["c"]), nil)
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "un lien d'image ne sert pas de token de session",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.withToken(c.tokens["page:sig"]).json("GET", "/api/me", nil)
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "page d'un profil inconnu",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.page("inconnu@example.com")
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "créer un profil avec du HTML dans l'email",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/createProfile", map[string]interface{}{"email": conformanceEmailHTML, "password": "secret", "state": true})
+			},
+			expect: expectAll(expectStatus(http.StatusBadRequest), expectField("Erreur", "Email invalide")),
+		},
+		{
+			name: "créer un profil avec des caractères à échapper dans l'email",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/createProfile", map[string]interface{}{"email": conformanceEmailQuote, "password": "secret", "state": true})
+			},
+			expect: expectStatus(http.StatusCreated),
+		},
+		{
+			name: "l'email est échappé dans la page",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.page(conformanceEmailQuote)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectContains("o&#39;neil&amp;co@example.com"), expectNotContains("o'neil&co")),
+		},
+		{
+			name: "supprimer le profil avec des caractères à échapper dans l'email",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("DELETE", "/api/deleteProfile", map[string]interface{}{"email": conformanceEmailQuote})
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+)
+
+// conformanceAccountSteps vide la base, connecte l'admin et crée les comptes A (moderator), B (admin) et C (user)
+func conformanceAccountSteps(adminEmail, adminPassword string) []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "connexion administrateur",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.login("admin", adminEmail, adminPassword)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "vider la base",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").wipe()
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "vider la base sans être connecté",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("DELETE", "/api/deleteAllDatabase", nil)
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "créer un profil moderator sans être admin",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/createProfile", map[string]interface{}{"email": conformanceEmailA, "password": "secret", "userType": 2})
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "créer un profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("POST", "/api/createProfile", map[string]interface{}{"email": conformanceEmailA, "password": "secret", "userType": 2, "state": false})
+			},
+			expect: expectAll(expectStatus(http.StatusCreated), expectField("email", conformanceEmailA), expectField("userType", 2), expectNoField("password")),
+		},
+		{
+			name: "créer un profil avec la clé usertype",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("POST", "/api/createProfile", map[string]interface{}{"email": conformanceEmailB, "password": "secret", "usertype": 3, "state": true})
+			},
+			expect: expectAll(expectStatus(http.StatusCreated), expectField("userType", 3)),
+		},
+		{
+			name: "créer un profil avec un userType invalide",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/createProfile", map[string]interface{}{"email": conformanceEmailC, "password": "secret", "userType": 42})
+			},
+			expect: expectAll(expectStatus(http.StatusCreated), expectField("userType", 1)),
+		},
+		{
+			name: "email déjà utilisé",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/createProfile", map[string]interface{}{"email": conformanceEmailA, "password": "autre"})
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+	}
+}
+
+// conformanceProfileSteps lit et modifie les profils avec les anciennes routes
+func conformanceProfileSteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "récupérer un profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("POST", "/api/getUserProfile", map[string]interface{}{"email": conformanceEmailA})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("email", conformanceEmailA), expectField("state", false), expectNoField("password")),
+		},
+		{
+			name: "un user ne peut pas lire le profil d'un autre",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").json("POST", "/api/getUserProfile", map[string]interface{}{"email": conformanceEmailA})
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "récupérer un profil inconnu",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("POST", "/api/getUserProfile", map[string]interface{}{"email": "inconnu@example.com"})
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "mettre à jour l'état",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("PUT", "/api/updateProfile", map[string]interface{}{"email": conformanceEmailA, "state": true})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("state", true)),
+		},
+		{
+			name: "l'état mis à jour est persisté",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("POST", "/api/getUserProfile", map[string]interface{}{"email": conformanceEmailA})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("state", true), expectField("userType", 2)),
+		},
+		{
+			name: "un user ne peut pas modifier le profil d'un autre",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").json("PUT", "/api/updateProfile", map[string]interface{}{"email": conformanceEmailA, "state": false})
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "mettre à jour un profil inconnu",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("PUT", "/api/updateProfile", map[string]interface{}{"email": "inconnu@example.com", "state": true})
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+	}
+}
+
+// conformanceLegacyListSteps liste les profils avec les anciennes routes
+func conformanceLegacyListSteps(adminEmail string) []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "lister par type",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("POST", "/api/getAllUsersState", map[string]interface{}{"userType": 2})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectEmails(conformanceEmailA)),
+		},
+		{
+			name: "lister tous les profils",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("GET", "/api/getAllUsers", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectEmails(adminEmail, conformanceEmailA, conformanceEmailB, conformanceEmailC)),
+		},
+		{
+			name: "lister tous les profils sans être admin",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("GET", "/api/getAllUsers", nil)
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+	}
+}
+
+// conformanceDeletionSteps supprime A et B : les images partagées restent à l'autre profil
+func conformanceDeletionSteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "un user ne peut pas supprimer le profil d'un autre",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").json("DELETE", "/api/deleteProfile/"+conformanceEmailB, nil)
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "envoyer la même image pour un autre profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").upload(conformanceEmailB, "paysage.png", "image/png", conformanceLargePNG)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "supprimer son profil (email dans l'url)",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("DELETE", "/api/deleteProfile/"+conformanceEmailA, nil)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "le token d'un profil supprimé est refusé",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("GET", "/api/me", nil)
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "l'image partagée reste disponible pour l'autre profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").image(conformanceEmailB, "original", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(describeImage("image/png", conformanceLargePNG))),
+		},
+		{
+			name: "la variante partagée reste disponible pour l'autre profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").image(conformanceEmailB, "64", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageSize(64, 32)),
+		},
+		{
+			name: "supprimer un profil (email dans le corps)",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("DELETE", "/api/deleteProfile", map[string]interface{}{"email": conformanceEmailB})
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "supprimer un profil déjà supprimé",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("DELETE", "/api/deleteProfile/"+conformanceEmailA, nil)
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "l'image part avec le profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("POST", "/api/getProfileImage", map[string]interface{}{"email": conformanceEmailA})
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+	}
+}
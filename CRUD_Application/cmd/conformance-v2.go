@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// conformanceV2ListSteps couvre les profils de l'API v2 et la liste paginée
+func conformanceV2ListSteps(adminEmail string) []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "v2 : créer un profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.json("POST", "/api/v2/profiles", map[string]interface{}{"email": conformanceEmailE, "password": "secret", "state": true})
+			},
+			expect: expectAll(expectStatus(http.StatusCreated), expectField("email", conformanceEmailE), expectField("userType", 1)),
+		},
+		{
+			name: "v2 : lire un profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("GET", "/api/v2/profiles/"+conformanceEmailE, nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("email", conformanceEmailE), expectField("state", true)),
+		},
+		{
+			name: "v2 : lire le profil d'un autre sans être modérateur",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").json("GET", "/api/v2/profiles/"+conformanceEmailE, nil)
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "v2 : modifier l'état",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("PATCH", "/api/v2/profiles/"+conformanceEmailE, map[string]interface{}{"state": false})
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("email", conformanceEmailE), expectField("state", false)),
+		},
+		{
+			name: "v2 : lister par type",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("GET", "/api/v2/profiles?userType=1", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectEmails(conformanceEmailC, conformanceEmailE)),
+		},
+		{
+			name: "v2 : lister tous les profils sans être admin",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("GET", "/api/v2/profiles", nil)
+			},
+			expect: expectStatus(http.StatusForbidden),
+		},
+		{
+			name: "v2 : lister les profils par pages de deux, triés par email",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").profilePages("limit=2")
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(conformanceEmailA+", "+adminEmail+" | "+conformanceEmailB+", "+conformanceEmailC+" | "+conformanceEmailE)),
+		},
+		{
+			name: "v2 : lister les profils du plus récent au plus ancien",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").profilePages("limit=3&sort=-createdAt")
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(conformanceEmailE+", "+conformanceEmailC+", "+conformanceEmailB+" | "+conformanceEmailA+", "+adminEmail)),
+		},
+		{
+			name: "v2 : lister par état et par type combinés",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").profilePages("limit=1&userType=1&state=true&sort=createdAt")
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody(conformanceEmailC)),
+		},
+		{
+			name: "v2 : lister avec un curseur illisible",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("GET", "/api/v2/profiles?cursor=pas-un-curseur", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusBadRequest), expectField("Erreur", "Curseur invalide")),
+		},
+		{
+			name: "v2 : réutiliser un curseur avec d'autres filtres",
+			do: func(c *conformanceClient) (observation, error) {
+				if _, err := c.as("admin").profilePages("limit=1&sort=createdAt"); err != nil {
+					return observation{}, err
+				}
+				return c.as("admin").json("GET", "/api/v2/profiles?limit=1&sort=email&cursor="+url.QueryEscape(c.tokens["profiles:next"]), nil)
+			},
+			expect: expectAll(expectStatus(http.StatusBadRequest), expectField("Erreur", "Curseur invalide")),
+		},
+		{
+			name: "v2 : lister avec une taille de page invalide",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("GET", "/api/v2/profiles?limit=0", nil)
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+	}
+}
+
+// conformanceV2ImageSteps envoie et supprime l'image de E puis E avec l'API v2
+func conformanceV2ImageSteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "v2 : envoyer l'image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").uploadForm("PUT", "/api/v2/profiles/"+conformanceEmailE+"/image", nil, "paysage.png", "image/png", conformanceLargePNG)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "v2 : télécharger l'image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("GET", "/api/v2/profiles/"+conformanceEmailE+"/image?size=64", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectImageSize(64, 32)),
+		},
+		{
+			name: "v2 : supprimer l'image",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("DELETE", "/api/v2/profiles/"+conformanceEmailE+"/image", nil)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "v2 : l'image supprimée n'est plus servie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("GET", "/api/v2/profiles/"+conformanceEmailE+"/image", nil)
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "v2 : l'image supprimée quitte la galerie",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").gallery(conformanceEmailE)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectBody("")),
+		},
+		{
+			name: "v2 : supprimer une image absente",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("a").json("DELETE", "/api/v2/profiles/"+conformanceEmailE+"/image", nil)
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+		{
+			name: "v2 : supprimer le profil",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("DELETE", "/api/v2/profiles/"+conformanceEmailE, nil)
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "v2 : le profil supprimé est introuvable",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("GET", "/api/v2/profiles/"+conformanceEmailE, nil)
+			},
+			expect: expectStatus(http.StatusNotFound),
+		},
+	}
+}
+
+// conformanceDeprecationSteps vérifie les en-têtes de dépréciation des anciennes routes
+func conformanceDeprecationSteps() []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "une ancienne route annonce sa remplaçante",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").deprecation("POST", "/api/getUserProfile", map[string]interface{}{"email": conformanceEmailC})
+			},
+			expect: expectBody(fmt.Sprintf(`@%d </api/v2/profiles/%s>; rel="successor-version"`, apiV1DeprecatedAt.Unix(), conformanceEmailC)),
+		},
+		{
+			name: "une route v2 n'est pas dépréciée",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("c").deprecation("GET", "/api/v2/profiles/"+conformanceEmailC, nil)
+			},
+			expect: expectBody(""),
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+)
+
+// conformanceWipeSteps couvre le vidage de la base et son token de confirmation
+func conformanceWipeSteps(adminEmail string) []conformanceStep {
+	return []conformanceStep{
+		{
+			name: "vider la base sans confirmation",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("DELETE", "/api/deleteAllDatabase", nil)
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+		{
+			name: "vider la base avec un token de session comme confirmation",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("DELETE", "/api/deleteAllDatabase", map[string]interface{}{"confirm": c.tokens["admin"]})
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+		{
+			name: "vider la base en dry-run",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").dryRunWipe()
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectField("count", 2)),
+		},
+		{
+			name: "le dry-run ne supprime rien",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("GET", "/api/getAllUsers", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectEmails(adminEmail, conformanceEmailC)),
+		},
+		{
+			name: "le token de confirmation ne remplace pas la connexion",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.withToken("").json("DELETE", "/api/deleteAllDatabase", map[string]interface{}{"confirm": c.tokens["confirmation"]})
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "vider la base à la fin",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").wipe()
+			},
+			expect: expectStatus(http.StatusOK),
+		},
+		{
+			name: "le token de confirmation ne sert qu'une fois",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("DELETE", "/api/deleteAllDatabase", map[string]interface{}{"confirm": c.tokens["confirmation"]})
+			},
+			expect: expectStatus(http.StatusBadRequest),
+		},
+		{
+			name: "le token de confirmation n'est pas un token de session",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.withToken(c.tokens["confirmation"]).json("GET", "/api/me", nil)
+			},
+			expect: expectStatus(http.StatusUnauthorized),
+		},
+		{
+			name: "seul l'admin configuré reste",
+			do: func(c *conformanceClient) (observation, error) {
+				return c.as("admin").json("GET", "/api/getAllUsers", nil)
+			},
+			expect: expectAll(expectStatus(http.StatusOK), expectEmails(adminEmail)),
+		},
+	}
+}
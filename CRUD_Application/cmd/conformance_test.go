@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Suite de conformité complète sur les backends qui tournent sans service externe. Le rapport
+// (écarts au contrat et différences entre backends) est affiché quand le test échoue.
+func TestConformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("suite de conformité ignorée avec -short")
+	}
+
+	var cfg config
+	fs := configFlagSet("conformance", &cfg)
+	err := fs.Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	conformanceConfig(&cfg, workDir)
+	cfg.SQLitePath = filepath.Join(workDir, "conformance.db")
+	cfg.PasswordHash = hashBcrypt
+	cfg.BcryptCost = bcrypt.MinCost // la suite se connecte des dizaines de fois
+
+	var targets []conformanceTarget
+	for _, name := range []string{backendMemory, backendSQLite} {
+		target, server, err := startConformanceBackend(cfg, name, workDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		targets = append(targets, target)
+	}
+
+	steps := conformanceSteps(cfg.AdminEmail, cfg.AdminPassword)
+	results := make(map[string][]conformanceResult)
+	for _, target := range targets {
+		results[target.name] = runConformanceSteps(target, steps)
+	}
+	if !reportConformance(targets, steps, results) {
+		t.Error("la suite de conformité a échoué")
+	}
+}
@@ -0,0 +1,132 @@
+// Documentation de l'API : lit /api/openapi.json et l'affiche, groupée par tag.
+// Le contenu de la spécification est inséré avec textContent, jamais comme du HTML.
+"use strict";
+
+const methods = ["get", "head", "post", "put", "patch", "delete"];
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    node.setAttribute(key, value);
+  }
+  for (const child of children) {
+    node.append(child);
+  }
+  return node;
+}
+
+// schemaText écrit un schéma sous une forme proche du JSON attendu, en suivant les $ref
+function schemaText(spec, schema, indent, seen) {
+  if (!schema) {
+    return "";
+  }
+  if (schema.$ref) {
+    const name = schema.$ref.split("/").pop();
+    if (seen.includes(name)) {
+      return name;
+    }
+    return schemaText(spec, spec.components.schemas[name], indent, seen.concat(name));
+  }
+  if (schema.oneOf) {
+    return schema.oneOf.map((s) => schemaText(spec, s, indent, seen)).join("\n" + indent + "ou ");
+  }
+  const pad = indent + "  ";
+  switch (schema.type) {
+    case "object": {
+      if (schema.additionalProperties) {
+        return "{ \"...\": " + schemaText(spec, schema.additionalProperties, pad, seen) + " }";
+      }
+      const entries = Object.entries(schema.properties || {});
+      if (entries.length === 0) {
+        return "{}";
+      }
+      const lines = entries.map(([name, prop]) => pad + JSON.stringify(name) + ": " + schemaText(spec, prop, pad, seen));
+      return "{\n" + lines.join(",\n") + "\n" + indent + "}";
+    }
+    case "array":
+      return "[" + schemaText(spec, schema.items, indent, seen) + ", ...]";
+    case undefined:
+      return "any";
+    default:
+      return schema.format ? schema.type + " (" + schema.format + ")" : schema.type;
+  }
+}
+
+function contentBlock(spec, content) {
+  const block = el("div");
+  for (const [type, media] of Object.entries(content || {})) {
+    block.append(el("div", {}, el("code", {}, type)), el("pre", {}, schemaText(spec, media.schema, "", [])));
+  }
+  return block;
+}
+
+function operationBlock(spec, path, method, op) {
+  const details = el("details", op.deprecated ? { class: "deprecated" } : {});
+  details.append(el("summary", {},
+    el("span", { class: "method " + method }, method.toUpperCase()), el("code", {}, path), " ", op.summary || ""));
+
+  if (op.description) {
+    for (const paragraph of op.description.split("\n\n")) {
+      details.append(el("p", {}, paragraph));
+    }
+  }
+  if (op.security) {
+    const schemes = op.security.map((s) => Object.keys(s)[0]).join(" ou ");
+    details.append(el("p", {}, "Authentification : " + schemes));
+  }
+  if (op.parameters) {
+    const table = el("table", {}, el("tr", {}, el("th", {}, "Paramètre"), el("th", {}, "Dans"), el("th", {}, "Type"), el("th", {}, "Description")));
+    for (const p of op.parameters) {
+      table.append(el("tr", {}, el("td", {}, el("code", {}, p.name + (p.required ? " *" : ""))), el("td", {}, p.in),
+        el("td", {}, p.schema.type), el("td", {}, p.description || "")));
+    }
+    details.append(table);
+  }
+  if (op.requestBody) {
+    details.append(el("h4", {}, "Corps de la requête"), contentBlock(spec, op.requestBody.content));
+  }
+  details.append(el("h4", {}, "Réponses"));
+  for (const [status, response] of Object.entries(op.responses || {})) {
+    details.append(el("div", {}, el("strong", {}, status), " " + response.description), contentBlock(spec, response.content));
+  }
+  return details;
+}
+
+function render(spec) {
+  const groups = new Map((spec.tags || []).map((tag) => [tag.name, []]));
+  for (const [path, item] of Object.entries(spec.paths).sort()) {
+    for (const method of methods) {
+      const op = item[method];
+      if (!op) {
+        continue;
+      }
+      const tag = (op.tags || ["autres"])[0];
+      if (!groups.has(tag)) {
+        groups.set(tag, []);
+      }
+      groups.get(tag).push(operationBlock(spec, path, method, op));
+    }
+  }
+
+  const main = document.getElementById("api");
+  main.textContent = "";
+  main.append(el("p", {}, spec.info.description || ""));
+  for (const [tag, blocks] of groups) {
+    if (blocks.length === 0) {
+      continue;
+    }
+    main.append(el("h2", {}, tag), ...blocks);
+  }
+}
+
+fetch("openapi.json")
+  .then((response) => {
+    if (!response.ok) {
+      throw new Error("statut " + response.status);
+    }
+    return response.json();
+  })
+  .then(render)
+  .catch((err) => {
+    document.getElementById("api").textContent = "Impossible de lire la spécification : " + err.message;
+  });
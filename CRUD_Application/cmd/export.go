@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export statique de toutes les pages de profil, pour publier l'annuaire sans faire tourner l'API :
+//
+//	./main export --backend=sqlite --base-url=https://profils.example.com ./site
+//
+// Le site produit contient :
+//
+//	index.html, page-2.html...  index des profils, --page-size profils par page
+//	profiles/<email>.html       une page par profil, rendue avec les mêmes templates que GET /profiles/{email}
+//	assets/<empreinte>.<ext>    copie des images (original et miniatures), une seule fois par contenu
+//	sitemap.xml                 URLs absolues à partir de --base-url
+//
+// Le site est écrit dans un dossier temporaire à côté de la cible, qui ne remplace l'ancien export
+// qu'une fois complet : un export interrompu laisse l'ancien site en place.
+
+// Fichier témoin écrit dans chaque export : seul un dossier vide ou un ancien export peut être remplacé
+const exportMarker = ".profiles-export"
+
+// Options de l'export statique
+type exportOptions struct {
+	BaseURL         string // URL publique du site, pour le sitemap
+	PageSize        int    // profils par page de l'index
+	IncludeInactive bool   // exporte aussi les profils dont state est à false
+	Sizes           []int  // tailles des variantes configurées (--image-variants)
+}
+
+// Compte rendu d'un export
+type exportReport struct {
+	Profiles int // pages de profil écrites
+	Skipped  int // profils inactifs ignorés
+	Pages    int // pages de l'index
+	Assets   int // images copiées
+	Missing  int // images référencées mais absentes du stockage, ignorées
+}
+
+// Profil dans l'index
+type indexEntry struct {
+	Email     string
+	Role      string
+	URL       string
+	Thumbnail string
+}
+
+// Lien vers une page de l'index
+type indexLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+// Données passées au template d'une page de l'index
+type indexPage struct {
+	Profiles []indexEntry
+	Page     int
+	Pages    int
+	Previous string
+	Next     string
+	Links    []indexLink
+}
+
+// exportSite écrit tout le site dans un dossier temporaire puis le met à la place de target
+func exportSite(ctx context.Context, images profileImages, pages pageTemplates, opts exportOptions, target string) (exportReport, error) {
+	var report exportReport
+
+	if _, ok := pages["index"]; !ok {
+		return report, fmt.Errorf("templates : pages/index.html manquant")
+	}
+	err := checkExportTarget(target)
+	if err != nil {
+		return report, err
+	}
+
+	profiles, err := images.store.ListProfiles(ctx)
+	if err != nil {
+		return report, err
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Email < profiles[j].Email })
+
+	parent := filepath.Dir(filepath.Clean(target))
+	err = os.MkdirAll(parent, 0755)
+	if err != nil {
+		return report, err
+	}
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(target)+"-export-")
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(tmp) // ne reste que si l'export a échoué avant le renommage
+
+	site := &siteWriter{dir: tmp, images: images, sizes: opts.Sizes, assets: make(map[string]string)}
+	for _, dir := range []string{"profiles", "assets"} {
+		err = os.Mkdir(filepath.Join(tmp, dir), 0755)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	var entries []indexEntry
+	var urls []sitemapURL
+	for _, profile := range profiles {
+		if !profile.State && !opts.IncludeInactive {
+			report.Skipped++
+			continue
+		}
+		entry, lastmod, err := site.writeProfile(ctx, pages, profile)
+		if errors.Is(err, ErrProfileNotFound) {
+			continue // profil supprimé pendant l'export
+		}
+		if err != nil {
+			return report, fmt.Errorf("profil %s : %w", profile.Email, err)
+		}
+		entries = append(entries, entry)
+		urls = append(urls, sitemapURL{Loc: absoluteURL(opts.BaseURL, entry.URL), LastMod: lastmod})
+	}
+	report.Profiles = len(entries)
+
+	indexFiles, err := site.writeIndex(pages, entries, opts.PageSize)
+	if err != nil {
+		return report, err
+	}
+	report.Pages = len(indexFiles)
+	for i := len(indexFiles) - 1; i >= 0; i-- {
+		urls = append([]sitemapURL{{Loc: absoluteURL(opts.BaseURL, indexFiles[i])}}, urls...)
+	}
+
+	err = writeSitemap(filepath.Join(tmp, "sitemap.xml"), urls)
+	if err != nil {
+		return report, err
+	}
+	err = os.WriteFile(filepath.Join(tmp, exportMarker), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+	if err != nil {
+		return report, err
+	}
+	// MkdirTemp crée le dossier en 0700, le site doit être lisible par le serveur web
+	err = os.Chmod(tmp, 0755)
+	if err != nil {
+		return report, err
+	}
+
+	report.Assets = len(site.assets)
+	report.Missing = site.missing
+	return report, replaceDir(tmp, target)
+}
+
+// checkExportTarget refuse de remplacer autre chose qu'un dossier vide ou un ancien export
+func checkExportTarget(target string) error {
+	info, err := os.Stat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s existe et n'est pas un dossier", target)
+	}
+	if _, err := os.Stat(filepath.Join(target, exportMarker)); err == nil {
+		return nil
+	}
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s n'est ni vide ni un export précédent (fichier %s absent), il ne sera pas remplacé", target, exportMarker)
+	}
+	return nil
+}
+
+// replaceDir met le dossier tmp à la place de target. L'ancien dossier est d'abord mis de côté
+// puis supprimé : target n'est absent que le temps de deux renommages.
+func replaceDir(tmp, target string) error {
+	old := ""
+	if _, err := os.Stat(target); err == nil {
+		old = tmp + ".old"
+		err = os.Rename(target, old)
+		if err != nil {
+			return err
+		}
+	}
+	err := os.Rename(tmp, target)
+	if err != nil {
+		if old != "" {
+			os.Rename(old, target)
+		}
+		return err
+	}
+	if old != "" {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
+
+// siteWriter écrit les fichiers du site dans le dossier temporaire
+type siteWriter struct {
+	dir     string
+	images  profileImages
+	sizes   []int
+	assets  map[string]string // chemin dans le site des images déjà copiées, indexé par empreinte
+	missing int
+}
+
+// writeProfile copie les images du profil et écrit sa page. Renvoie son entrée dans l'index
+// et la date de sa dernière image pour le sitemap.
+func (s *siteWriter) writeProfile(ctx context.Context, pages pageTemplates, profile Profile) (indexEntry, time.Time, error) {
+	entry := indexEntry{Email: profile.Email, Role: profileRole(profile).String(), URL: "profiles/" + exportSlug(profile.Email) + ".html"}
+
+	// Une image d'avant la galerie pas encore reprise (migrateLegacyAvatars) n'est que l'avatar
+	gallery, err := s.images.store.ListGalleryImages(ctx, profile.Email)
+	if err != nil {
+		return entry, time.Time{}, err
+	}
+	avatar, err := s.images.store.GetProfileImage(ctx, profile.Email)
+	if err != nil && !errors.Is(err, ErrImageNotFound) {
+		return entry, time.Time{}, err
+	}
+
+	thumbnail, small := pageThumbnail(s.sizes), indexThumbnail(s.sizes)
+	lastmod := avatar.UpdatedAt
+
+	// Chemins des images copiées, indexés par identifiant de galerie ("" pour l'avatar) et taille
+	links := make(map[string]string)
+	copyImage := func(id string, image ProfileImage, sizes ...string) error {
+		for _, size := range sizes {
+			asset, err := s.copyAsset(ctx, profile.Email, image, size)
+			if err != nil {
+				return err
+			}
+			links[id+"|"+size] = asset
+		}
+		return nil
+	}
+	if avatar.Key != "" || len(avatar.Data) > 0 {
+		err = copyImage("", avatar, "", thumbnail, small)
+		if err != nil {
+			return entry, time.Time{}, err
+		}
+		if asset := links["|"+small]; asset != "" {
+			entry.Thumbnail = asset
+		}
+	}
+	for _, image := range gallery {
+		err = copyImage(image.ID, image.Image, "", thumbnail)
+		if err != nil {
+			return entry, time.Time{}, err
+		}
+		if image.Image.UpdatedAt.After(lastmod) {
+			lastmod = image.Image.UpdatedAt
+		}
+	}
+
+	// Les pages de profil sont dans profiles/, les images dans assets/
+	page := newProfilePage(profile, gallery, avatar, thumbnail, func(id, size string) string {
+		if asset := links[id+"|"+size]; asset != "" {
+			return "../" + asset
+		}
+		return ""
+	})
+	page.Home = "../index.html"
+
+	body, err := pages.render("profile", page)
+	if err != nil {
+		return entry, time.Time{}, err
+	}
+	return entry, lastmod, os.WriteFile(filepath.Join(s.dir, filepath.FromSlash(entry.URL)), body, 0644)
+}
+
+// copyAsset copie une image (ou une de ses variantes) dans assets/ et renvoie son chemin dans le site.
+// Une image absente du stockage est signalée et ignorée : la page est exportée sans elle.
+func (s *siteWriter) copyAsset(ctx context.Context, email string, image ProfileImage, size string) (string, error) {
+	data, err := selectVariant(ctx, s.images, image, size, s.sizes)
+	if errors.Is(err, ErrBlobNotFound) {
+		log.Println("ATTENTION : image de", email, "absente du stockage, ignorée :", image.Key)
+		s.missing++
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:16])
+	if asset, ok := s.assets[hash]; ok {
+		return asset, nil
+	}
+	asset := "assets/" + hash + strings.ToLower(image.Extension)
+	err = os.WriteFile(filepath.Join(s.dir, filepath.FromSlash(asset)), data, 0644)
+	if err != nil {
+		return "", err
+	}
+	s.assets[hash] = asset
+	return asset, nil
+}
+
+// writeIndex écrit les pages de l'index et renvoie leurs chemins dans le site
+func (s *siteWriter) writeIndex(pages pageTemplates, entries []indexEntry, pageSize int) ([]string, error) {
+	count := (len(entries) + pageSize - 1) / pageSize
+	if count == 0 {
+		count = 1 // l'index existe même sans profil
+	}
+
+	files := make([]string, count)
+	for i := range files {
+		files[i] = indexFileName(i + 1)
+	}
+
+	for i := 0; i < count; i++ {
+		page := indexPage{Page: i + 1, Pages: count}
+		start, end := i*pageSize, (i+1)*pageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		if start < end {
+			page.Profiles = entries[start:end]
+		}
+		if i > 0 {
+			page.Previous = files[i-1]
+		}
+		if i < count-1 {
+			page.Next = files[i+1]
+		}
+		for j, file := range files {
+			page.Links = append(page.Links, indexLink{Number: j + 1, URL: file, Current: j == i})
+		}
+
+		body, err := pages.render("index", page)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(filepath.Join(s.dir, files[i]), body, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func indexFileName(page int) string {
+	if page == 1 {
+		return "index.html"
+	}
+	return "page-" + strconv.Itoa(page) + ".html"
+}
+
+// indexThumbnail choisit la plus petite variante pour les miniatures de l'index, l'original s'il n'y en a pas
+func indexThumbnail(sizes []int) string {
+	if len(sizes) == 0 {
+		return ""
+	}
+	return variantName(sizes[0])
+}
+
+// exportSlug donne le nom de fichier de la page d'un profil. Un email qui ne contient que des minuscules,
+// chiffres et @._+- est gardé tel quel. Sinon les autres caractères sont remplacés (les majuscules aussi,
+// pour les systèmes de fichiers insensibles à la casse) et une empreinte de l'email évite que deux profils
+// aient le même fichier.
+func exportSlug(email string) string {
+	var b strings.Builder
+	for _, r := range email {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '@', r == '.', r == '_', r == '+', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	slug := strings.Trim(b.String(), ".")
+	if slug != email || slug == "" {
+		sum := sha256.Sum256([]byte(email))
+		slug += "-" + hex.EncodeToString(sum[:4])
+	}
+	return slug
+}
+
+// Entrée du sitemap (https://www.sitemaps.org/protocol.html)
+type sitemapURL struct {
+	Loc     string
+	LastMod time.Time
+}
+
+func writeSitemap(path string, urls []sitemapURL) error {
+	type entry struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod,omitempty"`
+	}
+	doc := struct {
+		XMLName xml.Name `xml:"urlset"`
+		XMLNS   string   `xml:"xmlns,attr"`
+		URLs    []entry  `xml:"url"`
+	}{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, u := range urls {
+		e := entry{Loc: u.Loc}
+		if !u.LastMod.IsZero() {
+			e.LastMod = u.LastMod.UTC().Format("2006-01-02")
+		}
+		doc.URLs = append(doc.URLs, e)
+	}
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
+
+// absoluteURL ajoute le chemin d'un fichier du site à l'URL publique
+func absoluteURL(baseURL, file string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + file
+}
+
+// runExport est le point d'entrée de la sous-commande "export", renvoie le code de sortie
+//
+//	./main export --backend=sqlite --base-url=https://profils.example.com ./site
+func runExport(args []string) int {
+	var cfg config
+	fs := configFlagSet("export", &cfg)
+	baseURL := fs.String("base-url", getEnv("EXPORT_BASE_URL", ""), "URL publique du site exporté, pour les URLs absolues du sitemap")
+	pageSize := fs.Int("page-size", 50, "nombre de profils par page de l'index")
+	includeInactive := fs.Bool("include-inactive", false, "exporte aussi les profils inactifs (state à false)")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		log.Println("ERREUR : usage : export [flags] <dossier>")
+		return 2
+	}
+	err = cfg.validate()
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 2
+	}
+	if u, err := url.Parse(*baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Println("ERREUR : --base-url doit être une URL http(s), ex : https://profils.example.com")
+		return 2
+	}
+	if *pageSize <= 0 {
+		log.Println("ERREUR : --page-size doit être positif")
+		return 2
+	}
+
+	pages, err := loadPageTemplates(cfg.TemplateDir)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 2
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+	blobs, err := openBlobStore(cfg)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+	sizes, _ := parseVariantSizes(cfg.ImageVariants)
+
+	opts := exportOptions{BaseURL: *baseURL, PageSize: *pageSize, IncludeInactive: *includeInactive, Sizes: sizes}
+	report, err := exportSite(context.Background(), profileImages{store: store, blobs: blobs}, pages, opts, fs.Arg(0))
+	if err != nil {
+		log.Println("ERREUR : export interrompu, le dossier cible n'a pas été modifié :", err)
+		return 1
+	}
+
+	log.Printf("%d profils exportés dans %s (%d inactifs ignorés), %d pages d'index, %d images, %d absentes du stockage",
+		report.Profiles, fs.Arg(0), report.Skipped, report.Pages, report.Assets, report.Missing)
+	if report.Missing > 0 {
+		return 1
+	}
+	return 0
+}
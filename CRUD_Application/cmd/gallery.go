@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Galerie d'images d'un profil (aussi sous /api/profiles/..., déprécié) :
+//
+//	GET    /api/v2/profiles/{email}/images          liste triée par position
+//	POST   /api/v2/profiles/{email}/images          ajout (multipart : image, caption, primary)
+//	PUT    /api/v2/profiles/{email}/images/order    nouvel ordre {"ids": [...]}
+//	GET    /api/v2/profiles/{email}/images/{id}     téléchargement (?size=, Accept, comme l'avatar)
+//	PATCH  /api/v2/profiles/{email}/images/{id}     {"caption": "...", "primary": true}
+//	DELETE /api/v2/profiles/{email}/images/{id}
+//
+// L'avatar servi par /api/v2/profiles/{email}/image est l'image principale de la galerie.
+
+// Longueur maximale d'une légende, en caractères
+const maxCaptionLength = 500
+
+var errInvalidGalleryOrder = errors.New("l'ordre doit contenir chaque image de la galerie une seule fois")
+
+// Gallery renvoie la galerie du profil et son avatar (ProfileImage vide s'il n'en a pas).
+// Lecture seule : une image envoyée avant la galerie, pas encore reprise par migrateLegacyAvatars,
+// est renvoyée comme avatar sans entrée dans la galerie.
+func (p profileImages) Gallery(ctx context.Context, email string) ([]GalleryImage, ProfileImage, error) {
+	gallery, err := p.store.ListGalleryImages(ctx, email)
+	if err != nil {
+		return nil, ProfileImage{}, err
+	}
+	avatar, err := p.store.GetProfileImage(ctx, email)
+	if errors.Is(err, ErrImageNotFound) {
+		return gallery, ProfileImage{}, nil
+	}
+	if err != nil {
+		return nil, ProfileImage{}, err
+	}
+	return gallery, avatar, nil
+}
+
+// migrateLegacyAvatars reprend dans la galerie les images envoyées avant elle. Elle est lancée une fois
+// par la sous-commande "migrate-avatars" après la mise à jour, et pas à chaque démarrage : elle parcourt
+// tous les profils. Les profils déjà repris sont ignorés, la relancer ne reprend que ceux en erreur.
+func migrateLegacyAvatars(ctx context.Context, p profileImages) (int, error) {
+	profiles, err := p.store.ListProfiles(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, profile := range profiles {
+		ok, err := p.migrateLegacyAvatar(ctx, profile.Email)
+		if err != nil {
+			log.Println("ERREUR : reprise de l'image de", profile.Email, "dans la galerie :", err)
+			continue
+		}
+		if ok {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+// runMigrateAvatars est le point d'entrée de la sous-commande "migrate-avatars", renvoie le code de sortie
+//
+//	./main migrate-avatars --backend=sqlite
+func runMigrateAvatars(args []string) int {
+	var cfg config
+	fs := configFlagSet("migrate-avatars", &cfg)
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	err = cfg.validate()
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 2
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+	blobs, err := openBlobStore(cfg)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+
+	migrated, err := migrateLegacyAvatars(context.Background(), profileImages{store: store, blobs: blobs})
+	if err != nil {
+		log.Println("ERREUR : reprise des images dans les galeries :", err)
+		return 1
+	}
+	log.Println("Images reprises dans les galeries :", migrated)
+	return 0
+}
+
+// migrateLegacyAvatar fait de l'image d'avant la galerie la dernière image de la galerie et l'avatar.
+// Renvoie false si le profil n'a pas d'image à reprendre.
+func (p profileImages) migrateLegacyAvatar(ctx context.Context, email string) (bool, error) {
+	avatar, err := p.store.GetProfileImage(ctx, email)
+	if errors.Is(err, ErrImageNotFound) {
+		return false, nil
+	}
+	if err != nil || avatar.GalleryID != "" {
+		return false, err
+	}
+	gallery, err := p.store.ListGalleryImages(ctx, email)
+	if err != nil {
+		return false, err
+	}
+
+	// Les données sont relues puis réécrites : les images d'avant le BlobStore y passent au passage
+	upload, err := p.LoadImage(ctx, avatar)
+	if err != nil {
+		return false, err
+	}
+	entry, err := p.add(ctx, email, upload, "", nextPosition(gallery), 0)
+	if err != nil {
+		return false, err
+	}
+	err = p.SetPrimary(ctx, email, entry)
+	if err != nil {
+		return false, err
+	}
+	log.Println("Image de", email, "reprise dans la galerie :", entry.ID)
+	return true, nil
+}
+
+// AddToGallery ajoute l'image à la fin de la galerie. Elle devient l'avatar si primary est vrai
+// ou si le profil n'en a pas encore. maxImages limite la taille de la galerie (0 : sans limite) :
+// la limite est vérifiée par le store au moment de l'ajout, deux envois simultanés ne la dépassent pas.
+func (p profileImages) AddToGallery(ctx context.Context, email string, upload imageUpload, caption string, primary bool, maxImages int) (GalleryImage, error) {
+	gallery, avatar, err := p.Gallery(ctx, email)
+	if err != nil {
+		return GalleryImage{}, err
+	}
+
+	entry, err := p.add(ctx, email, upload, caption, nextPosition(gallery), maxImages)
+	if err != nil {
+		return GalleryImage{}, err
+	}
+	if primary || avatar.GalleryID == "" {
+		err = p.SetPrimary(ctx, email, entry)
+	}
+	return entry, err
+}
+
+// add écrit les données de l'image puis son entrée dans la galerie, sauf si elle a déjà maxImages images
+func (p profileImages) add(ctx context.Context, email string, upload imageUpload, caption string, position, maxImages int) (GalleryImage, error) {
+	image, err := p.storeUpload(ctx, upload)
+	if err != nil {
+		return GalleryImage{}, err
+	}
+	id, err := newGalleryID()
+	if err != nil {
+		p.Remove(ctx, image)
+		return GalleryImage{}, err
+	}
+
+	entry := GalleryImage{ID: id, Caption: caption, Position: position, Image: image}
+	err = p.store.AddGalleryImage(ctx, email, entry, maxImages)
+	if err != nil {
+		p.Remove(ctx, image)
+		return GalleryImage{}, err
+	}
+	return entry, nil
+}
+
+// SetPrimary fait de l'image de la galerie l'avatar du profil. L'avatar garde ses propres références
+// sur les données, partagées avec l'image de la galerie.
+func (p profileImages) SetPrimary(ctx context.Context, email string, entry GalleryImage) error {
+	previous, err := p.store.GetProfileImage(ctx, email)
+	if err != nil && !errors.Is(err, ErrImageNotFound) {
+		return err
+	}
+
+	avatar := entry.Image
+	avatar.Data = nil
+	avatar.GalleryID = entry.ID
+	err = p.acquire(ctx, avatar)
+	if err != nil {
+		return err
+	}
+	err = p.store.PutProfileImage(ctx, email, avatar)
+	if err != nil {
+		p.Remove(ctx, avatar)
+		return err
+	}
+	p.Remove(ctx, previous)
+	return nil
+}
+
+// RemoveFromGallery supprime une image de la galerie. Si c'était l'avatar, la première image restante
+// le devient, et le profil n'a plus d'avatar si la galerie est vide.
+func (p profileImages) RemoveFromGallery(ctx context.Context, email, id string) error {
+	gallery, _, err := p.Gallery(ctx, email)
+	if err != nil {
+		return err
+	}
+	entry, ok := findGalleryImage(gallery, id)
+	if !ok {
+		return ErrImageNotFound
+	}
+	return p.removeEntry(ctx, email, entry)
+}
+
+func (p profileImages) removeEntry(ctx context.Context, email string, entry GalleryImage) error {
+	err := p.store.DeleteGalleryImage(ctx, email, entry.ID)
+	if err != nil {
+		return err
+	}
+	p.Remove(ctx, entry.Image)
+
+	avatar, err := p.store.GetProfileImage(ctx, email)
+	if errors.Is(err, ErrImageNotFound) || (err == nil && avatar.GalleryID != entry.ID) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	gallery, err := p.store.ListGalleryImages(ctx, email)
+	if err != nil {
+		return err
+	}
+	if len(gallery) > 0 {
+		return p.SetPrimary(ctx, email, gallery[0])
+	}
+	err = p.store.PutProfileImage(ctx, email, ProfileImage{})
+	if err != nil {
+		return err
+	}
+	p.Remove(ctx, avatar)
+	return nil
+}
+
+// Reorder range la galerie dans l'ordre des identifiants, qui doivent tous y être une seule fois
+func (p profileImages) Reorder(ctx context.Context, email string, ids []string) ([]GalleryImage, error) {
+	gallery, _, err := p.Gallery(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) != len(gallery) {
+		return nil, errInvalidGalleryOrder
+	}
+
+	seen := make(map[string]bool, len(ids))
+	for position, id := range ids {
+		entry, ok := findGalleryImage(gallery, id)
+		if !ok || seen[id] {
+			return nil, errInvalidGalleryOrder
+		}
+		seen[id] = true
+		if entry.Position == position {
+			continue
+		}
+		entry.Position = position
+		err = p.store.UpdateGalleryImage(ctx, email, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p.store.ListGalleryImages(ctx, email)
+}
+
+func findGalleryImage(gallery []GalleryImage, id string) (GalleryImage, bool) {
+	for _, entry := range gallery {
+		if id != "" && entry.ID == id {
+			return entry, true
+		}
+	}
+	return GalleryImage{}, false
+}
+
+// nextPosition renvoie la position qui place une image à la fin de la galerie
+func nextPosition(gallery []GalleryImage) int {
+	if len(gallery) == 0 {
+		return 0
+	}
+	return gallery[len(gallery)-1].Position + 1
+}
+
+func newGalleryID() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Image de la galerie telle qu'elle est renvoyée au client
+type galleryItem struct {
+	ID        string    `json:"id"`
+	Caption   string    `json:"caption"`
+	Position  int       `json:"position"`
+	Primary   bool      `json:"primary"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	URL       string    `json:"url"`
+}
+
+type galleryAddResponse struct {
+	Message  string         `json:"Message"`
+	Image    galleryItem    `json:"image"`
+	Metadata metadataReport `json:"metadata"`
+}
+
+func toGalleryItems(email string, gallery []GalleryImage, avatar ProfileImage) []galleryItem {
+	items := make([]galleryItem, 0, len(gallery))
+	for _, entry := range gallery {
+		items = append(items, toGalleryItem(email, entry, avatar))
+	}
+	return items
+}
+
+func toGalleryItem(email string, entry GalleryImage, avatar ProfileImage) galleryItem {
+	return galleryItem{
+		ID:        entry.ID,
+		Caption:   entry.Caption,
+		Position:  entry.Position,
+		Primary:   avatar.GalleryID == entry.ID,
+		UpdatedAt: entry.Image.UpdatedAt,
+		URL:       "/api/v2/profiles/" + url.PathEscape(email) + "/images/" + entry.ID,
+	}
+}
+
+func (a *apiHandlers) ListGalleryImages(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	email := mux.Vars(r)["email"]
+	gallery, avatar, err := a.images.Gallery(r.Context(), email)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(toGalleryItems(email, gallery, avatar))
+}
+
+func (a *apiHandlers) AddGalleryImage(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	upload, report, ok := a.readImageUpload(w, r)
+	if !ok {
+		return
+	}
+	caption := r.FormValue("caption")
+	if utf8.RuneCountInString(caption) > maxCaptionLength {
+		writeError(w, http.StatusBadRequest, "Légende trop longue ("+strconv.Itoa(maxCaptionLength)+" caractères au plus)")
+		return
+	}
+	primary, _ := strconv.ParseBool(r.FormValue("primary"))
+
+	email := mux.Vars(r)["email"]
+	entry, err := a.images.AddToGallery(r.Context(), email, upload, caption, primary, a.cfg.GalleryMaxImages)
+	if errors.Is(err, ErrGalleryFull) {
+		writeError(w, http.StatusBadRequest, "La galerie a déjà "+strconv.Itoa(a.cfg.GalleryMaxImages)+" images, le maximum")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	avatar, err := a.store.GetProfileImage(r.Context(), email)
+	if err != nil && !errors.Is(err, ErrImageNotFound) {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(galleryAddResponse{
+		Message:  "Image ajoutée à la galerie",
+		Image:    toGalleryItem(email, entry, avatar),
+		Metadata: report,
+	})
+}
+
+func (a *apiHandlers) ServeGalleryImage(w http.ResponseWriter, r *http.Request) {
+	email, id := mux.Vars(r)["email"], mux.Vars(r)["id"]
+	gallery, _, err := a.images.Gallery(r.Context(), email)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	entry, ok := findGalleryImage(gallery, id)
+	if !ok {
+		writeStoreError(w, ErrImageNotFound)
+		return
+	}
+	a.serveImage(w, r, email, email+"-"+id, entry.Image)
+}
+
+// Modification d'une image de la galerie : légende et/ou choix comme avatar
+
+type galleryUpdateRequest struct {
+	Caption *string `json:"caption"`
+	Primary *bool   `json:"primary"`
+}
+
+func (a *apiHandlers) UpdateGalleryImage(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var body galleryUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Erreur lors de la lecture du corps de la requête")
+		return
+	}
+	if body.Caption != nil && utf8.RuneCountInString(*body.Caption) > maxCaptionLength {
+		writeError(w, http.StatusBadRequest, "Légende trop longue ("+strconv.Itoa(maxCaptionLength)+" caractères au plus)")
+		return
+	}
+
+	email, id := mux.Vars(r)["email"], mux.Vars(r)["id"]
+	gallery, avatar, err := a.images.Gallery(r.Context(), email)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	entry, ok := findGalleryImage(gallery, id)
+	if !ok {
+		writeStoreError(w, ErrImageNotFound)
+		return
+	}
+
+	// On ne retire pas l'avatar sans en désigner un autre
+	if body.Primary != nil && !*body.Primary && avatar.GalleryID == id {
+		writeError(w, http.StatusBadRequest, "Choisir une autre image principale pour remplacer celle-ci")
+		return
+	}
+
+	if body.Caption != nil && *body.Caption != entry.Caption {
+		entry.Caption = *body.Caption
+		err = a.store.UpdateGalleryImage(r.Context(), email, entry)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+	if body.Primary != nil && *body.Primary && avatar.GalleryID != id {
+		err = a.images.SetPrimary(r.Context(), email, entry)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		avatar.GalleryID = id
+	}
+
+	json.NewEncoder(w).Encode(toGalleryItem(email, entry, avatar))
+}
+
+func (a *apiHandlers) DeleteGalleryImage(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := a.images.RemoveFromGallery(r.Context(), mux.Vars(r)["email"], mux.Vars(r)["id"])
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeMessage(w, http.StatusOK, "Image supprimée de la galerie")
+}
+
+// Nouvel ordre de la galerie : tous ses ids, chacun une fois
+type galleryOrderRequest struct {
+	IDs []string `json:"ids"`
+}
+
+func (a *apiHandlers) ReorderGalleryImages(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var body galleryOrderRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Erreur lors de la lecture du corps de la requête")
+		return
+	}
+
+	email := mux.Vars(r)["email"]
+	gallery, err := a.images.Reorder(r.Context(), email, body.IDs)
+	if errors.Is(err, errInvalidGalleryOrder) {
+		writeError(w, http.StatusBadRequest, "Ordre invalide : "+err.Error())
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	avatar, err := a.store.GetProfileImage(r.Context(), email)
+	if err != nil && !errors.Is(err, ErrImageNotFound) {
+		writeStoreError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(toGalleryItems(email, gallery, avatar))
+}
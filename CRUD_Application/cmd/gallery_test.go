@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testGalleryImage(id string, position int) GalleryImage {
+	return GalleryImage{ID: id, Position: position, Image: ProfileImage{Key: "images/" + id + ".png", Extension: ".png", UpdatedAt: time.Now().UTC()}}
+}
+
+func testGallery(t *testing.T, images profileImages, email string) ([]GalleryImage, ProfileImage) {
+	gallery, avatar, err := images.Gallery(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gallery, avatar
+}
+
+// La première image devient l'avatar, primary le change, et la suppression de l'avatar passe à l'image suivante
+func TestGalleryPrimaryImage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		images := testImages(t, store)
+		ctx := context.Background()
+		err := store.CreateProfile(ctx, testProfile("user@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first, err := images.AddToGallery(ctx, "user@example.com", testJPEGUpload(t, ".jpg"), "première", false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, avatar := testGallery(t, images, "user@example.com"); avatar.GalleryID != first.ID {
+			t.Errorf("avatar après le premier ajout : %q, %q attendu", avatar.GalleryID, first.ID)
+		}
+		second, err := images.AddToGallery(ctx, "user@example.com", testJPEGUpload(t, ".jpg"), "deuxième", true, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, avatar := testGallery(t, images, "user@example.com"); avatar.GalleryID != second.ID {
+			t.Errorf("avatar après un ajout avec primary : %q, %q attendu", avatar.GalleryID, second.ID)
+		}
+
+		err = images.RemoveFromGallery(ctx, "user@example.com", second.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gallery, avatar := testGallery(t, images, "user@example.com")
+		if len(gallery) != 1 || avatar.GalleryID != first.ID {
+			t.Errorf("après la suppression de l'avatar : %d images, avatar %q ; 1 et %q attendus", len(gallery), avatar.GalleryID, first.ID)
+		}
+
+		err = images.RemoveFromGallery(ctx, "user@example.com", first.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetProfileImage(ctx, "user@example.com")
+		if !errors.Is(err, ErrImageNotFound) {
+			t.Errorf("avatar après la suppression de la dernière image : %v, ErrImageNotFound attendue", err)
+		}
+		if ref, _ := blobRefCount(t, store, first.Image.Key); ref.Count != 0 {
+			t.Errorf("compteur après la suppression de la dernière image : %d, 0 attendu", ref.Count)
+		}
+	})
+}
+
+// L'ordre doit contenir chaque image une seule fois
+func TestReorderGallery(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		images := testImages(t, store)
+		ctx := context.Background()
+		err := store.CreateProfile(ctx, testProfile("user@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for i := 0; i < 3; i++ {
+			entry, err := images.AddToGallery(ctx, "user@example.com", testJPEGUpload(t, ".jpg"), "", false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, entry.ID)
+		}
+
+		for _, order := range [][]string{ids[:2], {ids[0], ids[0], ids[1]}, {ids[0], ids[1], "inconnue"}} {
+			_, err = images.Reorder(ctx, "user@example.com", order)
+			if !errors.Is(err, errInvalidGalleryOrder) {
+				t.Errorf("Reorder(%v) : %v, errInvalidGalleryOrder attendue", order, err)
+			}
+		}
+
+		gallery, err := images.Reorder(ctx, "user@example.com", []string{ids[2], ids[0], ids[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, id := range []string{ids[2], ids[0], ids[1]} {
+			if gallery[i].ID != id {
+				t.Fatalf("galerie après Reorder : %+v, ordre %v attendu", gallery, []string{ids[2], ids[0], ids[1]})
+			}
+		}
+	})
+}
+
+// Des ajouts simultanés à une galerie presque pleine : le store n'en accepte que jusqu'à la limite
+func TestAddGalleryImageEnforcesLimit(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		ctx := context.Background()
+		err := store.CreateProfile(ctx, testProfile("user@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const maxImages, attempts = 3, 10
+		errs := make([]error, attempts)
+		var wg sync.WaitGroup
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = store.AddGalleryImage(ctx, "user@example.com", testGalleryImage(fmt.Sprint("image-", i), i), maxImages)
+			}(i)
+		}
+		wg.Wait()
+
+		added := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				added++
+			case !errors.Is(err, ErrGalleryFull):
+				t.Errorf("AddGalleryImage simultané : %v, ErrGalleryFull attendue", err)
+			}
+		}
+		gallery, err := store.ListGalleryImages(ctx, "user@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != maxImages || len(gallery) != maxImages {
+			t.Errorf("%d ajouts acceptés, %d images dans la galerie ; %d attendus", added, len(gallery), maxImages)
+		}
+
+		// Une suppression libère une place, 0 enlève la limite
+		err = store.DeleteGalleryImage(ctx, "user@example.com", gallery[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.AddGalleryImage(ctx, "user@example.com", testGalleryImage("après-suppression", 20), maxImages)
+		if err != nil {
+			t.Errorf("ajout après une suppression : %v", err)
+		}
+		err = store.AddGalleryImage(ctx, "user@example.com", testGalleryImage("sans-limite", 21), 0)
+		if err != nil {
+			t.Errorf("ajout sans limite : %v", err)
+		}
+
+		err = store.AddGalleryImage(ctx, "inconnu@example.com", testGalleryImage("orpheline", 0), maxImages)
+		if !errors.Is(err, ErrProfileNotFound) {
+			t.Errorf("ajout à un profil inconnu : %v, ErrProfileNotFound attendue", err)
+		}
+	})
+}
+
+// Une image envoyée avant la galerie est reprise une fois, comme image de la galerie et avatar
+func TestMigrateLegacyAvatars(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		images := testImages(t, store)
+		ctx := context.Background()
+		for _, email := range []string{"ancien@example.com", "sans-image@example.com"} {
+			err := store.CreateProfile(ctx, testProfile(email))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		legacy, err := images.storeUpload(ctx, testJPEGUpload(t, ".jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.PutProfileImage(ctx, "ancien@example.com", legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		migrated, err := migrateLegacyAvatars(ctx, images)
+		if err != nil || migrated != 1 {
+			t.Fatalf("migrateLegacyAvatars = %d, %v ; 1 image reprise attendue", migrated, err)
+		}
+		gallery, avatar, err := images.Gallery(ctx, "ancien@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gallery) != 1 || avatar.GalleryID != gallery[0].ID || avatar.Key != legacy.Key {
+			t.Errorf("après la reprise : galerie %+v, avatar %+v", gallery, avatar)
+		}
+
+		// Déjà reprise : une deuxième exécution ne fait rien
+		migrated, err = migrateLegacyAvatars(ctx, images)
+		if err != nil || migrated != 0 {
+			t.Errorf("deuxième migrateLegacyAvatars = %d, %v ; rien à reprendre attendu", migrated, err)
+		}
+		if gallery, _, _ := images.Gallery(ctx, "ancien@example.com"); len(gallery) != 1 {
+			t.Errorf("galerie après la deuxième exécution : %d images, 1 attendue", len(gallery))
+		}
+	})
+}
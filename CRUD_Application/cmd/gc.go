@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// Compte rendu d'un passage du ramasse-miettes des images
+type gcReport struct {
+	Profiles  int      // profils parcourus
+	Blobs     int      // données présentes dans le BlobStore
+	Removed   []string // données supprimées : plus aucun profil n'y fait référence
+	Corrected []string // compteurs de références remis au nombre réel de références
+	Pending   []string // compteurs récents sans profil : envoi en cours ou libération récente, laissés tels quels
+	Missing   []string // données référencées par un profil mais absentes du BlobStore
+}
+
+// collectGarbage recompte les références à partir des profils, corrige les compteurs qui ont dérivé
+// (envoi interrompu, erreur du BlobStore...) et supprime les données qui ne sont plus référencées.
+// Un compteur pris ou retombé à zéro depuis moins de grace sans profil correspondant est celui d'un envoi
+// en cours ou d'une libération récente qu'un envoi peut encore reprendre : on n'y touche pas.
+func collectGarbage(ctx context.Context, images profileImages, now time.Time, grace time.Duration, dryRun bool) (gcReport, error) {
+	var report gcReport
+
+	profiles, err := images.store.ListProfiles(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Profiles = len(profiles)
+
+	live := make(map[string]int)
+	for _, profile := range profiles {
+		// Avatar et images de la galerie : l'avatar a ses propres références sur les données partagées
+		gallery, err := images.store.ListGalleryImages(ctx, profile.Email)
+		if errors.Is(err, ErrProfileNotFound) {
+			continue // profil supprimé pendant le parcours
+		}
+		if err != nil {
+			return report, err
+		}
+		for _, entry := range gallery {
+			for _, key := range imageKeys(entry.Image) {
+				live[key]++
+			}
+		}
+
+		image, err := images.store.GetProfileImage(ctx, profile.Email)
+		if errors.Is(err, ErrImageNotFound) || errors.Is(err, ErrProfileNotFound) {
+			continue // profil sans image, ou supprimé pendant le parcours
+		}
+		if err != nil {
+			return report, err
+		}
+		for _, key := range imageKeys(image) {
+			live[key]++
+		}
+	}
+
+	refs, err := images.store.ListBlobRefs(ctx)
+	if err != nil {
+		return report, err
+	}
+	counters := make(map[string]BlobRef, len(refs))
+	for _, ref := range refs {
+		counters[ref.Key] = ref
+	}
+
+	pending := make(map[string]bool)
+	for _, key := range unionKeys(live, counters) {
+		ref, counted := counters[key]
+		// Compteur retombé à zéro par ReleaseBlob : la donnée n'est supprimée qu'après le délai de grâce
+		released := counted && ref.Count == 0 && live[key] == 0
+		if ref.Count == live[key] && !released {
+			continue
+		}
+		if (live[key] < ref.Count || released) && now.Sub(ref.UpdatedAt) < grace {
+			report.Pending = append(report.Pending, key)
+			pending[key] = true
+			continue
+		}
+		if !released {
+			report.Corrected = append(report.Corrected, key)
+		}
+		if !dryRun {
+			err = images.store.SetBlobRef(ctx, BlobRef{Key: key, Count: live[key], UpdatedAt: now})
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	keys, err := images.blobs.List(ctx, imageBlobPrefix)
+	if err != nil {
+		return report, err
+	}
+	report.Blobs = len(keys)
+
+	// Compteurs relus juste avant la suppression : un envoi a pu reprendre une clé pendant le parcours
+	refs, err = images.store.ListBlobRefs(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, ref := range refs {
+		before := counters[ref.Key]
+		if live[ref.Key] == 0 && !pending[ref.Key] && (ref.Count > before.Count || ref.UpdatedAt.After(before.UpdatedAt)) {
+			report.Pending = append(report.Pending, ref.Key)
+			pending[ref.Key] = true
+		}
+	}
+
+	stored := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stored[key] = true
+		if live[key] > 0 || pending[key] {
+			continue
+		}
+		// Les conversions en cache (WebP...) vivent tant que leur source est référencée
+		if source := conversionSource(key); source != "" && (live[source] > 0 || pending[source]) {
+			continue
+		}
+		report.Removed = append(report.Removed, key)
+		if !dryRun {
+			err = images.blobs.Delete(ctx, key)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	for key := range live {
+		if !stored[key] {
+			report.Missing = append(report.Missing, key)
+		}
+	}
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+func unionKeys(live map[string]int, counters map[string]BlobRef) []string {
+	var keys []string
+	for key := range live {
+		keys = append(keys, key)
+	}
+	for key := range counters {
+		if _, ok := live[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runGC est le point d'entrée de la sous-commande "gc", renvoie le code de sortie
+//
+//	./main gc --backend=sqlite --dry-run
+func runGC(args []string) int {
+	var cfg config
+	fs := configFlagSet("gc", &cfg)
+	dryRun := fs.Bool("dry-run", false, "affiche ce qui serait supprimé ou corrigé sans rien modifier")
+	grace := fs.Duration("grace", time.Hour, "âge minimal d'un compteur sans profil avant de le considérer comme abandonné")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	err = cfg.validate()
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 2
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+	blobs, err := openBlobStore(cfg)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+
+	report, err := collectGarbage(context.Background(), profileImages{store: store, blobs: blobs}, time.Now().UTC(), *grace, *dryRun)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+
+	verb := "supprimées"
+	if *dryRun {
+		verb = "à supprimer (dry-run)"
+	}
+	for _, key := range report.Removed {
+		log.Println("Donnée orpheline", verb, ":", key)
+	}
+	for _, key := range report.Corrected {
+		log.Println("Compteur de références corrigé :", key)
+	}
+	for _, key := range report.Pending {
+		log.Println("Envoi en cours ou libération récente, ignoré :", key)
+	}
+	for _, key := range report.Missing {
+		log.Println("ATTENTION : donnée référencée mais absente du stockage :", key)
+	}
+	log.Printf("%d profils, %d données stockées, %d %s, %d compteurs corrigés, %d absentes",
+		report.Profiles, report.Blobs, len(report.Removed), verb, len(report.Corrected), len(report.Missing))
+
+	if len(report.Missing) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Handlers HTTP communs à tous les backends, la base de données est choisie via le ProfileStore
+type apiHandlers struct {
+	cfg            config
+	store          ProfileStore
+	tokens         *tokenIssuer
+	notifier       Notifier
+	passwords      *passwordHashing
+	images         profileImages // données des images dans le BlobStore
+	pages          pageTemplates // templates des pages HTML, nil s'ils n'ont pas pu être lus
+	usedWipeTokens *usedTokens   // tokens de confirmation du vidage déjà utilisés
+}
+
+func newAPIHandlers(cfg config, store ProfileStore, blobs BlobStore) *apiHandlers {
+	// Les templates sont déjà vérifiés par cfg.validate(), une erreur ici ne bloque que les pages HTML
+	pages, err := loadPageTemplates(cfg.TemplateDir)
+	if err != nil {
+		log.Println("ERREUR : templates des pages :", err)
+	}
+
+	return &apiHandlers{
+		cfg:            cfg,
+		store:          store,
+		images:         profileImages{store: store, blobs: blobs},
+		tokens:         newTokenIssuer(cfg.TokenSecret, cfg.TokenTTL),
+		notifier:       newNotifier(cfg),
+		passwords:      newPasswordHashing(cfg),
+		pages:          pages,
+		usedWipeTokens: newUsedTokens(),
+	}
+}
+
+// Corps de la création d'un profil. Le tag userType accepte aussi "usertype" car encoding/json
+// ne tient pas compte de la casse.
+type createProfileRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	State    bool   `json:"state"`
+	UserType int    `json:"userType"`
+}
+
+// Création d'un utilisateur
+
+func (a *apiHandlers) CreateProfile(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json") // on définit le type de contenu de la réponse
+
+	var body createProfileRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Erreur lors de la lecture du corps de la requête")
+		return
+	}
+
+	if body.Email == "" {
+		writeError(w, http.StatusBadRequest, "Email manquant")
+		return
+	}
+	if !validEmail(body.Email) {
+		writeError(w, http.StatusBadRequest, "Email invalide")
+		return
+	}
+
+	// On hash le mot de passe avec l'algorithme configuré (--password-hash)
+	hash, err := a.passwords.Hash(body.Password)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Erreur lors du hashage du mot de passe")
+		return
+	}
+
+	profile := Profile{
+		Email:     body.Email,
+		Password:  hash,
+		State:     body.State,
+		UserType:  body.UserType,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	// Vérification de l'usertype si autre que prévu, on le met à 1 par défaut
+	if !validUserType(profile.UserType) {
+		profile.UserType = int(roleUser)
+	}
+
+	// Seul un admin connecté peut donner un rôle supérieur à user
+	if profileRole(profile) > roleUser {
+		caller, ok := currentProfile(r.Context())
+		if !ok || profileRole(caller) < roleAdmin {
+			writeError(w, http.StatusForbidden, "Seul un admin peut créer un profil "+profileRole(profile).String())
+			return
+		}
+	}
+
+	err = a.store.CreateProfile(r.Context(), profile)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	log.Println("Création du profile : ", profile.Email)
+	w.Header().Set("Location", "/api/v2/profiles/"+url.PathEscape(profile.Email))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// validEmail accepte une adresse seule (pas de nom affiché, pas de <...>), à la création et à l'import
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Name == "" && address.Address == email
+}
+
+// Récupération d'un utilisateur avec son email
+
+func (a *apiHandlers) GetUserProfile(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	email, ok := profileEmail(w, r)
+	if !ok {
+		return
+	}
+
+	profile, err := a.store.GetProfile(r.Context(), email)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(profile)
+}
+
+// Récupération de tous les utilisateurs
+
+func (a *apiHandlers) GetAllUsers(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// GET /api/getAllUsers?userType=2 filtre par type comme POST /api/getAllUsersState
+	if value := r.URL.Query().Get("userType"); value != "" {
+		userType, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "userType doit être un entier")
+			return
+		}
+		profiles, err := a.store.ListProfilesByType(r.Context(), userType)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(nonNilProfiles(profiles))
+		return
+	}
+
+	profiles, err := a.store.ListProfiles(r.Context())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(nonNilProfiles(profiles))
+}
+
+// Corps de POST /api/getAllUsersState. "user_type" était attendu par l'ancienne route Cockroach,
+// on l'accepte toujours.
+type userTypeRequest struct {
+	UserType      int  `json:"userType"`
+	UserTypeSnake *int `json:"user_type"`
+}
+
+// Récupération de tous les utilisateurs d'un type donné
+
+func (a *apiHandlers) GetAllUsersType(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var body userTypeRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Requête JSON invalide")
+		return
+	}
+	if body.UserTypeSnake != nil {
+		body.UserType = *body.UserTypeSnake
+	}
+
+	profiles, err := a.store.ListProfilesByType(r.Context(), body.UserType)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(nonNilProfiles(profiles))
+}
+
+// Corps de la mise à jour d'un profil
+type updateProfileRequest struct {
+	Email string `json:"email"` // l'email de l'utilisateur pour le trouver et le modifier, absent en v2
+	State *bool  `json:"state"` // le nouvel état de l'utilisateur qui sera mis à jour
+}
+
+// Update d'un utilisateur sur son état, l'email est lu dans l'url ou à défaut dans le corps de la requête
+
+func (a *apiHandlers) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var body updateProfileRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Erreur lors de la lecture du corps de la requête")
+		return
+	}
+
+	// PATCH /api/v2/profiles/{email} : l'email est dans l'url
+	if email, ok := mux.Vars(r)["email"]; ok {
+		body.Email = email
+	}
+
+	// Si l'état est absent, on renvoie une erreur
+	if body.State == nil {
+		writeError(w, http.StatusBadRequest, "Etat non valide")
+		return
+	}
+
+	profile, err := a.store.UpdateProfileState(r.Context(), body.Email, *body.State)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(profile)
+}
+
+// Suppression d'un utilisateur, l'email est lu dans l'url ou à défaut dans le corps de la requête
+
+func (a *apiHandlers) DeleteProfile(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	email, ok := profileEmail(w, r)
+	if !ok {
+		return
+	}
+
+	// Les références sont lues avant la suppression pour retirer ensuite les données des images
+	image, err := a.store.GetProfileImage(r.Context(), email)
+	if err != nil && !errors.Is(err, ErrImageNotFound) {
+		writeStoreError(w, err)
+		return
+	}
+	gallery, err := a.store.ListGalleryImages(r.Context(), email)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	err = a.store.DeleteProfile(r.Context(), email)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	a.images.Remove(r.Context(), image)
+	for _, entry := range gallery {
+		a.images.Remove(r.Context(), entry.Image)
+	}
+
+	writeMessage(w, http.StatusOK, "Profil supprimé")
+}
+
+// Réponse à l'envoi d'une image : le metadata indique ce qui a été retiré de l'image
+type imageUploadResponse struct {
+	Message  string         `json:"Message"`
+	Metadata metadataReport `json:"metadata"`
+}
+
+func (a *apiHandlers) UploadProfileImage(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	upload, report, ok := a.readImageUpload(w, r)
+	if !ok {
+		return
+	}
+
+	// PUT /api/v2/profiles/{email}/image : l'email est dans l'url, sinon dans le formulaire
+	email, ok := mux.Vars(r)["email"]
+	if !ok {
+		email = r.FormValue("email")
+	}
+
+	// On écrit l'image dans le BlobStore puis sa référence dans le profil, elle remplace l'avatar
+	err := a.images.Put(r.Context(), email, upload)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	// La réponse indique ce qui a été retiré de l'image
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(imageUploadResponse{Message: "Image envoyée", Metadata: report})
+}
+
+// readImageUpload lit, vérifie et normalise l'image du formulaire multipart (champ "image") et génère ses variantes.
+// En cas d'erreur la réponse est déjà écrite.
+func (a *apiHandlers) readImageUpload(w http.ResponseWriter, r *http.Request) (imageUpload, metadataReport, bool) {
+	limits := imageLimitsFromConfig(a.cfg)
+
+	// Parse le corps de la requête pour récupérer le formulaire multipart (taille limitée par maxUploadSize)
+	err := r.ParseMultipartForm(limits.MaxBytes)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeImageError(w, tooLargeImageError(r.ContentLength, limits))
+		return imageUpload{}, metadataReport{}, false
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Erreur lors de la lecture du formulaire")
+		return imageUpload{}, metadataReport{}, false
+	}
+
+	// On lit le fichier image envoyé
+	file, handler, err := r.FormFile("image")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Récupération du fichier impossible")
+		return imageUpload{}, metadataReport{}, false
+	}
+	defer file.Close()
+
+	if handler.Size > limits.MaxBytes {
+		writeImageError(w, tooLargeImageError(handler.Size, limits))
+		return imageUpload{}, metadataReport{}, false
+	}
+
+	// Lire les bytes de l'image
+	imageBytes, err := io.ReadAll(file)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Lecture des bytes de l'image impossible")
+		return imageUpload{}, metadataReport{}, false
+	}
+
+	// Le Content-Type et le nom de fichier envoyés par le client ne sont pas fiables :
+	// le type est détecté sur le contenu et l'image est entièrement décodée
+	info, err := validateImage(imageBytes, handler.Filename, limits)
+	var invalid *imageValidationError
+	if errors.As(err, &invalid) {
+		writeImageError(w, invalid)
+		return imageUpload{}, metadataReport{}, false
+	}
+
+	// Les GIF sont stockés en PNG
+	uploadedFormat := info.Format.Name
+	imageBytes, info, err = normalizeUploadFormat(imageBytes, info)
+	if err != nil {
+		log.Println("ERREUR : conversion de l'image :", err)
+		writeError(w, http.StatusInternalServerError, "Impossible de convertir l'image")
+		return imageUpload{}, metadataReport{}, false
+	}
+
+	// Les métadonnées (EXIF, GPS, XMP...) ne doivent pas être redistribuées par le téléchargement
+	imageBytes, normalized, report, err := stripMetadata(imageBytes, info, a.cfg.KeepICCProfile)
+	if err != nil {
+		writeImageError(w, &imageValidationError{Status: http.StatusUnprocessableEntity, Code: imageErrCorrupt, Message: "Structure de l'image invalide"})
+		return imageUpload{}, metadataReport{}, false
+	}
+
+	if uploadedFormat != info.Format.Name {
+		report.ConvertedFrom = uploadedFormat
+	}
+
+	// Les variantes réduites sont générées une fois pour toutes à l'envoi (--image-variants)
+	variants, err := generateVariants(normalized, imageBytes, info.Format, a.variantSizes())
+	if err != nil {
+		log.Println("ERREUR : génération des variantes :", err)
+		writeError(w, http.StatusInternalServerError, "Impossible de générer les variantes de l'image")
+		return imageUpload{}, metadataReport{}, false
+	}
+
+	upload := imageUpload{
+		Data:      imageBytes,
+		Extension: info.Extension,
+		UpdatedAt: time.Now().UTC().Truncate(time.Second), // Last-Modified n'a qu'une précision à la seconde
+		Variants:  variants,
+	}
+	return upload, report, true
+}
+
+// Téléchargement de l'image d'un profil : GET /api/profiles/{email}/image
+
+func (a *apiHandlers) ServeProfileImage(w http.ResponseWriter, r *http.Request) {
+	a.serveProfileImage(w, r, mux.Vars(r)["email"])
+}
+
+// Ancienne route POST /api/getProfileImage avec {"email": "..."}, renvoie maintenant l'image elle-même
+// au lieu de l'écrire dans ./images sur le serveur
+
+func (a *apiHandlers) GetProfileImage(w http.ResponseWriter, r *http.Request) {
+	email, ok := decodeEmail(w, r)
+	if !ok {
+		return
+	}
+	a.serveProfileImage(w, r, email)
+}
+
+// serveProfileImage envoie l'image stockée, ou la variante demandée avec ?size=64. http.ServeContent gère
+// Content-Length, Range et les requêtes conditionnelles (If-None-Match, If-Modified-Since, If-Range).
+func (a *apiHandlers) serveProfileImage(w http.ResponseWriter, r *http.Request, email string) {
+	image, err := a.store.GetProfileImage(r.Context(), email)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	a.serveImage(w, r, email, email, image)
+}
+
+// serveImage envoie une image de profil ou de galerie, name sert au nom du fichier proposé au client
+func (a *apiHandlers) serveImage(w http.ResponseWriter, r *http.Request, email, name string, image ProfileImage) {
+	size := r.URL.Query().Get("size")
+	data, err := selectVariant(r.Context(), a.images, image, size, a.variantSizes())
+	var invalid *imageValidationError
+	if errors.As(err, &invalid) {
+		writeImageError(w, invalid)
+		return
+	}
+	if errors.Is(err, ErrBlobNotFound) {
+		log.Println("ERREUR : données de l'image de", email, "absentes du stockage :", image.Key)
+		writeStoreError(w, ErrImageNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("ERREUR : variante", size, "de l'image de", email, ":", err)
+		writeError(w, http.StatusInternalServerError, "Impossible de générer la variante de l'image")
+		return
+	}
+
+	contentType := mime.TypeByExtension(strings.ToLower(image.Extension))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	// Le format envoyé dépend de l'en-tête Accept : WebP pour les clients qui le demandent s'il est plus léger
+	w.Header().Set("Vary", "Accept")
+	accept := r.Header.Get("Accept")
+	switch format := negotiateFormat(accept, contentType); format {
+	case "":
+		writeImageError(w, notAcceptableError(accept))
+		return
+	case contentType:
+	default:
+		converted, err := a.images.Convert(r.Context(), storedKey(image, size), data, format)
+		if err != nil {
+			log.Println("ERREUR : conversion en", format, "de l'image de", email, ":", err)
+			writeError(w, http.StatusInternalServerError, "Impossible de convertir l'image")
+			return
+		}
+		// La conversion WebP sans perte peut être plus lourde qu'un JPEG : on garde alors l'original s'il est accepté
+		if q, _ := acceptQuality(accept, contentType); format != contentTypeWebP || len(converted) < len(data) || q == 0 {
+			data, contentType = converted, format
+		}
+	}
+
+	extension := image.Extension
+	if ext, ok := outputExtensions[contentType]; ok && mime.TypeByExtension(strings.ToLower(extension)) != contentType {
+		extension = ext
+	}
+	filename := name + extension
+	if size != "" && size != variantOriginal {
+		filename = name + "-" + size + extension
+	}
+
+	// L'ETag dépend uniquement du contenu : une image renvoyée à l'identique garde le même ETag
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache") // l'image est protégée, le client revalide avec l'ETag
+
+	http.ServeContent(w, r, "", image.UpdatedAt, bytes.NewReader(data))
+}
+
+// variantSizes renvoie les tailles de --image-variants, déjà vérifiées au chargement de la configuration
+func (a *apiHandlers) variantSizes() []int {
+	sizes, _ := parseVariantSizes(a.cfg.ImageVariants)
+	return sizes
+}
+
+// Ancienne route POST /api/createHtmlPage : écrit la page du profil dans ./html_pages/<email>.html.
+// Elle est rendue avec les mêmes templates que GET /profiles/{email} ; les images pointent vers l'API
+// sans lien signé, le fichier n'ayant pas de durée de vie.
+
+func (a *apiHandlers) CreateHTMLPage(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	email, ok := decodeEmail(w, r)
+	if !ok {
+		return
+	}
+
+	// L'email sert de nom de fichier : pas de chemin vers un autre dossier
+	if email == "" || email != filepath.Base(email) || email == ".." {
+		writeError(w, http.StatusBadRequest, "Email invalide pour un nom de fichier")
+		return
+	}
+	if a.pages == nil {
+		writeError(w, http.StatusInternalServerError, "Templates des pages indisponibles")
+		return
+	}
+
+	page, err := a.loadProfilePage(r.Context(), email, apiImageLink(email, ""))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	body, err := a.pages.render("profile", page)
+	if err != nil {
+		log.Println("ERREUR : rendu de la page de", email, ":", err)
+		writeError(w, http.StatusInternalServerError, "Erreur lors du rendu de la page")
+		return
+	}
+
+	err = os.WriteFile(filepath.Join("html_pages", email+".html"), body, 0644)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusInternalServerError, "Impossible de créer le fichier HTML")
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "Fichier HTML créé avec succès, dans le répertoire html_pages")
+}
+
+// profileEmail lit l'email du profil visé dans l'url (routes /api/v2), ou à défaut dans le corps de la requête
+func profileEmail(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if email, ok := mux.Vars(r)["email"]; ok {
+		return email, true
+	}
+	return decodeEmail(w, r)
+}
+
+// Corps des anciennes routes qui désignent le profil dans le corps de la requête
+type emailRequest struct {
+	Email string `json:"email"`
+}
+
+// decodeEmail lit un corps de requête de la forme {"email": "..."}
+func decodeEmail(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body emailRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Erreur lors du décodage de la requête")
+		return "", false
+	}
+	return body.Email, true
+}
+
+// nonNilProfiles évite d'encoder null à la place d'une liste vide
+func nonNilProfiles(profiles []Profile) []Profile {
+	if profiles == nil {
+		return []Profile{}
+	}
+	return profiles
+}
+
+// Corps des réponses d'erreur et des réponses sans autre contenu qu'un message
+type errorResponse struct {
+	Erreur string `json:"Erreur"`
+}
+
+type messageResponse struct {
+	Message string `json:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Erreur: message})
+}
+
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(messageResponse{Message: message})
+}
+
+// writeStoreError traduit les erreurs des backends en réponse HTTP
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrProfileNotFound):
+		writeError(w, http.StatusNotFound, "Utilisateur non trouvé")
+	case errors.Is(err, ErrImageNotFound):
+		writeError(w, http.StatusNotFound, "Image non trouvée")
+	case errors.Is(err, ErrEmailAlreadyUsed):
+		writeError(w, http.StatusBadRequest, "Email déjà utilisé")
+	default:
+		log.Println("ERREUR :", err)
+		writeError(w, http.StatusInternalServerError, "Erreur interne de la base de données")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithmes disponibles pour --password-hash
+const (
+	hashBcrypt   = "bcrypt"
+	hashArgon2id = "argon2id"
+)
+
+// Erreur renvoyée quand le format d'un hash stocké n'est reconnu par aucun algorithme
+var ErrUnknownHashFormat = errors.New("format de hash de mot de passe inconnu")
+
+// passwordHasher est implémenté par chaque algorithme de hash de mot de passe
+type passwordHasher interface {
+	Hash(password string) (string, error)
+	Verify(hash, password string) (bool, error)
+	// Matches indique si le hash a été produit par cet algorithme (détection par préfixe)
+	Matches(hash string) bool
+	// Outdated indique si le hash a été produit avec d'autres paramètres que ceux configurés
+	Outdated(hash string) bool
+}
+
+// passwordHashing hash les nouveaux mots de passe avec l'algorithme configuré et vérifie
+// les hash de tous les algorithmes connus, pour que les anciens comptes puissent toujours se connecter
+type passwordHashing struct {
+	current passwordHasher
+	known   []passwordHasher
+
+	// Hash comparé quand l'email n'existe pas, pour que la réponse prenne le même temps.
+	// Calculé au premier login car le hash est volontairement lent.
+	dummyOnce sync.Once
+	dummy     string
+}
+
+func newPasswordHashing(cfg config) *passwordHashing {
+	bcryptHasher := bcryptHasher{cost: cfg.BcryptCost}
+	argon2Hasher := argon2idHasher{
+		memory:  uint32(cfg.Argon2Memory),
+		time:    uint32(cfg.Argon2Time),
+		threads: uint8(cfg.Argon2Threads),
+		keyLen:  32,
+		saltLen: 16,
+	}
+
+	p := &passwordHashing{known: []passwordHasher{bcryptHasher, argon2Hasher}}
+	switch cfg.PasswordHash {
+	case hashArgon2id:
+		p.current = argon2Hasher
+	default:
+		p.current = bcryptHasher
+	}
+	return p
+}
+
+func (p *passwordHashing) Hash(password string) (string, error) {
+	return p.current.Hash(password)
+}
+
+// Verify vérifie le mot de passe et indique si le hash doit être recalculé
+// (autre algorithme ou paramètres différents de la configuration actuelle)
+func (p *passwordHashing) Verify(hash, password string) (ok bool, rehash bool, err error) {
+	for _, hasher := range p.known {
+		if !hasher.Matches(hash) {
+			continue
+		}
+		ok, err = hasher.Verify(hash, password)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, hasher != p.current || hasher.Outdated(hash), nil
+	}
+	return false, false, ErrUnknownHashFormat
+}
+
+// DummyHash renvoie un hash valide d'un mot de passe que personne ne connaît
+func (p *passwordHashing) DummyHash() string {
+	p.dummyOnce.Do(func() {
+		p.dummy, _ = p.Hash("mot de passe factice")
+	})
+	return p.dummy
+}
+
+// bcrypt : $2a$<coût>$<sel et hash>
+type bcryptHasher struct {
+	cost int
+}
+
+func (b bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	return string(hash), err
+}
+
+func (b bcryptHasher) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b bcryptHasher) Matches(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (b bcryptHasher) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.cost
+}
+
+// argon2id au format PHC : $argon2id$v=19$m=<mémoire en Kio>,t=<itérations>,p=<threads>$<sel>$<hash>
+type argon2idHasher struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	keyLen  uint32
+	saltLen uint32
+}
+
+func (a argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.saltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.time, a.memory, a.threads, a.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.memory, a.time, a.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a argon2idHasher) Verify(hash, password string) (bool, error) {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	// On recalcule avec les paramètres du hash stocké, pas ceux de la configuration
+	computed := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (a argon2idHasher) Matches(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (a argon2idHasher) Outdated(hash string) bool {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.memory != a.memory || params.time != a.time || params.threads != a.threads ||
+		uint32(len(key)) != a.keyLen || uint32(len(salt)) != a.saltLen
+}
+
+func parseArgon2id(hash string) (params argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("version argon2 non supportée : %s", parts[2])
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("paramètres argon2 invalides : %w", err)
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("sel argon2 invalide : %w", err)
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("hash argon2 invalide : %w", err)
+	}
+
+	// argon2.IDKey panique sur ces valeurs, un hash corrompu ne doit pas faire tomber le serveur
+	if params.time < 1 || params.threads < 1 || params.memory < 8*uint32(params.threads) {
+		return params, nil, nil, fmt.Errorf("paramètres argon2 invalides : %s", parts[3])
+	}
+	if len(key) == 0 || len(salt) < 8 {
+		return params, nil, nil, fmt.Errorf("sel ou hash argon2 trop court : %d et %d octets", len(salt), len(key))
+	}
+	return params, salt, key, nil
+}
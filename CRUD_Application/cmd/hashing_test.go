@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func testArgon2idHasher() argon2idHasher {
+	return argon2idHasher{memory: 64, time: 1, threads: 1, keyLen: 32, saltLen: 16}
+}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	hasher := testArgon2idHasher()
+	hash, err := hasher.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := hasher.Verify(hash, "secret")
+	if err != nil || !ok {
+		t.Fatalf("Verify(bon mot de passe) = %v, %v", ok, err)
+	}
+	ok, err = hasher.Verify(hash, "faux")
+	if err != nil || ok {
+		t.Fatalf("Verify(mauvais mot de passe) = %v, %v", ok, err)
+	}
+	if hasher.Outdated(hash) {
+		t.Error("un hash produit avec la configuration ne doit pas être à recalculer")
+	}
+
+	stronger := hasher
+	stronger.time = 2
+	if !stronger.Outdated(hash) {
+		t.Error("un hash produit avec d'autres paramètres doit être à recalculer")
+	}
+}
+
+// Un hash stocké corrompu renvoie une erreur : argon2.IDKey ne doit jamais être appelé avec des valeurs qui le font paniquer
+func TestArgon2idRejectsCorruptedHashes(t *testing.T) {
+	hashes := map[string]string{
+		"hash vide":           "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$",
+		"sel trop court":      "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$aGFzaGhhc2g",
+		"aucune itération":    "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"aucun thread":        "$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"mémoire trop petite": "$argon2id$v=19$m=4,t=1,p=1$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"mauvaise version":    "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"sel illisible":       "$argon2id$v=19$m=64,t=1,p=1$!!!$aGFzaGhhc2g",
+		"segment manquant":    "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ",
+	}
+
+	hasher := testArgon2idHasher()
+	for name, hash := range hashes {
+		t.Run(name, func(t *testing.T) {
+			ok, err := hasher.Verify(hash, "secret")
+			if err == nil || ok {
+				t.Errorf("Verify(%q) = %v, %v, une erreur est attendue", hash, ok, err)
+			}
+			if !hasher.Outdated(hash) {
+				t.Errorf("Outdated(%q) = false, un hash illisible est à recalculer", hash)
+			}
+		})
+	}
+}
+
+// Un compte dont le hash vient d'un autre algorithme se connecte toujours, et son hash est à recalculer
+func TestPasswordHashingRehashesOtherAlgorithm(t *testing.T) {
+	cfg := config{PasswordHash: hashArgon2id, BcryptCost: 4, Argon2Memory: 64, Argon2Time: 1, Argon2Threads: 1}
+	hashing := newPasswordHashing(cfg)
+
+	bcryptHash, err := bcryptHasher{cost: 4}.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, rehash, err := hashing.Verify(bcryptHash, "secret")
+	if err != nil || !ok || !rehash {
+		t.Fatalf("Verify(hash bcrypt) = %v, %v, %v, connexion avec rehash attendue", ok, rehash, err)
+	}
+
+	_, _, err = hashing.Verify("$md5$inconnu", "secret")
+	if err != ErrUnknownHashFormat {
+		t.Errorf("Verify(format inconnu) : erreur %v, ErrUnknownHashFormat attendue", err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Préfixe des clés des images de profil dans le BlobStore
+const imageBlobPrefix = "images/"
+
+// Image envoyée, avec ses données, avant son écriture dans le BlobStore
+type imageUpload struct {
+	Data      []byte
+	Extension string
+	UpdatedAt time.Time
+	Variants  map[string][]byte // données des variantes réduites, indexées par nom
+}
+
+// profileImages relie les références gardées par le ProfileStore aux données du BlobStore
+type profileImages struct {
+	store ProfileStore
+	blobs BlobStore
+}
+
+// Put remplace l'avatar du profil par l'image envoyée (ancienne route d'envoi d'une seule image) :
+// l'image prend la place de l'ancien avatar dans la galerie, qui en est retiré.
+func (p profileImages) Put(ctx context.Context, email string, upload imageUpload) error {
+	// Une image d'avant la galerie pas encore reprise (migrateLegacyAvatars) est de toute façon remplacée
+	gallery, err := p.store.ListGalleryImages(ctx, email)
+	if err != nil {
+		return err
+	}
+	previous, err := p.store.GetProfileImage(ctx, email)
+	if err != nil && !errors.Is(err, ErrImageNotFound) {
+		return err
+	}
+
+	position := nextPosition(gallery)
+	replaced, found := findGalleryImage(gallery, previous.GalleryID)
+	if found {
+		position = replaced.Position
+	}
+
+	// Sans limite : l'ancien avatar est retiré juste après, la galerie ne grandit pas
+	entry, err := p.add(ctx, email, upload, "", position, 0)
+	if err != nil {
+		return err
+	}
+	err = p.SetPrimary(ctx, email, entry)
+	if err != nil {
+		return err
+	}
+	if found {
+		return p.removeEntry(ctx, email, replaced)
+	}
+	return nil
+}
+
+// storeUpload écrit les données de l'image et de ses variantes dans le BlobStore et renvoie leur référence.
+// Les données sont rangées par empreinte SHA-256 : une image déjà envoyée par un autre profil n'est pas
+// stockée une deuxième fois, elle gagne seulement une référence. La référence est prise avant l'écriture
+// pour que le ramasse-miettes ne supprime pas une donnée en cours d'envoi. L'appelant rend les références
+// avec Remove si la référence ne peut pas être enregistrée.
+func (p profileImages) storeUpload(ctx context.Context, upload imageUpload) (ProfileImage, error) {
+	image := ProfileImage{
+		Key:       contentKey(upload.Data, upload.Extension),
+		Extension: canonicalExtension(upload.Data, upload.Extension),
+		UpdatedAt: upload.UpdatedAt,
+		Variants:  make(map[string]string, len(upload.Variants)),
+	}
+	data := map[string][]byte{image.Key: upload.Data}
+	for name, variant := range upload.Variants {
+		image.Variants[name] = contentKey(variant, upload.Extension)
+		data[image.Variants[name]] = variant
+	}
+
+	err := p.acquire(ctx, image)
+	if err != nil {
+		return ProfileImage{}, err
+	}
+	for key, content := range data {
+		err = p.blobs.Put(ctx, key, content)
+		if err != nil {
+			p.Remove(ctx, image)
+			return ProfileImage{}, err
+		}
+	}
+	return image, nil
+}
+
+// acquire prend une référence sur chaque donnée de l'image, et rend celles déjà prises en cas d'erreur
+func (p profileImages) acquire(ctx context.Context, image ProfileImage) error {
+	var acquired []string
+	for _, key := range imageKeys(image) {
+		err := p.store.AcquireBlob(ctx, key, time.Now().UTC())
+		if err != nil {
+			p.release(ctx, acquired)
+			return err
+		}
+		acquired = append(acquired, key)
+	}
+	return nil
+}
+
+// Read renvoie les données de l'original ou d'une variante stockée (ok à false si elle n'a pas été générée)
+func (p profileImages) Read(ctx context.Context, image ProfileImage, name string) (data []byte, ok bool, err error) {
+	key := storedKey(image, name)
+	if name != "" && name != variantOriginal && key == "" {
+		return nil, false, nil
+	}
+
+	// Images envoyées avant le BlobStore : les variantes sont recalculées à partir de l'original
+	if key == "" {
+		return image.Data, true, nil
+	}
+
+	data, err = p.blobs.Get(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// LoadImage lit les données d'une image (avatar ou image de la galerie) et de ses variantes stockées
+func (p profileImages) LoadImage(ctx context.Context, image ProfileImage) (imageUpload, error) {
+	upload := imageUpload{Extension: image.Extension, UpdatedAt: image.UpdatedAt}
+	var err error
+	upload.Data, _, err = p.Read(ctx, image, variantOriginal)
+	if err != nil {
+		return imageUpload{}, err
+	}
+	for name := range image.Variants {
+		data, _, err := p.Read(ctx, image, name)
+		if err != nil {
+			return imageUpload{}, err
+		}
+		if upload.Variants == nil {
+			upload.Variants = make(map[string][]byte)
+		}
+		upload.Variants[name] = data
+	}
+	return upload, nil
+}
+
+// Remove retire les références d'une image qui n'est plus utilisée par le profil. Les données ne sont
+// jamais supprimées ici : un envoi concurrent peut reprendre la même clé entre la libération et la
+// suppression. La sous-commande gc supprime les données sans référence après le délai de grâce.
+// Une erreur laisse au pire un compteur trop haut, que gc corrige : elle est seulement journalisée.
+func (p profileImages) Remove(ctx context.Context, image ProfileImage) {
+	p.release(ctx, imageKeys(image))
+}
+
+func (p profileImages) release(ctx context.Context, keys []string) {
+	now := time.Now().UTC()
+	for _, key := range keys {
+		_, err := p.store.ReleaseBlob(ctx, key, now)
+		if err != nil {
+			log.Println("ERREUR : libération de", key, ":", err)
+		}
+	}
+}
+
+// RemoveAll supprime les données de toutes les images, après le vidage de la base
+func (p profileImages) RemoveAll(ctx context.Context) error {
+	keys, err := p.blobs.List(ctx, imageBlobPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = p.blobs.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedKey renvoie la clé de l'original ou d'une variante stockée, "" si elle n'est pas dans le BlobStore
+func storedKey(image ProfileImage, name string) string {
+	if name == "" || name == variantOriginal {
+		return image.Key
+	}
+	return image.Variants[name]
+}
+
+// imageKeys renvoie les clés utilisées par une image, une fois par référence : une variante
+// identique à l'original (image plus petite que la variante) compte comme une deuxième référence
+func imageKeys(image ProfileImage) []string {
+	var keys []string
+	if image.Key != "" {
+		keys = append(keys, image.Key)
+	}
+	for _, key := range image.Variants {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// contentKey range les données par empreinte : images/ab/ab12...ef.png. L'extension est celle du format
+// détecté sur le contenu, pas celle du nom de fichier : les mêmes octets envoyés en photo.jpg et en
+// PHOTO.JPEG partagent la même clé.
+func contentKey(data []byte, extension string) string {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	return imageBlobPrefix + digest[:2] + "/" + digest + canonicalExtension(data, extension)
+}
+
+// canonicalExtension renvoie la première extension du format détecté sur les données, ou l'extension
+// donnée en minuscules si le contenu n'est pas reconnu
+func canonicalExtension(data []byte, extension string) string {
+	detected := http.DetectContentType(data)
+	for _, format := range imageFormats {
+		if format.ContentType == detected {
+			return format.Extensions[0]
+		}
+	}
+	return strings.ToLower(extension)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+func testImages(t *testing.T, store ProfileStore) profileImages {
+	blobs, err := newFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profileImages{store: store, blobs: blobs}
+}
+
+func testJPEGUpload(t *testing.T, extension string) imageUpload {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return imageUpload{Data: buf.Bytes(), Extension: extension, UpdatedAt: time.Now().UTC()}
+}
+
+func storedBlobs(t *testing.T, images profileImages) []string {
+	keys, err := images.blobs.List(context.Background(), imageBlobPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func blobRefCount(t *testing.T, store ProfileStore, key string) (BlobRef, bool) {
+	refs, err := store.ListBlobRefs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range refs {
+		if ref.Key == key {
+			return ref, true
+		}
+	}
+	return BlobRef{}, false
+}
+
+// Les mêmes octets envoyés sous des noms différents sont stockés une seule fois, sous l'extension du format détecté
+func TestStoreUploadDeduplicatesAcrossExtensions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		images := testImages(t, store)
+		ctx := context.Background()
+
+		var stored []ProfileImage
+		for _, extension := range []string{".jpg", ".JPEG", ".jpe"} {
+			image, err := images.storeUpload(ctx, testJPEGUpload(t, extension))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored = append(stored, image)
+		}
+
+		for _, image := range stored {
+			if image.Key != stored[0].Key || image.Extension != ".jpg" {
+				t.Errorf("image stockée sous %s (%s), %s (.jpg) attendu", image.Key, image.Extension, stored[0].Key)
+			}
+		}
+		if keys := storedBlobs(t, images); len(keys) != 1 {
+			t.Errorf("données stockées : %v, une seule attendue", keys)
+		}
+		if ref, _ := blobRefCount(t, store, stored[0].Key); ref.Count != 3 {
+			t.Errorf("compteur de références : %d, 3 attendu", ref.Count)
+		}
+	})
+}
+
+// La dernière libération ne supprime pas les données : un envoi simultané de la même image peut les reprendre.
+// Seul le ramasse-miettes les supprime, après le délai de grâce.
+func TestReleasedImagesWaitForGC(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		images := testImages(t, store)
+		ctx := context.Background()
+
+		image, err := images.storeUpload(ctx, testJPEGUpload(t, ".jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		images.Remove(ctx, image)
+
+		if keys := storedBlobs(t, images); len(keys) != 1 {
+			t.Fatalf("données après la dernière libération : %v, gardées jusqu'au ramasse-miettes", keys)
+		}
+		if ref, ok := blobRefCount(t, store, image.Key); !ok || ref.Count != 0 {
+			t.Fatalf("compteur après la dernière libération : %+v (présent : %v), gardé à zéro", ref, ok)
+		}
+
+		// Dans le délai de grâce, la donnée est laissée à un envoi qui la reprendrait
+		report, err := collectGarbage(ctx, images, time.Now().UTC(), time.Hour, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Removed) != 0 || len(report.Pending) != 1 {
+			t.Fatalf("ramasse-miettes dans le délai de grâce : %+v", report)
+		}
+
+		// Reprise de la même image : la donnée et son compteur sont réutilisés
+		again, err := images.storeUpload(ctx, testJPEGUpload(t, ".jpeg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref, _ := blobRefCount(t, store, again.Key); again.Key != image.Key || ref.Count != 1 {
+			t.Fatalf("reprise : clé %s, compteur %d ; %s et 1 attendus", again.Key, ref.Count, image.Key)
+		}
+		images.Remove(ctx, again)
+
+		// Après le délai de grâce, la donnée et son compteur sont supprimés
+		report, err = collectGarbage(ctx, images, time.Now().UTC().Add(2*time.Hour), time.Hour, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Removed) != 1 || report.Removed[0] != image.Key {
+			t.Fatalf("ramasse-miettes après le délai de grâce : %+v", report)
+		}
+		if keys := storedBlobs(t, images); len(keys) != 0 {
+			t.Errorf("données restantes : %v", keys)
+		}
+		if _, ok := blobRefCount(t, store, image.Key); ok {
+			t.Error("le compteur à zéro doit partir avec les données")
+		}
+	})
+}
+
+// Le ramasse-miettes supprime les données sans référence et remet les compteurs au nombre réel de références
+func TestCollectGarbage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		images := testImages(t, store)
+		ctx := context.Background()
+
+		err := store.CreateProfile(ctx, testProfile("a@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = images.Put(ctx, "a@example.com", testJPEGUpload(t, ".jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		image, err := store.GetProfileImage(ctx, "a@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Envoi interrompu : données écrites sans profil, et compteur qui a dérivé
+		orphan := imageBlobPrefix + "00/orphelin.png"
+		err = images.blobs.Put(ctx, orphan, []byte("orphelin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.SetBlobRef(ctx, BlobRef{Key: image.Key, Count: 5, UpdatedAt: time.Now().UTC().Add(-2 * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := collectGarbage(ctx, images, time.Now().UTC(), time.Hour, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Removed) != 1 || report.Removed[0] != orphan {
+			t.Errorf("données supprimées : %v, %s attendu", report.Removed, orphan)
+		}
+		// Une référence pour l'image de la galerie, une pour l'avatar
+		if ref, _ := blobRefCount(t, store, image.Key); ref.Count != 2 {
+			t.Errorf("compteur après le ramasse-miettes : %d, 2 attendu", ref.Count)
+		}
+		if keys := storedBlobs(t, images); len(keys) != 1 || keys[0] != image.Key {
+			t.Errorf("données restantes : %v, seulement %s attendu", keys, image.Key)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	_ "image/gif" // décodeurs enregistrés pour image.Decode
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Limites appliquées aux images envoyées, configurables avec --image-max-*
+type imageLimits struct {
+	MaxBytes  int64
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int
+}
+
+func imageLimitsFromConfig(cfg config) imageLimits {
+	return imageLimits{
+		MaxBytes:  cfg.ImageMaxBytes,
+		MaxWidth:  cfg.ImageMaxWidth,
+		MaxHeight: cfg.ImageMaxHeight,
+		MaxPixels: cfg.ImageMaxPixels,
+	}
+}
+
+// Format d'image accepté : le type est reconnu sur les premiers octets, jamais sur ce qu'annonce le client
+type imageFormat struct {
+	Name        string   // nom renvoyé par image.Decode
+	ContentType string   // type détecté par http.DetectContentType
+	Extensions  []string // extensions acceptées, la première est celle sous laquelle l'image est stockée
+}
+
+var imageFormats = []imageFormat{
+	{Name: "png", ContentType: "image/png", Extensions: []string{".png"}},
+	{Name: "jpeg", ContentType: "image/jpeg", Extensions: []string{".jpg", ".jpeg", ".jpe"}},
+	{Name: "gif", ContentType: "image/gif", Extensions: []string{".gif"}}, // stocké en PNG, voir normalizeUploadFormat
+}
+
+// Résultat de la validation d'une image
+type imageInfo struct {
+	Image     image.Image // image décodée, réutilisée pour générer les variantes
+	Format    imageFormat
+	Extension string
+	Width     int
+	Height    int
+}
+
+// Codes des erreurs de validation, renvoyés dans le champ "code" de la réponse
+const (
+	imageErrTooLarge          = "image_too_large"
+	imageErrUnsupportedFormat = "unsupported_format"
+	imageErrExtensionMismatch = "extension_mismatch"
+	imageErrDimensions        = "dimensions_too_large"
+	imageErrCorrupt           = "corrupt_image"
+)
+
+// imageValidationError explique pourquoi une image est refusée
+type imageValidationError struct {
+	Status  int
+	Code    string
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *imageValidationError) Error() string {
+	return e.Code + " : " + e.Message
+}
+
+// validateImage vérifie une image envoyée : taille, type détecté sur le contenu, extension du nom de fichier,
+// dimensions annoncées (avant décodage, pour refuser les bombes de décompression) puis décodage complet
+func validateImage(data []byte, filename string, limits imageLimits) (imageInfo, error) {
+	if int64(len(data)) > limits.MaxBytes {
+		return imageInfo{}, tooLargeImageError(int64(len(data)), limits)
+	}
+
+	detected := http.DetectContentType(data)
+	var format *imageFormat
+	for i := range imageFormats {
+		if imageFormats[i].ContentType == detected {
+			format = &imageFormats[i]
+		}
+	}
+	if format == nil {
+		return imageInfo{}, &imageValidationError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    imageErrUnsupportedFormat,
+			Message: "Le fichier n'est pas une image PNG, JPEG ou GIF",
+			Details: map[string]interface{}{"detected": detected, "allowed": allowedImageTypes()},
+		}
+	}
+
+	// Le nom de fichier n'est que vérifié : l'image est stockée sous l'extension du format détecté
+	extension := strings.ToLower(filepath.Ext(filename))
+	if extension == "" {
+		extension = format.Extensions[0]
+	}
+	if !containsString(format.Extensions, extension) {
+		return imageInfo{}, &imageValidationError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    imageErrExtensionMismatch,
+			Message: "L'extension du fichier ne correspond pas à son contenu",
+			Details: map[string]interface{}{"extension": extension, "detected": format.ContentType, "expected": format.Extensions},
+		}
+	}
+
+	// Seul l'en-tête est lu ici : une image de 50000x50000 pixels est refusée sans allouer sa mémoire
+	config, name, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || name != format.Name {
+		return imageInfo{}, corruptImageError(err)
+	}
+	if config.Width > limits.MaxWidth || config.Height > limits.MaxHeight || config.Width*config.Height > limits.MaxPixels {
+		return imageInfo{}, &imageValidationError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    imageErrDimensions,
+			Message: "Les dimensions de l'image dépassent les limites autorisées",
+			Details: map[string]interface{}{
+				"width":     config.Width,
+				"height":    config.Height,
+				"maxWidth":  limits.MaxWidth,
+				"maxHeight": limits.MaxHeight,
+				"maxPixels": limits.MaxPixels,
+			},
+		}
+	}
+
+	// Décodage complet : une image tronquée ou corrompue est refusée
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return imageInfo{}, corruptImageError(err)
+	}
+
+	return imageInfo{Image: decoded, Format: *format, Extension: format.Extensions[0], Width: config.Width, Height: config.Height}, nil
+}
+
+func corruptImageError(err error) *imageValidationError {
+	details := map[string]interface{}{}
+	if err != nil {
+		details["cause"] = err.Error()
+	}
+	return &imageValidationError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    imageErrCorrupt,
+		Message: "L'image est corrompue ou ne peut pas être décodée",
+		Details: details,
+	}
+}
+
+// writeImageError renvoie l'erreur de validation sous la forme {"Erreur": ..., "code": ..., "details": {...}}
+func writeImageError(w http.ResponseWriter, err *imageValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(imageErrorResponse{
+		Erreur:  err.Message,
+		Code:    err.Code,
+		Details: err.Details,
+	})
+}
+
+type imageErrorResponse struct {
+	Erreur  string                 `json:"Erreur"`
+	Code    string                 `json:"code"`
+	Details map[string]interface{} `json:"details"`
+}
+
+// Place laissée aux autres champs du formulaire multipart en plus de l'image
+const multipartOverhead = 1 << 20
+
+// maxUploadSize limite la taille du corps de la requête avant que le formulaire soit lu
+// (y compris par les policies d'autorisation qui lisent l'email du formulaire). Les limites sont
+// gardées dans le contexte : targetEmail lit le formulaire avec la même limite que le handler.
+func maxUploadSize(limits imageLimits, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := limits.MaxBytes + multipartOverhead
+		if r.ContentLength > limit {
+			writeImageError(w, tooLargeImageError(r.ContentLength, limits))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next(w, r.WithContext(context.WithValue(r.Context(), imageLimitsContextKey, limits)))
+	}
+}
+
+const imageLimitsContextKey contextKey = "imageLimits"
+
+func tooLargeImageError(size int64, limits imageLimits) *imageValidationError {
+	return &imageValidationError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    imageErrTooLarge,
+		Message: "L'image dépasse la taille maximale autorisée",
+		Details: map[string]interface{}{"size": size, "maxBytes": limits.MaxBytes},
+	}
+}
+
+func allowedImageTypes() []string {
+	var types []string
+	for _, format := range imageFormats {
+		types = append(types, format.ContentType)
+	}
+	return types
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
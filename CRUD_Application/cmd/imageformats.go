@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// Formats de sortie que l'API sait produire à partir d'une image stockée (PNG ou JPEG).
+// WebP est encodé sans perte par un encodeur en Go pur (pas de libwebp) ; AVIF n'a pas d'encodeur en Go pur.
+const (
+	contentTypePNG  = "image/png"
+	contentTypeJPEG = "image/jpeg"
+	contentTypeWebP = "image/webp"
+)
+
+var outputExtensions = map[string]string{
+	contentTypePNG:  ".png",
+	contentTypeJPEG: ".jpg",
+	contentTypeWebP: ".webp",
+}
+
+// Les GIF sont acceptés à l'envoi mais stockés en PNG (première image d'un GIF animé) :
+// le stockage, les variantes et la déduplication ne connaissent ainsi que PNG et JPEG
+func normalizeUploadFormat(data []byte, info imageInfo) ([]byte, imageInfo, error) {
+	if info.Format.Name != "gif" {
+		return data, info, nil
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, info.Image)
+	if err != nil {
+		return nil, info, err
+	}
+	for _, format := range imageFormats {
+		if format.Name == "png" {
+			info.Format = format
+		}
+	}
+	info.Extension = ".png"
+	return buf.Bytes(), info, nil
+}
+
+// acceptQuality renvoie le poids (q) donné à contentType par l'en-tête Accept, et si le type y est nommé
+// explicitement (et non via image/* ou */*). Sans en-tête Accept, tout est accepté.
+func acceptQuality(accept, contentType string) (q float64, explicit bool) {
+	if strings.TrimSpace(accept) == "" {
+		return 1, false
+	}
+
+	major, _, _ := strings.Cut(contentType, "/")
+	best, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		weight := 1.0
+		if value, ok := params["q"]; ok {
+			weight, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		// La règle la plus précise l'emporte : image/webp;q=0 refuse WebP même avec */*
+		level := -1
+		switch mediaType {
+		case contentType:
+			level = 2
+		case major + "/*":
+			level = 1
+		case "*/*":
+			level = 0
+		}
+		if level > specificity {
+			best, specificity = weight, level
+		}
+	}
+	return best, specificity == 2
+}
+
+// negotiateFormat choisit le format envoyé au client. WebP n'est proposé qu'aux clients qui le citent
+// explicitement (les navigateurs le font), les autres reçoivent le format stocké s'ils l'acceptent,
+// sinon une conversion en PNG ou JPEG. Renvoie "" si aucun format ne convient.
+func negotiateFormat(accept, stored string) string {
+	storedQ, _ := acceptQuality(accept, stored)
+	if webpQ, explicit := acceptQuality(accept, contentTypeWebP); explicit && webpQ > 0 && webpQ >= storedQ {
+		return contentTypeWebP
+	}
+	if storedQ > 0 {
+		return stored
+	}
+
+	best, bestQ := "", 0.0
+	for _, candidate := range []string{contentTypePNG, contentTypeJPEG} {
+		if q, _ := acceptQuality(accept, candidate); q > bestQ {
+			best, bestQ = candidate, q
+		}
+	}
+	return best
+}
+
+// convertImage réencode les données dans le format demandé
+func convertImage(data []byte, contentType string) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	switch contentType {
+	case contentTypeWebP:
+		err = nativewebp.Encode(&buf, img, nil)
+	case contentTypePNG:
+		err = png.Encode(&buf, img)
+	case contentTypeJPEG:
+		// JPEG n'a pas de transparence : l'image est posée sur un fond blanc
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: 85})
+	default:
+		return nil, errors.New("format de sortie inconnu " + contentType)
+	}
+	return buf.Bytes(), err
+}
+
+// conversionKey range une conversion à côté de sa source dans le BlobStore : images/ab/ab12...ef.png.webp.
+// Elle disparaît avec la source et le ramasse-miettes la garde tant que la source est référencée.
+func conversionKey(sourceKey, contentType string) string {
+	return sourceKey + outputExtensions[contentType]
+}
+
+// conversionSource renvoie la clé de la source d'une conversion, ou "" si key n'est pas une conversion
+func conversionSource(key string) string {
+	for _, extension := range outputExtensions {
+		source := strings.TrimSuffix(key, extension)
+		if source != key && strings.HasPrefix(source, imageBlobPrefix) && strings.Contains(source[len(imageBlobPrefix):], ".") {
+			return source
+		}
+	}
+	return ""
+}
+
+// Convert renvoie les données converties, en réutilisant la conversion déjà faite pour la même source.
+// sourceKey est vide pour les variantes calculées à la volée et les anciennes images : pas de cache.
+func (p profileImages) Convert(ctx context.Context, sourceKey string, data []byte, contentType string) ([]byte, error) {
+	if sourceKey == "" {
+		return convertImage(data, contentType)
+	}
+
+	key := conversionKey(sourceKey, contentType)
+	cached, err := p.blobs.Get(ctx, key)
+	if err == nil {
+		return cached, nil
+	}
+	if !errors.Is(err, ErrBlobNotFound) {
+		log.Println("ERREUR : lecture de la conversion", key, ":", err)
+	}
+
+	converted, err := convertImage(data, contentType)
+	if err != nil {
+		return nil, err
+	}
+	// Le cache est une optimisation : une erreur d'écriture n'empêche pas de servir l'image
+	if err := p.blobs.Put(ctx, key, converted); err != nil {
+		log.Println("ERREUR : écriture de la conversion", key, ":", err)
+	}
+	return converted, nil
+}
+
+// notAcceptableError est renvoyée quand l'en-tête Accept n'autorise aucun format d'image
+func notAcceptableError(accept string) *imageValidationError {
+	return &imageValidationError{
+		Status:  http.StatusNotAcceptable,
+		Code:    "not_acceptable",
+		Message: "Aucun format d'image disponible ne correspond à l'en-tête Accept",
+		Details: map[string]interface{}{"accept": accept, "available": []string{contentTypeWebP, contentTypePNG, contentTypeJPEG}},
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// Nom de la variante qui correspond à l'image envoyée, sans redimensionnement
+const variantOriginal = "original"
+
+// parseVariantSizes lit --image-variants : tailles en pixels du plus grand côté, séparées par des virgules
+func parseVariantSizes(value string) ([]int, error) {
+	var sizes []int
+	for _, entry := range splitList(value) {
+		size, err := strconv.Atoi(entry)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("taille de variante invalide %q dans --image-variants", entry)
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// variantName donne le nom d'une variante, utilisé dans ?size= et comme clé de stockage
+func variantName(size int) string {
+	return strconv.Itoa(size)
+}
+
+// generateVariants produit une version réduite de l'image pour chaque taille, dans le même format que l'original.
+// Une image déjà plus petite que la taille demandée n'est pas agrandie : la variante est l'original.
+func generateVariants(img image.Image, original []byte, format imageFormat, sizes []int) (map[string][]byte, error) {
+	variants := make(map[string][]byte, len(sizes))
+	for _, size := range sizes {
+		data, err := resizeImage(img, original, format, size)
+		if err != nil {
+			return nil, fmt.Errorf("variante %dpx : %w", size, err)
+		}
+		variants[variantName(size)] = data
+	}
+	return variants, nil
+}
+
+// resizeImage réduit l'image pour que son plus grand côté fasse au plus size pixels
+func resizeImage(img image.Image, original []byte, format imageFormat, size int) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return original, nil
+	}
+
+	// On garde les proportions : le plus grand côté passe à size
+	if width >= height {
+		width, height = size, height*size/width
+	} else {
+		width, height = width*size/height, size
+	}
+	if width == 0 {
+		width = 1
+	}
+	if height == 0 {
+		height = 1
+	}
+
+	resized := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	var err error
+	switch format.Name {
+	case "jpeg":
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 85})
+	default:
+		err = png.Encode(&buf, resized)
+	}
+	return buf.Bytes(), err
+}
+
+// selectVariant renvoie les données de la variante demandée avec ?size=.
+// Les images envoyées avant l'ajout d'une taille n'ont pas cette variante : elle est alors calculée à la volée.
+func selectVariant(ctx context.Context, images profileImages, image ProfileImage, name string, sizes []int) ([]byte, error) {
+	data, ok, err := images.Read(ctx, image, name)
+	if err != nil || ok {
+		return data, err
+	}
+
+	for _, size := range sizes {
+		if variantName(size) == name {
+			original, _, err := images.Read(ctx, image, variantOriginal)
+			if err != nil {
+				return nil, err
+			}
+			return resizeStored(original, size)
+		}
+	}
+	return nil, &imageValidationError{
+		Status:  http.StatusBadRequest,
+		Code:    "unknown_variant",
+		Message: "Taille d'image inconnue",
+		Details: map[string]interface{}{"size": name, "available": availableVariants(sizes)},
+	}
+}
+
+func resizeStored(original []byte, size int) ([]byte, error) {
+	img, name, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return nil, err
+	}
+	for _, format := range imageFormats {
+		if format.Name == name {
+			return resizeImage(img, original, format, size)
+		}
+	}
+	return nil, fmt.Errorf("format d'image inattendu %q", name)
+}
+
+func availableVariants(sizes []int) []string {
+	names := []string{variantOriginal}
+	for _, size := range sizes {
+		names = append(names, variantName(size))
+	}
+	return names
+}
+
+// copyVariantKeys copie les clés des variantes, pour les backends qui gardent les références en mémoire
+func copyVariantKeys(variants map[string]string) map[string]string {
+	if variants == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(variants))
+	for name, key := range variants {
+		copied[name] = key
+	}
+	return copied
+}
@@ -1,252 +1,98 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
 
-	"github.com/gocql/gocql"
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/mongo"
-	"gorm.io/gorm"
 )
 
-////////////////////////
-///// PARTIE MONGO /////
-////////////////////////
-
-type mongoDB_Interface interface {
-	CreateProfileMongo(w http.ResponseWriter, r *http.Request)
-	GetAllUsersMongo(w http.ResponseWriter, r *http.Request)
-	GetUserProfileMongo(w http.ResponseWriter, r *http.Request)
-	UpdateProfileMongo(w http.ResponseWriter, r *http.Request)
-	DeleteProfileMongo(w http.ResponseWriter, r *http.Request)
-	UploadProfileImageMongo(w http.ResponseWriter, r *http.Request)
-	GetProfileImageMongo(w http.ResponseWriter, r *http.Request)
-	CreateHTLMPageMongo(w http.ResponseWriter, r *http.Request)
-}
-
-type mongodb_struct struct {
-	client *mongo.Client
-}
-
-func (m *mongodb_struct) CreateProfileMongo(w http.ResponseWriter, r *http.Request) {
-	CreateProfileMongo(w, r)
-}
-
-func (m *mongodb_struct) GetAllUsersMongo(w http.ResponseWriter, r *http.Request) {
-	GetAllUsersMongo(w, r)
-}
-
-func (m *mongodb_struct) GetUserProfileMongo(w http.ResponseWriter, r *http.Request) {
-	GetUserProfileMongo(w, r)
-}
-
-func (m *mongodb_struct) UpdateProfileMongo(w http.ResponseWriter, r *http.Request) {
-	UpdateProfileMongo(w, r)
-}
-
-func (m *mongodb_struct) DeleteProfileMongo(w http.ResponseWriter, r *http.Request) {
-	DeleteProfileMongo(w, r)
-}
-
-func (m *mongodb_struct) UploadProfileImageMongo(w http.ResponseWriter, r *http.Request) {
-	UploadProfileImageMongo(w, r)
-}
-
-func (m *mongodb_struct) GetProfileImageMongo(w http.ResponseWriter, r *http.Request) {
-	GetProfileImageMongo(w, r)
-}
-
-func (m *mongodb_struct) CreateHTLMPageMongo(w http.ResponseWriter, r *http.Request) {
-	CreateHTLMPageMongo(w, r)
-}
-
-///////////////////////////
-///// PARTIE SCYLLADB /////
-///////////////////////////
-
-type scyllaDB_Interface interface {
-	CreateProfileScylla(w http.ResponseWriter, r *http.Request)
-	GetAllUsersScylla(w http.ResponseWriter, r *http.Request)
-	GetUserProfileScylla(w http.ResponseWriter, r *http.Request)
-	UpdateProfileScylla(w http.ResponseWriter, r *http.Request)
-	DeleteProfileScylla(w http.ResponseWriter, r *http.Request)
-	UploadProfileImageScylla(w http.ResponseWriter, r *http.Request)
-	GetProfileImageScylla(w http.ResponseWriter, r *http.Request)
-	CreateHTLMPageScylla(w http.ResponseWriter, r *http.Request)
-	DeleteAllDatabaseScylla(w http.ResponseWriter, r *http.Request)
-	getAllUsersTypeScylla(w http.ResponseWriter, r *http.Request)
-}
-
-type scylladb_struct struct {
-	cluster *gocql.ClusterConfig
-	session *gocql.Session
-}
-
-func (s *scylladb_struct) CreateProfileScylla(w http.ResponseWriter, r *http.Request) {
-	CreateProfileScylla(w, r)
-}
-
-func (s *scylladb_struct) GetAllUsersScylla(w http.ResponseWriter, r *http.Request) {
-	GetAllUsersScylla(w, r)
-}
-
-func (s *scylladb_struct) GetUserProfileScylla(w http.ResponseWriter, r *http.Request) {
-	GetUserProfileScylla(w, r)
-}
-
-func (s *scylladb_struct) UpdateProfileScylla(w http.ResponseWriter, r *http.Request) {
-	UpdateProfileScylla(w, r)
-}
-
-func (s *scylladb_struct) DeleteProfileScylla(w http.ResponseWriter, r *http.Request) {
-	DeleteProfileScylla(w, r)
-}
-
-func (s *scylladb_struct) UploadProfileImageScylla(w http.ResponseWriter, r *http.Request) {
-	UploadProfileImageScylla(w, r)
-}
-
-func (s *scylladb_struct) GetProfileImageScylla(w http.ResponseWriter, r *http.Request) {
-	GetProfileImageScylla(w, r)
-}
-
-func (s *scylladb_struct) CreateHTLMPageScylla(w http.ResponseWriter, r *http.Request) {
-	CreateHTLMPageScylla(w, r)
-}
-
-func (s *scylladb_struct) DeleteAllDatabaseScylla(w http.ResponseWriter, r *http.Request) {
-	DeleteAllDatabaseScylla(w, r)
-}
-
-func (s *scylladb_struct) getAllUsersTypeScylla(w http.ResponseWriter, r *http.Request) {
-	getAllUsersTypeScylla(w, r)
-}
-
-/////////////////////////////
-///// PARTIE COCKCROACH /////
-/////////////////////////////
-
-type cockroachDB_Interface interface {
-	CreateProfileCockroach(w http.ResponseWriter, r *http.Request)
-	GetAllUsersCockroach(w http.ResponseWriter, r *http.Request)
-	GetUserProfileCockroach(w http.ResponseWriter, r *http.Request)
-	UpdateProfileCockroach(w http.ResponseWriter, r *http.Request)
-	DeleteProfileCockroach(w http.ResponseWriter, r *http.Request)
-	UploadProfileImageCockroach(w http.ResponseWriter, r *http.Request)
-	GetProfileImageCockroach(w http.ResponseWriter, r *http.Request)
-	CreateHTLMPageCockroach(w http.ResponseWriter, r *http.Request)
-	getAllUsersTypeCockroach(w http.ResponseWriter, r *http.Request)
-	DropTableAndRecreateCockroach(w http.ResponseWriter, r *http.Request)
-}
-
-type cockroachdb_struct struct {
-	db *gorm.DB
-}
-
-func (c *cockroachdb_struct) CreateProfileCockroach(w http.ResponseWriter, r *http.Request) {
-	CreateProfileCockroach(w, r)
-}
-
-func (c *cockroachdb_struct) GetAllUsersCockroach(w http.ResponseWriter, r *http.Request) {
-	GetAllUsersCockroach(w, r)
-}
-
-func (c *cockroachdb_struct) GetUserProfileCockroach(w http.ResponseWriter, r *http.Request) {
-	GetUserProfileCockroach(w, r)
-}
-
-func (c *cockroachdb_struct) UpdateProfileCockroach(w http.ResponseWriter, r *http.Request) {
-	UpdateProfileCockroach(w, r)
-}
-
-func (c *cockroachdb_struct) DeleteProfileCockroach(w http.ResponseWriter, r *http.Request) {
-	DeleteProfileCockroach(w, r)
-}
-
-func (c *cockroachdb_struct) UploadProfileImageCockroach(w http.ResponseWriter, r *http.Request) {
-	UploadProfileImageCockroach(w, r)
-}
-
-func (c *cockroachdb_struct) GetProfileImageCockroach(w http.ResponseWriter, r *http.Request) {
-	GetProfileImageCockroach(w, r)
-}
-
-func (c *cockroachdb_struct) CreateHTLMPageCockroach(w http.ResponseWriter, r *http.Request) {
-	CreateHTMLPageCockroach(w, r)
-}
-
-func (c *cockroachdb_struct) getAllUsersTypeCockroach(w http.ResponseWriter, r *http.Request) {
-	getAllUsersTypeCockroach(w, r)
-}
-
-func (c *cockroachdb_struct) DropTableAndRecreateCockroach(w http.ResponseWriter, r *http.Request) {
-	DropTableAndRecreateCockroach(w, r)
-}
-
 ///////////////////////////
 ////// PARTIE INIT ////////
 ///////////////////////////
 
-func initMongoDB(m mongoDB_Interface) {
+// Les routes sont les mêmes quel que soit le backend, seul le ProfileStore change
+func newRouter(cfg config, store ProfileStore, blobs BlobStore) *mux.Router {
 	route := mux.NewRouter()
 	log.Println("On créer le routeur")
 	s := route.PathPrefix("/api").Subrouter() // on créer un sous-routeur pour les routes de l'api
 
-	log.Println("On créer les routes")
-	s.HandleFunc("/createProfile", m.CreateProfileMongo).Methods("POST")
-	s.HandleFunc("/getAllUsers", m.GetAllUsersMongo).Methods("GET")
-	s.HandleFunc("/getUserProfile", m.GetUserProfileMongo).Methods("POST")
-	s.HandleFunc("/updateProfile", m.UpdateProfileMongo).Methods("PUT")
-	s.HandleFunc("/deleteProfile/{id}", m.DeleteProfileMongo).Methods("DELETE")
-	s.HandleFunc("/uploadProfileImage", m.UploadProfileImageMongo).Methods("POST")
-	s.HandleFunc("/getProfileImage", m.GetProfileImageMongo).Methods("POST")
-	s.HandleFunc("/createHtmlPage", m.CreateHTLMPageMongo).Methods("POST")
-
-	log.Println("On lance le serveur sur le port 8080")
-	log.Fatal(http.ListenAndServe(":8080", s)) // on lance le serveur sur le port 8080
-}
-
-func initScyllaDB(s scyllaDB_Interface) {
-	route := mux.NewRouter()
-	log.Println("On créer le routeur")
-	s2 := route.PathPrefix("/api").Subrouter() // on créer un sous-routeur pour les routes de l'api
+	a := newAPIHandlers(cfg, store, blobs)
+	s.Use(a.AuthMiddleware) // résout le token de session en profil pour toutes les routes
 
 	log.Println("On créer les routes")
-	s2.HandleFunc("/createProfile", s.CreateProfileScylla).Methods("POST")
-	s2.HandleFunc("/getAllUsers", s.GetAllUsersScylla).Methods("GET")
-	s2.HandleFunc("/getUserProfile", s.GetUserProfileScylla).Methods("POST")
-	s2.HandleFunc("/updateProfile", s.UpdateProfileScylla).Methods("PUT")
-	s2.HandleFunc("/deleteProfile/{id}", s.DeleteProfileScylla).Methods("DELETE")
-	s2.HandleFunc("/uploadProfileImage", s.UploadProfileImageScylla).Methods("POST")
-	s2.HandleFunc("/getProfileImage", s.GetProfileImageScylla).Methods("POST")
-	s2.HandleFunc("/createHtmlPage", s.CreateHTLMPageScylla).Methods("POST")
-	s2.HandleFunc("/deleteAllDatabase", s.DeleteAllDatabaseScylla).Methods("DELETE")
-	s2.HandleFunc("/getAllUsersState", s.getAllUsersTypeScylla).Methods("POST")
-
-	log.Println("On lance le serveur sur le port 8080")
-	log.Fatal(http.ListenAndServe(":8080", s2)) // on lance le serveur sur le port 8080
-}
-
-func initCockroachDB(c cockroachDB_Interface) {
-	route := mux.NewRouter()
-	log.Println("On créer le routeur")
-	s3 := route.PathPrefix("/api").Subrouter() // on créer un sous-routeur pour les routes de l'api
-
-	log.Println("On créer les routes")
-	s3.HandleFunc("/createProfile", c.CreateProfileCockroach).Methods("POST")
-	s3.HandleFunc("/getAllUsers", c.GetAllUsersCockroach).Methods("GET")
-	s3.HandleFunc("/getUserProfile", c.GetUserProfileCockroach).Methods("POST")
-	s3.HandleFunc("/updateProfile", c.UpdateProfileCockroach).Methods("PUT")
-	s3.HandleFunc("/deleteProfile", c.DeleteProfileCockroach).Methods("DELETE")
-	s3.HandleFunc("/uploadProfileImage", c.UploadProfileImageCockroach).Methods("POST")
-	s3.HandleFunc("/getProfileImage", c.GetProfileImageCockroach).Methods("POST")
-	s3.HandleFunc("/createHtmlPage", c.CreateHTLMPageCockroach).Methods("POST")
-	s3.HandleFunc("/getAllUsersState", c.getAllUsersTypeCockroach).Methods("POST")
-	s3.HandleFunc("/deleteAllDatabase", c.DropTableAndRecreateCockroach).Methods("DELETE")
-
-	log.Println("On lance le serveur sur le port 8080")
-	log.Fatal(http.ListenAndServe(":8080", s3)) // on lance le serveur sur le port 8080
+	limits := imageLimitsFromConfig(cfg)
+
+	// Spécification OpenAPI, construite à la fin à partir des routes enregistrées
+	docs := &apiDocs{}
+	s.HandleFunc("/openapi.json", docs.ServeSpec).Methods("GET")
+	s.HandleFunc("/docs", docs.ServeUI).Methods("GET")
+	s.HandleFunc("/docs/app.js", docs.ServeScript).Methods("GET")
+
+	// API v2 : une ressource par profil, l'email dans l'url
+	v2 := s.PathPrefix("/v2").Subrouter()
+	v2.HandleFunc("/profiles", authorize(listProfilesPolicy, a.ListProfiles)).Methods("GET")
+	v2.HandleFunc("/profiles", a.CreateProfile).Methods("POST") // seul un admin peut créer un profil modérateur ou admin
+	v2.HandleFunc("/profiles/{email}", authorize(selfOrMinRole(roleModerator), a.GetUserProfile)).Methods("GET")
+	v2.HandleFunc("/profiles/{email}", authorize(selfOrMinRole(roleModerator), a.UpdateProfile)).Methods("PATCH")
+	v2.HandleFunc("/profiles/{email}", authorize(selfOrMinRole(roleAdmin), a.DeleteProfile)).Methods("DELETE")
+	v2.HandleFunc("/profiles/{email}/image", maxUploadSize(limits, authorize(selfOrMinRole(roleModerator), a.UploadProfileImage))).Methods("PUT")
+	v2.HandleFunc("/profiles/{email}/image", a.signedImageOr(selfOrMinRole(roleModerator), a.ServeProfileImage)).Methods("GET", "HEAD")
+	v2.HandleFunc("/profiles/{email}/image", authorize(selfOrMinRole(roleModerator), a.DeleteProfileImage)).Methods("DELETE")
+	v2.HandleFunc("/profiles/{email}/images", authorize(selfOrMinRole(roleModerator), a.ListGalleryImages)).Methods("GET")
+	v2.HandleFunc("/profiles/{email}/images", maxUploadSize(limits, authorize(selfOrMinRole(roleModerator), a.AddGalleryImage))).Methods("POST")
+	v2.HandleFunc("/profiles/{email}/images/order", authorize(selfOrMinRole(roleModerator), a.ReorderGalleryImages)).Methods("PUT")
+	v2.HandleFunc("/profiles/{email}/images/{id}", a.signedImageOr(selfOrMinRole(roleModerator), a.ServeGalleryImage)).Methods("GET", "HEAD")
+	v2.HandleFunc("/profiles/{email}/images/{id}", authorize(selfOrMinRole(roleModerator), a.UpdateGalleryImage)).Methods("PATCH")
+	v2.HandleFunc("/profiles/{email}/images/{id}", authorize(selfOrMinRole(roleModerator), a.DeleteGalleryImage)).Methods("DELETE")
+
+	// Routes publiques
+	s.HandleFunc("/login", a.Login).Methods("POST")
+	s.HandleFunc("/requestPasswordReset", a.RequestPasswordReset).Methods("POST")
+	s.HandleFunc("/resetPassword", a.ResetPassword).Methods("POST")
+
+	// Routes protégées : user (1) < moderator (2) < admin (3)
+	s.HandleFunc("/me", requireAuth(a.Me)).Methods("GET")
+	s.HandleFunc("/changePassword", requireAuth(a.ChangePassword)).Methods("POST")
+	s.HandleFunc("/profiles/export", authorize(listProfilesPolicy, a.ExportProfiles)).Methods("GET")
+	s.HandleFunc("/profiles/import", authorize(minRole(roleAdmin), a.ImportProfiles)).Methods("POST")
+	s.HandleFunc("/deleteAllDatabase", authorize(minRole(roleAdmin), a.DeleteAllDatabase)).Methods("DELETE")
+
+	// Anciennes routes, dépréciées : headers Deprecation et Link vers la route v2 qui les remplace.
+	// Pour les envois d'image, deprecated passe après maxUploadSize car il peut lire le formulaire.
+	s.HandleFunc("/createProfile", deprecated("/api/v2/profiles", a.CreateProfile)).Methods("POST")
+	s.HandleFunc("/getAllUsers", deprecated("/api/v2/profiles", authorize(minRole(roleAdmin), a.GetAllUsers))).Methods("GET")
+	s.HandleFunc("/getAllUsersState", deprecated("/api/v2/profiles", authorize(minRole(roleModerator), a.GetAllUsersType))).Methods("POST")
+	s.HandleFunc("/getUserProfile", deprecated("/api/v2/profiles/{email}", authorize(selfOrMinRole(roleModerator), a.GetUserProfile))).Methods("POST")
+	s.HandleFunc("/updateProfile", deprecated("/api/v2/profiles/{email}", authorize(selfOrMinRole(roleModerator), a.UpdateProfile))).Methods("PUT")
+	s.HandleFunc("/deleteProfile", deprecated("/api/v2/profiles/{email}", authorize(selfOrMinRole(roleAdmin), a.DeleteProfile))).Methods("DELETE")
+	s.HandleFunc("/deleteProfile/{email}", deprecated("/api/v2/profiles/{email}", authorize(selfOrMinRole(roleAdmin), a.DeleteProfile))).Methods("DELETE")
+	s.HandleFunc("/uploadProfileImage", maxUploadSize(limits, deprecated("/api/v2/profiles/{email}/image", authorize(selfOrMinRole(roleModerator), a.UploadProfileImage)))).Methods("POST")
+	s.HandleFunc("/getProfileImage", deprecated("/api/v2/profiles/{email}/image", authorize(selfOrMinRole(roleModerator), a.GetProfileImage))).Methods("POST")
+	s.HandleFunc("/profiles/{email}/image", deprecated("/api/v2/profiles/{email}/image", a.signedImageOr(selfOrMinRole(roleModerator), a.ServeProfileImage))).Methods("GET", "HEAD")
+	s.HandleFunc("/profiles/{email}/images", deprecated("/api/v2/profiles/{email}/images", authorize(selfOrMinRole(roleModerator), a.ListGalleryImages))).Methods("GET")
+	s.HandleFunc("/profiles/{email}/images", maxUploadSize(limits, deprecated("/api/v2/profiles/{email}/images", authorize(selfOrMinRole(roleModerator), a.AddGalleryImage)))).Methods("POST")
+	s.HandleFunc("/profiles/{email}/images/order", deprecated("/api/v2/profiles/{email}/images/order", authorize(selfOrMinRole(roleModerator), a.ReorderGalleryImages))).Methods("PUT")
+	s.HandleFunc("/profiles/{email}/images/{id}", deprecated("/api/v2/profiles/{email}/images/{id}", a.signedImageOr(selfOrMinRole(roleModerator), a.ServeGalleryImage))).Methods("GET", "HEAD")
+	s.HandleFunc("/profiles/{email}/images/{id}", deprecated("/api/v2/profiles/{email}/images/{id}", authorize(selfOrMinRole(roleModerator), a.UpdateGalleryImage))).Methods("PATCH")
+	s.HandleFunc("/profiles/{email}/images/{id}", deprecated("/api/v2/profiles/{email}/images/{id}", authorize(selfOrMinRole(roleModerator), a.DeleteGalleryImage))).Methods("DELETE")
+	s.HandleFunc("/createHtmlPage", deprecated("/profiles/{email}", authorize(selfOrMinRole(roleModerator), a.CreateHTMLPage))).Methods("POST")
+
+	// Pages HTML publiques des profils actifs, hors de /api : les images y sont liées avec un lien signé
+	route.HandleFunc("/profiles/{email}", a.ProfilePage).Methods("GET", "HEAD")
+
+	// Toute nouvelle route doit avoir son entrée dans apiOperations (openapi.go)
+	docs.build(route)
+	return route
+}
+
+func initServer(cfg config, store ProfileStore, blobs BlobStore) {
+	route := newRouter(cfg, store, blobs)
+
+	log.Println("On lance le serveur sur", cfg.ListenAddr)
+	log.Fatal(http.ListenAndServe(cfg.ListenAddr, route)) // on lance le serveur, par défaut sur le port 8080
 }
 
 ////////////////
@@ -255,11 +101,51 @@ func initCockroachDB(c cockroachDB_Interface) {
 
 func main() {
 
-	//var scylladb_interface scyllaDB_Interface = &scylladb_struct{}
-	//var mongodb_interface mongoDB_Interface = &mongodb_struct{}
-	var cockroachdb_interface cockroachDB_Interface = &cockroachdb_struct{}
-
-	//initMongoDB(mongodb_interface)
-	initCockroachDB(cockroachdb_interface)
-	//initScyllaDB(scylladb_interface)
+	// Sous-commandes : "conformance" lance la suite de conformité, "restore" recharge une sauvegarde,
+	// "gc" supprime les images qui ne sont plus référencées, "export" écrit le site statique des profils,
+	// "openapi" écrit la spécification de l'API, "import" importe un fichier de profils CSV ou NDJSON,
+	// "migrate-avatars" reprend dans les galeries les images envoyées avant elles
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "conformance":
+			os.Exit(runConformance(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		case "gc":
+			os.Exit(runGC(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "openapi":
+			os.Exit(runOpenAPI(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "migrate-avatars":
+			os.Exit(runMigrateAvatars(os.Args[2:]))
+		}
+	}
+
+	// Le backend est choisi au lancement : --backend=mongo|scylla|cockroach|memory ou la variable BACKEND
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Backend utilisé :", cfg.Backend)
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatal("ERREUR : ", err)
+	}
+
+	// Les données des images sont stockées à part des profils : --blob-store=fs|s3
+	blobs, err := openBlobStore(cfg)
+	if err != nil {
+		log.Fatal("ERREUR : ", err)
+	}
+
+	err = ensureAdminProfile(context.Background(), store, cfg)
+	if err != nil {
+		log.Fatal("ERREUR : impossible de créer le compte administrateur : ", err)
+	}
+
+	initServer(cfg, store, blobs)
 }
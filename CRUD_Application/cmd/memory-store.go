@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Implémentation de ProfileStore en mémoire, sans base de données.
+// Utile en local et pour les tests : tout est perdu à l'arrêt du serveur.
+type memoryStore struct {
+	mu       sync.RWMutex
+	profiles map[string]Profile        // profils indexés par email
+	images   map[string]ProfileImage   // références des images indexées par email
+	gallery  map[string][]GalleryImage // galeries indexées par email, triées par position
+	resets   map[string]PasswordReset  // demandes de réinitialisation indexées par hash du token
+	blobRefs map[string]BlobRef        // compteurs de références des images indexés par clé
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		profiles: make(map[string]Profile),
+		images:   make(map[string]ProfileImage),
+		gallery:  make(map[string][]GalleryImage),
+		resets:   make(map[string]PasswordReset),
+		blobRefs: make(map[string]BlobRef),
+	}
+}
+
+func (m *memoryStore) CreateProfile(ctx context.Context, profile Profile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.profiles[profile.Email]; ok {
+		return ErrEmailAlreadyUsed
+	}
+	m.profiles[profile.Email] = profile
+	return nil
+}
+
+func (m *memoryStore) CreateProfiles(ctx context.Context, profiles []Profile) (int, error) {
+	for i, profile := range profiles {
+		err := m.CreateProfile(ctx, profile)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(profiles), nil
+}
+
+func (m *memoryStore) GetProfile(ctx context.Context, email string) (Profile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	profile, ok := m.profiles[email]
+	if !ok {
+		return Profile{}, ErrProfileNotFound
+	}
+	return profile, nil
+}
+
+func (m *memoryStore) ListProfiles(ctx context.Context) ([]Profile, error) {
+	return m.filter(func(Profile) bool { return true }), nil
+}
+
+func (m *memoryStore) ListProfilesByType(ctx context.Context, userType int) ([]Profile, error) {
+	return m.filter(func(p Profile) bool { return p.UserType == userType }), nil
+}
+
+// La mémoire trie tous les profils filtrés puis reprend après la clé du curseur, comme le ferait un index
+func (m *memoryStore) ListProfilesPage(ctx context.Context, query ProfileQuery) (ProfilePage, error) {
+	page := ProfilePage{Profiles: []Profile{}}
+	for _, profile := range m.sortedProfiles(query) {
+		if query.After != nil && !profileKeyLess(Profile{Email: query.After.Email, CreatedAt: createdAtTime(query.After.CreatedAt)}, profile, query) {
+			continue
+		}
+		if len(page.Profiles) == query.Limit {
+			page.Next = cursorOf(page.Profiles[len(page.Profiles)-1])
+			break
+		}
+		profile.Password = ""
+		page.Profiles = append(page.Profiles, profile)
+	}
+	return page, nil
+}
+
+// Les profils sont déjà en mémoire : le flux parcourt une copie triée
+func (m *memoryStore) StreamProfiles(ctx context.Context, query ProfileQuery, fn func(Profile) error) error {
+	for _, profile := range m.sortedProfiles(query) {
+		profile.Password = ""
+		err := fn(profile)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) sortedProfiles(query ProfileQuery) []Profile {
+	profiles := m.filter(query.matches)
+	sort.Slice(profiles, func(i, j int) bool { return profileKeyLess(profiles[i], profiles[j], query) })
+	return profiles
+}
+
+// profileKeyLess compare deux profils dans l'ordre de la requête : (date de création, email) ou email
+func profileKeyLess(a, b Profile, query ProfileQuery) bool {
+	less := a.Email < b.Email
+	if ka, kb := createdAtNanos(a.CreatedAt), createdAtNanos(b.CreatedAt); query.Sort == sortByCreated && ka != kb {
+		less = ka < kb
+	}
+	if query.Descending {
+		return !less && a.Email != b.Email
+	}
+	return less
+}
+
+func (m *memoryStore) CountProfiles(ctx context.Context) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.profiles), nil
+}
+
+func (m *memoryStore) UpdateProfileState(ctx context.Context, email string, state bool) (Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	profile, ok := m.profiles[email]
+	if !ok {
+		return Profile{}, ErrProfileNotFound
+	}
+	profile.State = state
+	m.profiles[email] = profile
+	return profile, nil
+}
+
+func (m *memoryStore) UpdateProfilePassword(ctx context.Context, email string, passwordHash string, changedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	profile, ok := m.profiles[email]
+	if !ok {
+		return ErrProfileNotFound
+	}
+	profile.Password = passwordHash
+	if !changedAt.IsZero() {
+		profile.PasswordChangedAt = changedAt
+		m.deletePasswordResets(email)
+	}
+	m.profiles[email] = profile
+	return nil
+}
+
+func (m *memoryStore) DeleteProfile(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.profiles[email]; !ok {
+		return ErrProfileNotFound
+	}
+	delete(m.profiles, email)
+	delete(m.images, email)
+	delete(m.gallery, email)
+	m.deletePasswordResets(email)
+	return nil
+}
+
+// deletePasswordResets supprime les demandes de réinitialisation en cours du profil, m.mu doit être verrouillé
+func (m *memoryStore) deletePasswordResets(email string) {
+	for tokenHash, reset := range m.resets {
+		if reset.Email == email {
+			delete(m.resets, tokenHash)
+		}
+	}
+}
+
+func (m *memoryStore) DeleteAllProfiles(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.profiles = make(map[string]Profile)
+	m.images = make(map[string]ProfileImage)
+	m.gallery = make(map[string][]GalleryImage)
+	m.resets = make(map[string]PasswordReset)
+	m.blobRefs = make(map[string]BlobRef)
+	return nil
+}
+
+func (m *memoryStore) PutProfileImage(ctx context.Context, email string, image ProfileImage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.profiles[email]; !ok {
+		return ErrProfileNotFound
+	}
+	if image.Key == "" && len(image.Data) == 0 {
+		delete(m.images, email)
+		return nil
+	}
+	// On copie la map pour que l'appelant ne puisse pas modifier la référence stockée
+	image.Variants = copyVariantKeys(image.Variants)
+	m.images[email] = image
+	return nil
+}
+
+func (m *memoryStore) GetProfileImage(ctx context.Context, email string) (ProfileImage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.profiles[email]; !ok {
+		return ProfileImage{}, ErrProfileNotFound
+	}
+	image, ok := m.images[email]
+	if !ok {
+		return ProfileImage{}, ErrImageNotFound
+	}
+	image.Variants = copyVariantKeys(image.Variants)
+	return image, nil
+}
+
+func (m *memoryStore) ListGalleryImages(ctx context.Context, email string) ([]GalleryImage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.profiles[email]; !ok {
+		return nil, ErrProfileNotFound
+	}
+	images := make([]GalleryImage, 0, len(m.gallery[email]))
+	for _, image := range m.gallery[email] {
+		image.Image.Variants = copyVariantKeys(image.Image.Variants)
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func (m *memoryStore) AddGalleryImage(ctx context.Context, email string, image GalleryImage, maxImages int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.profiles[email]; !ok {
+		return ErrProfileNotFound
+	}
+	if maxImages > 0 && len(m.gallery[email]) >= maxImages {
+		return ErrGalleryFull
+	}
+	image.Image.Variants = copyVariantKeys(image.Image.Variants)
+	m.gallery[email] = sortGallery(append(m.gallery[email], image))
+	return nil
+}
+
+func (m *memoryStore) UpdateGalleryImage(ctx context.Context, email string, image GalleryImage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.profiles[email]; !ok {
+		return ErrProfileNotFound
+	}
+	images := m.gallery[email]
+	for i := range images {
+		if images[i].ID == image.ID {
+			images[i].Caption = image.Caption
+			images[i].Position = image.Position
+			m.gallery[email] = sortGallery(images)
+			return nil
+		}
+	}
+	return ErrImageNotFound
+}
+
+func (m *memoryStore) DeleteGalleryImage(ctx context.Context, email string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.profiles[email]; !ok {
+		return ErrProfileNotFound
+	}
+	images := m.gallery[email]
+	for i := range images {
+		if images[i].ID == id {
+			m.gallery[email] = append(images[:i:i], images[i+1:]...)
+			return nil
+		}
+	}
+	return ErrImageNotFound
+}
+
+func (m *memoryStore) AcquireBlob(ctx context.Context, key string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ref := m.blobRefs[key]
+	m.blobRefs[key] = BlobRef{Key: key, Count: ref.Count + 1, UpdatedAt: now}
+	return nil
+}
+
+func (m *memoryStore) ReleaseBlob(ctx context.Context, key string, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ref, ok := m.blobRefs[key]
+	if !ok || ref.Count <= 0 {
+		return 0, nil
+	}
+	ref.Count--
+	if ref.Count == 0 {
+		ref.UpdatedAt = now
+	}
+	m.blobRefs[key] = ref
+	return ref.Count, nil
+}
+
+func (m *memoryStore) ListBlobRefs(ctx context.Context) ([]BlobRef, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	refs := make([]BlobRef, 0, len(m.blobRefs))
+	for _, ref := range m.blobRefs {
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func (m *memoryStore) SetBlobRef(ctx context.Context, ref BlobRef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ref.Count <= 0 {
+		delete(m.blobRefs, ref.Key)
+		return nil
+	}
+	m.blobRefs[ref.Key] = ref
+	return nil
+}
+
+func (m *memoryStore) CreatePasswordReset(ctx context.Context, reset PasswordReset) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.resets[reset.TokenHash] = reset
+	return nil
+}
+
+func (m *memoryStore) ConsumePasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reset, ok := m.resets[tokenHash]
+	if !ok {
+		return PasswordReset{}, ErrResetNotFound
+	}
+	delete(m.resets, tokenHash)
+	return reset, nil
+}
+
+// filter renvoie les profils qui respectent keep, triés par email pour avoir un ordre stable
+func (m *memoryStore) filter(keep func(Profile) bool) []Profile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var profiles []Profile
+	for _, profile := range m.profiles {
+		if keep(profile) {
+			profiles = append(profiles, profile)
+		}
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Email < profiles[j].Email })
+	return profiles
+}
+
+// sortGallery trie une galerie par position, puis par identifiant pour un ordre stable
+func sortGallery(images []GalleryImage) []GalleryImage {
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Position != images[j].Position {
+			return images[i].Position < images[j].Position
+		}
+		return images[i].ID < images[j].ID
+	})
+	return images
+}
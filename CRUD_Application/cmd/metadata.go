@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"sort"
+)
+
+// Métadonnées retirées des images envoyées, renvoyées dans la réponse de l'envoi
+const (
+	metadataEXIF    = "exif"
+	metadataGPS     = "gps" // coordonnées GPS présentes dans le bloc EXIF
+	metadataXMP     = "xmp"
+	metadataICC     = "icc"
+	metadataIPTC    = "iptc"
+	metadataComment = "comment"
+	metadataText    = "text" // chunks tEXt / zTXt / iTXt des PNG
+	metadataTime    = "time"
+	// données après la fin de l'image : images secondaires MPF (avec leur propre EXIF), contenu ajouté...
+	metadataTrailing = "trailing"
+)
+
+// Compte rendu du nettoyage d'une image
+type metadataReport struct {
+	Removed            []string `json:"removed"`                      // types de métadonnées supprimées
+	OrientationApplied int      `json:"orientationApplied,omitempty"` // tag EXIF Orientation appliqué aux pixels (2 à 8)
+	KeptColorProfile   bool     `json:"keptColorProfile,omitempty"`   // profil ICC conservé (--keep-icc-profile)
+	ConvertedFrom      string   `json:"convertedFrom,omitempty"`      // format envoyé quand l'image est stockée dans un autre (GIF)
+}
+
+var errMalformedImage = errors.New("structure d'image invalide")
+
+// stripMetadata retire les blocs EXIF, XMP, ICC (sauf keepICC), IPTC et les commentaires d'une image validée.
+// Si l'image a un tag EXIF Orientation, la rotation est appliquée aux pixels et l'image est réencodée ;
+// sinon les blocs sont retirés sans toucher aux données compressées. Renvoie aussi l'image décodée redressée.
+func stripMetadata(data []byte, info imageInfo, keepICC bool) ([]byte, image.Image, metadataReport, error) {
+	var stripped []byte
+	var found metadataFound
+	var err error
+	switch info.Format.Name {
+	case "jpeg":
+		stripped, found, err = stripJPEG(data, keepICC)
+	case "png":
+		stripped, found, err = stripPNG(data, keepICC)
+	default:
+		return data, info.Image, metadataReport{Removed: []string{}}, nil
+	}
+	if err != nil {
+		return nil, nil, metadataReport{}, err
+	}
+
+	report := metadataReport{Removed: found.removedList(), KeptColorProfile: keepICC && len(found.icc) > 0}
+	if found.orientation <= 1 || found.orientation > 8 {
+		return stripped, info.Image, report, nil
+	}
+
+	// Les décodeurs Go ignorent l'orientation EXIF : sans cette étape la photo s'afficherait couchée
+	img := applyOrientation(info.Image, found.orientation)
+	report.OrientationApplied = found.orientation
+
+	var buf bytes.Buffer
+	switch info.Format.Name {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 92})
+		if err == nil && keepICC {
+			return insertJPEGSegments(buf.Bytes(), found.icc), img, report, nil
+		}
+	default:
+		err = png.Encode(&buf, img)
+		if err == nil && keepICC {
+			return insertPNGChunks(buf.Bytes(), found.icc), img, report, nil
+		}
+	}
+	return buf.Bytes(), img, report, err
+}
+
+// Ce qui a été trouvé en parcourant les blocs de l'image
+type metadataFound struct {
+	removed     map[string]bool
+	orientation int
+	icc         [][]byte // segments ou chunks ICC bruts, pour les remettre avec --keep-icc-profile
+}
+
+func (f *metadataFound) add(kind string) {
+	if f.removed == nil {
+		f.removed = make(map[string]bool)
+	}
+	f.removed[kind] = true
+}
+
+func (f *metadataFound) removedList() []string {
+	list := []string{}
+	for kind := range f.removed {
+		list = append(list, kind)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// readEXIF lit le tag Orientation et repère les coordonnées GPS dans un bloc EXIF (format TIFF)
+func (f *metadataFound) readEXIF(tiff []byte) {
+	f.add(metadataEXIF)
+	if len(tiff) < 8 {
+		return
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return
+		}
+		switch order.Uint16(tiff[entry:]) {
+		case 0x0112: // Orientation, SHORT
+			f.orientation = int(order.Uint16(tiff[entry+8:]))
+		case 0x8825: // pointeur vers le bloc GPS
+			f.add(metadataGPS)
+		}
+	}
+}
+
+// stripJPEG retire les segments APPn de métadonnées et les commentaires. JFIF (APP0) et Adobe (APP14)
+// sont gardés car ils décrivent l'espace de couleur des données compressées.
+// Tout ce qui suit le marqueur de fin (EOI) est retiré : les images secondaires MPF des appareils photo
+// y sont rangées avec leur propre bloc EXIF, coordonnées GPS comprises.
+func stripJPEG(data []byte, keepICC bool) ([]byte, metadataFound, error) {
+	var found metadataFound
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, found, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	pos := 2
+	for pos+2 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, found, errMalformedImage
+		}
+		marker := data[pos+1]
+		if marker == 0xFF { // octet de remplissage
+			pos++
+			continue
+		}
+		if marker == 0xD9 { // fin de l'image
+			out.Write(data[pos : pos+2])
+			if pos+2 < len(data) {
+				found.add(metadataTrailing)
+			}
+			return out.Bytes(), found, nil
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) { // marqueurs sans longueur
+			out.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return nil, found, errMalformedImage
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, found, errMalformedImage
+		}
+		if marker == 0xDA { // début d'un scan : l'en-tête puis les données compressées, copiées telles quelles
+			scanEnd := jpegScanEnd(data, end)
+			out.Write(data[pos:scanEnd])
+			pos = scanEnd
+			continue
+		}
+		segment := data[pos:end]
+		payload := data[pos+4 : end]
+
+		keep := true
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			found.readEXIF(payload[6:])
+			keep = false
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xap/1.0/")):
+			found.add(metadataXMP)
+			keep = false
+		case marker == 0xE1: // autres APP1 (XMP étendu...)
+			found.add(metadataXMP)
+			keep = false
+		case marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			found.icc = append(found.icc, segment)
+			keep = keepICC
+			if !keepICC {
+				found.add(metadataICC)
+			}
+		case marker == 0xED:
+			found.add(metadataIPTC)
+			keep = false
+		case marker == 0xFE:
+			found.add(metadataComment)
+			keep = false
+		case marker >= 0xE1 && marker <= 0xEF && marker != 0xEE:
+			found.add(metadataEXIF) // segments propriétaires des appareils photo
+			keep = false
+		}
+		if keep {
+			out.Write(segment)
+		}
+		pos = end
+	}
+	return nil, found, errMalformedImage
+}
+
+// jpegScanEnd renvoie la position du marqueur qui suit les données compressées commençant à start
+// (un autre scan, une table, ou la fin de l'image), ou la fin des données si l'image est tronquée.
+// Dans les données compressées, 0xFF est suivi de 0x00 (octet échappé) ou d'un marqueur RSTn.
+func jpegScanEnd(data []byte, start int) int {
+	for i := start; i+1 < len(data); i++ {
+		if data[i] != 0xFF {
+			continue
+		}
+		next := data[i+1]
+		if next == 0x00 || next == 0xFF || (next >= 0xD0 && next <= 0xD7) {
+			continue
+		}
+		return i
+	}
+	return len(data)
+}
+
+// insertJPEGSegments remet des segments juste après le marqueur SOI
+func insertJPEGSegments(data []byte, segments [][]byte) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	for _, segment := range segments {
+		out.Write(segment)
+	}
+	out.Write(data[2:])
+	return out.Bytes()
+}
+
+// stripPNG retire les chunks de métadonnées (eXIf, iCCP, tEXt, zTXt, iTXt, tIME).
+// Les chunks qui changent le rendu (gAMA, cHRM, sRGB, tRNS...) sont gardés.
+func stripPNG(data []byte, keepICC bool) ([]byte, metadataFound, error) {
+	var found metadataFound
+	if len(data) < 8 {
+		return nil, found, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:8])
+	pos := 8
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, found, errMalformedImage
+		}
+		kind := string(data[pos+4 : pos+8])
+		body := data[pos+8 : pos+8+length]
+		chunk := data[pos:end]
+
+		keep := true
+		switch kind {
+		case "eXIf":
+			found.readEXIF(body)
+			keep = false
+		case "iCCP":
+			found.icc = append(found.icc, chunk)
+			keep = keepICC
+			if !keepICC {
+				found.add(metadataICC)
+			}
+		case "iTXt":
+			if bytes.HasPrefix(body, []byte("XML:com.adobe.xmp\x00")) {
+				found.add(metadataXMP)
+			} else {
+				found.add(metadataText)
+			}
+			keep = false
+		case "tEXt", "zTXt":
+			found.add(metadataText)
+			keep = false
+		case "tIME":
+			found.add(metadataTime)
+			keep = false
+		}
+		if keep {
+			out.Write(chunk)
+		}
+		pos = end
+		if kind == "IEND" {
+			return out.Bytes(), found, nil
+		}
+	}
+	return nil, found, errMalformedImage
+}
+
+// insertPNGChunks remet des chunks juste après IHDR (iCCP doit précéder PLTE et IDAT)
+func insertPNGChunks(data []byte, chunks [][]byte) []byte {
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(data[8:]))
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:ihdrEnd])
+	for _, chunk := range chunks {
+		// On vérifie le CRC : un chunk abîmé ferait refuser toute l'image par les navigateurs
+		length := int(binary.BigEndian.Uint32(chunk))
+		if binary.BigEndian.Uint32(chunk[8+length:]) == crc32.ChecksumIEEE(chunk[4:8+length]) {
+			out.Write(chunk)
+		}
+	}
+	out.Write(data[ihdrEnd:])
+	return out.Bytes()
+}
+
+// applyOrientation applique aux pixels une valeur du tag EXIF Orientation (1 à 8)
+func applyOrientation(img image.Image, orientation int) image.Image {
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	// Les orientations 5 à 8 échangent largeur et hauteur
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // miroir horizontal
+				sx, sy = w-1-x, y
+			case 3: // rotation 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // miroir vertical
+				sx, sy = x, h-1-y
+			case 5: // transposition
+				sx, sy = y, x
+			case 6: // rotation 90° horaire
+				sx, sy = y, h-1-x
+			case 7: // transversale
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotation 90° anti-horaire
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// Position GPS recherchée dans l'image nettoyée
+const testGPSSentinel = "GPS 48.8566N 2.3522E"
+
+// jpegSegment construit un segment marqueur + longueur + contenu
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// exifWithGPS construit un bloc APP1 EXIF dont l'IFD pointe vers un bloc GPS
+func exifWithGPS() []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = append(tiff, 0, 1)                                      // une entrée
+	tiff = append(tiff, 0x88, 0x25, 0, 4, 0, 0, 0, 1, 0, 0, 0, 26) // pointeur GPS, LONG
+	tiff = append(tiff, 0, 0, 0, 0)                                // pas d'IFD suivant
+	tiff = append(tiff, testGPSSentinel...)
+	return jpegSegment(0xE1, append([]byte("Exif\x00\x00"), tiff...))
+}
+
+func testJPEG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	img.Set(3, 3, color.White)
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Un JPEG d'appareil photo : EXIF et MPF dans l'image principale, puis une image secondaire
+// après EOI avec son propre EXIF
+func TestStripJPEGRemovesTrailingImages(t *testing.T) {
+	encoded := testJPEG(t)
+
+	var data []byte
+	data = append(data, encoded[:2]...)
+	data = append(data, exifWithGPS()...)
+	data = append(data, jpegSegment(0xE2, []byte("MPF\x00MM\x00\x2a"))...)
+	data = append(data, encoded[2:]...)
+	data = append(data, encoded[:2]...)
+	data = append(data, exifWithGPS()...)
+	data = append(data, encoded[2:]...)
+
+	stripped, found, err := stripJPEG(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stripped, []byte(testGPSSentinel)) {
+		t.Error("les coordonnées GPS sont restées dans l'image")
+	}
+	if bytes.Contains(stripped, []byte{0xFF, 0xE1}) || bytes.Contains(stripped, []byte("Exif\x00\x00")) {
+		t.Error("un segment APP1 est resté dans l'image")
+	}
+	if bytes.Contains(stripped, []byte("MPF\x00")) {
+		t.Error("le segment MPF est resté dans l'image")
+	}
+	if !bytes.HasSuffix(stripped, []byte{0xFF, 0xD9}) || bytes.Count(stripped, []byte{0xFF, 0xD8}) != 1 {
+		t.Error("l'image nettoyée doit s'arrêter au premier EOI")
+	}
+	for _, kind := range []string{metadataEXIF, metadataGPS, metadataTrailing} {
+		if !found.removed[kind] {
+			t.Errorf("%s absent du compte rendu %v", kind, found.removedList())
+		}
+	}
+
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Error("image nettoyée illisible :", err)
+	}
+}
+
+// Sans données après EOI, seuls les segments de métadonnées sont retirés
+func TestStripJPEGKeepsScanData(t *testing.T) {
+	encoded := testJPEG(t)
+	data := append(append(append([]byte{}, encoded[:2]...), exifWithGPS()...), encoded[2:]...)
+
+	stripped, found, err := stripJPEG(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, encoded) {
+		t.Error("l'image nettoyée doit être l'image d'origine sans le bloc EXIF")
+	}
+	if found.removed[metadataTrailing] {
+		t.Error("trailing signalé sans données après EOI")
+	}
+}
@@ -2,406 +2,582 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"os"
-	"path"
-	"path/filepath"
-
-	"github.com/gorilla/mux"
+	"errors"
+	"strconv"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Struct des userMongo
 type userMongo struct {
-	Email    string           `json:"email"`
-	Password string           `json:"password"`
-	Picture  ImageBinaryMongo `json:"picture"`
-	State    bool             `json:"state"`
-	UserType int              `json:"userType"`
+	Email    string              `json:"email"`
+	Password string              `json:"password"`
+	Picture  ImageBinaryMongo    `json:"picture"`
+	Gallery  []GalleryImageMongo `json:"gallery" bson:"gallery,omitempty"` // omis à la création : $push refuse un champ null
+	State    bool                `json:"state"`
+	UserType int                 `json:"userType"`
+	// Date de création en nanosecondes Unix, 0 pour les profils d'avant (voir migrate)
+	CreatedAt int64 `json:"createdAt" bson:"createdat"`
+	// Dernier changement du mot de passe en nanosecondes Unix, absent si le mot de passe n'a jamais changé
+	PasswordChangedAt int64 `json:"-" bson:"passwordchangedat,omitempty"`
 }
 
-// Définition d'un nouveau type pour représenter l'image sous forme de données binaires
+// Référence vers l'image du profil, les données sont dans le BlobStore
 type ImageBinaryMongo struct {
-	Data      []byte           `bson:"data"`      // les données binaires de l'image
-	Type      primitive.Binary `bson:"type"`      // le type de données de l'image
-	Extension string           `bson:"extension"` // l'extension de l'image
+	Key         string            `bson:"key"`                 // clé de l'original dans le BlobStore
+	Extension   string            `bson:"extension"`           // l'extension de l'image
+	UpdatedAt   time.Time         `bson:"updatedat"`           // date de l'envoi
+	VariantKeys map[string]string `bson:"variantkeys"`         // clés des versions réduites de l'image
+	Data        []byte            `bson:"data,omitempty"`      // données des images envoyées avant le BlobStore
+	GalleryID   string            `bson:"galleryid,omitempty"` // image de la galerie choisie comme avatar
 }
 
-var userCollectionMongo = db_mongodb().Database("goDatabaseCrud").Collection("users")
+// Image de la galerie, rangée dans le tableau "gallery" du document de l'utilisateur
+type GalleryImageMongo struct {
+	ID       string           `bson:"id"`
+	Caption  string           `bson:"caption"`
+	Position int              `bson:"position"`
+	Picture  ImageBinaryMongo `bson:"picture"`
+}
 
-// Création d'un utilisateur
+// Demande de réinitialisation de mot de passe stockée dans la collection "password_resets"
+type passwordResetMongo struct {
+	TokenHash string
+	Email     string
+	ExpiresAt time.Time
+}
 
-func CreateProfileMongo(w http.ResponseWriter, r *http.Request) {
+// Compteur de références d'une image stocké dans la collection "image_refs", la clé sert d'_id
+type blobRefMongo struct {
+	Key       string    `bson:"_id"`
+	Count     int       `bson:"count"`
+	UpdatedAt time.Time `bson:"updatedat"`
+}
 
-	w.Header().Set("Content-Type", "application/json") // on définit le type de contenu de la réponse
+// Implémentation de ProfileStore pour MongoDB
+type mongoStore struct {
+	users    *mongo.Collection
+	resets   *mongo.Collection
+	blobRefs *mongo.Collection
+}
 
-	var person userMongo
-	err := json.NewDecoder(r.Body).Decode(&person) // On stocke le body de la requête dans la variable person
-	if err != nil {
-		fmt.Println(err)
-	}
+func newMongoStore(users, resets, blobRefs *mongo.Collection) *mongoStore {
+	return &mongoStore{users: users, resets: resets, blobRefs: blobRefs}
+}
 
-	// On vérifie si l'email est déjà utilisé
-	var result primitive.M                                                                                         // une représentation non ordonnée d'un document BSON qui est une Map
-	err = userCollectionMongo.FindOne(context.TODO(), bson.D{{Key: "email", Value: person.Email}}).Decode(&result) // on cherche un document avec l'email donné
-	if err == nil {                                                                                                // si on trouve un document, on renvoie une erreur
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email déjà utilisé"}`))
-		return
+func (u userMongo) toProfile() Profile {
+	return Profile{
+		Email:             u.Email,
+		Password:          u.Password,
+		State:             u.State,
+		UserType:          u.UserType,
+		CreatedAt:         createdAtTime(u.CreatedAt),
+		PasswordChangedAt: createdAtTime(u.PasswordChangedAt),
 	}
+}
 
-	// On hash le mot de passe avec bcrypt et les fonctions en bas
-	hash, _ := hashPasswordMongo(person.Password)
-	person.Password = hash
-
-	// Vérification de l'usertype si autre que prévu, on le met à 1 par défaut (userMongo)
-	if person.UserType != 1 && person.UserType != 2 && person.UserType != 3 {
-		person.UserType = 1
+// migrate donne une date de création nulle aux profils qui n'en ont pas, pour qu'ils soient comparables
+// dans les requêtes de pagination, et crée les index des tris et celui d'expiration des réinitialisations.
+// L'index unique sur email garantit qu'un email n'est utilisé qu'une fois, même avec des créations simultanées.
+func (m *mongoStore) migrate(ctx context.Context) error {
+	_, err := m.users.UpdateMany(ctx, bson.D{{Key: "createdat", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "createdat", Value: int64(0)}}}})
+	if err != nil {
+		return err
 	}
-
-	insertResult, err := userCollectionMongo.InsertOne(context.Background(), person)
+	_, err = m.users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "createdat", Value: 1}, {Key: "email", Value: 1}}},
+	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	fmt.Println("Création du profile : ", insertResult)
-	json.NewEncoder(w).Encode(insertResult.InsertedID) // on renvoie l'id du document créé (on peut envoyé autre chose si besoin)
-
+	// Index TTL : MongoDB supprime lui-même les demandes de réinitialisation expirées
+	_, err = m.resets.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresat", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
 }
 
-func CreateHTLMPageMongo(w http.ResponseWriter, r *http.Request) {
+// Création d'un utilisateur
 
-	w.Header().Set("Content-Type", "application/json")
+func (m *mongoStore) CreateProfile(ctx context.Context, profile Profile) error {
 
-	var body userMongo
-	err := json.NewDecoder(r.Body).Decode(&body)
-	if err != nil {
-		fmt.Println(err)
+	// On vérifie si l'email est déjà utilisé
+	_, err := m.GetProfile(ctx, profile.Email)
+	if err == nil {
+		return ErrEmailAlreadyUsed
 	}
-
-	// On récupère les informations de l'utilisateur et on crée la page HTML
-	var userMongo userMongo
-	err = userCollectionMongo.FindOne(context.TODO(), bson.D{{Key: "email", Value: body.Email}}).Decode(&userMongo)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email non trouvé"}`))
-		return
+	if !errors.Is(err, ErrProfileNotFound) {
+		return err
 	}
 
-	// On crée le fichier HTML
-	file, err := os.Create("./html_pages/" + userMongo.Email + ".html")
-	if err != nil {
-		log.Fatal(err)
+	_, err = m.users.InsertOne(ctx, newUserMongo(profile))
+	if mongo.IsDuplicateKeyError(err) {
+		// profil créé entre la vérification et l'insertion
+		return ErrEmailAlreadyUsed
 	}
-	defer file.Close()
+	return err
+}
 
-	// On écrit le contenu du fichier HTML
-	_, err = io.WriteString(file, "<html><head><title>Page de profil</title></head><body><h1>Page de profil</h1><p>Email : "+userMongo.Email+"</p><p>Etat : "+fmt.Sprint(userMongo.State)+"</p><p>Type d'utilisateur : "+fmt.Sprint(userMongo.UserType)+"</p><img src='../images/"+userMongo.Email+userMongo.Picture.Extension+"' /></body></html>")
-	if err != nil {
-		log.Fatal(err)
+// InsertMany ordonné : en cas d'erreur, les documents avant celui en erreur sont insérés, pas les suivants
+func (m *mongoStore) CreateProfiles(ctx context.Context, profiles []Profile) (int, error) {
+	documents := make([]interface{}, 0, len(profiles))
+	for _, profile := range profiles {
+		documents = append(documents, newUserMongo(profile))
 	}
 
-	// On met un message de succès
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Fichier HTML créer avec succès, dans le répertoir html_pages"}`))
+	_, err := m.users.InsertMany(ctx, documents)
+	if err == nil {
+		return len(profiles), nil
+	}
+	var bulk mongo.BulkWriteException
+	if errors.As(err, &bulk) && len(bulk.WriteErrors) > 0 {
+		if mongo.IsDuplicateKeyError(bulk.WriteErrors[0]) {
+			return bulk.WriteErrors[0].Index, ErrEmailAlreadyUsed
+		}
+		return bulk.WriteErrors[0].Index, err
+	}
+	return 0, err
+}
 
+func newUserMongo(profile Profile) userMongo {
+	return userMongo{
+		Email:     profile.Email,
+		Password:  profile.Password,
+		State:     profile.State,
+		UserType:  profile.UserType,
+		CreatedAt: createdAtNanos(profile.CreatedAt),
+	}
 }
 
 // Récupération d'un utilisateur avec son email
 
-func GetUserProfileMongo(w http.ResponseWriter, r *http.Request) {
-
-	w.Header().Set("Content-Type", "application/json")
-
-	var body userMongo
-	e := json.NewDecoder(r.Body).Decode(&body)
-	if e != nil {
-
-		fmt.Print(e)
-	}
-	var result primitive.M
-	err := userCollectionMongo.FindOne(context.TODO(), bson.D{{Key: "email", Value: body.Email}}).Decode(&result)
+func (m *mongoStore) GetProfile(ctx context.Context, email string) (Profile, error) {
+	user, err := m.findUser(ctx, email)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email non trouvé"}`))
-		return
+		return Profile{}, err
 	}
-	json.NewEncoder(w).Encode(result)
-
+	return user.toProfile(), nil
 }
 
-// Update d'un utilisateur sur son état
+// Récupération de tous les utilisateurs
 
-func UpdateProfileMongo(w http.ResponseWriter, r *http.Request) {
+func (m *mongoStore) ListProfiles(ctx context.Context) ([]Profile, error) {
+	return m.find(ctx, bson.D{})
+}
 
-	w.Header().Set("Content-Type", "application/json")
+func (m *mongoStore) ListProfilesByType(ctx context.Context, userType int) ([]Profile, error) {
+	return m.find(ctx, bson.D{{Key: "usertype", Value: userType}})
+}
 
-	type updateBody struct {
-		Email string `json:"email"` // l'email de l'utilisateur pour le trouver et le modifier
-		State bool   `json:"state"` // le nouvel état de l'utilisateur qui sera mis à jour
+// Pagination par clés de tri : la page suivante reprend après le dernier (createdat, email) lu.
+// Une ligne de plus que la limite est lue pour savoir s'il reste une page.
+func (m *mongoStore) ListProfilesPage(ctx context.Context, query ProfileQuery) (ProfilePage, error) {
+	cur, err := m.findProfiles(ctx, query, options.Find().SetLimit(int64(query.Limit)+1))
+	if err != nil {
+		return ProfilePage{}, err
 	}
-	var body updateBody
-	e := json.NewDecoder(r.Body).Decode(&body)
-	if e != nil {
+	defer cur.Close(ctx)
 
-		fmt.Print(e)
+	page := ProfilePage{Profiles: []Profile{}}
+	for cur.Next(ctx) {
+		var user userMongo
+		err := cur.Decode(&user)
+		if err != nil {
+			return ProfilePage{}, err
+		}
+		if len(page.Profiles) == query.Limit {
+			page.Next = cursorOf(page.Profiles[query.Limit-1])
+			break
+		}
+		page.Profiles = append(page.Profiles, user.toProfile())
 	}
+	return page, cur.Err()
+}
 
-	// Si l'email n'existe pas, on renvoie une erreur
-	var resultEmail primitive.M
-	err := userCollectionMongo.FindOne(context.TODO(), bson.D{{Key: "email", Value: body.Email}}).Decode(&resultEmail)
+// Le curseur Mongo ramène les documents par lots de 500, un seul lot est en mémoire à la fois
+func (m *mongoStore) StreamProfiles(ctx context.Context, query ProfileQuery, fn func(Profile) error) error {
+	query.After = nil
+	cur, err := m.findProfiles(ctx, query, options.Find().SetBatchSize(500))
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email non trouvé"}`))
-		return
+		return err
 	}
+	defer cur.Close(ctx)
 
-	// Si l'état est autre que true ou false, on renvoie une erreur
-	if body.State != true && body.State != false {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Etat non valide"}`))
-		return
+	for cur.Next(ctx) {
+		var user userMongo
+		err := cur.Decode(&user)
+		if err != nil {
+			return err
+		}
+		err = fn(user.toProfile())
+		if err != nil {
+			return err
+		}
 	}
+	return cur.Err()
+}
 
-	filter := bson.D{{Key: "email", Value: body.Email}} // on filtre sur l'email pour trouver l'utilisateur à modifier
-	after := options.After                              // on veut que le document soit retourné après la modification
-	returnOpt := options.FindOneAndUpdateOptions{
-
-		ReturnDocument: &after,
+// findProfiles ouvre un curseur sur les profils filtrés et triés de la requête, à partir de query.After,
+// sans le mot de passe ni les images
+func (m *mongoStore) findProfiles(ctx context.Context, query ProfileQuery, opts *options.FindOptions) (*mongo.Cursor, error) {
+	filter := bson.D{}
+	if query.State != nil {
+		filter = append(filter, bson.E{Key: "state", Value: *query.State})
+	}
+	if query.UserType != nil {
+		filter = append(filter, bson.E{Key: "usertype", Value: *query.UserType})
+	}
+
+	cmp, dir := "$gt", 1
+	if query.Descending {
+		cmp, dir = "$lt", -1
+	}
+	sort := bson.D{{Key: "email", Value: dir}}
+	if query.Sort == sortByCreated {
+		sort = bson.D{{Key: "createdat", Value: dir}, {Key: "email", Value: dir}}
+	}
+	if after := query.After; after != nil {
+		if query.Sort == sortByCreated {
+			filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+				bson.D{{Key: "createdat", Value: bson.D{{Key: cmp, Value: after.CreatedAt}}}},
+				bson.D{{Key: "createdat", Value: after.CreatedAt}, {Key: "email", Value: bson.D{{Key: cmp, Value: after.Email}}}},
+			}})
+		} else {
+			filter = append(filter, bson.E{Key: "email", Value: bson.D{{Key: cmp, Value: after.Email}}})
+		}
 	}
-	update := bson.D{{Key: "$set", Value: bson.D{{Key: "state", Value: body.State}}}} // on met à jour l'état de l'utilisateur
-	updateResult := userCollectionMongo.FindOneAndUpdate(context.TODO(), filter, update, &returnOpt)
-
-	var result primitive.M
-	_ = updateResult.Decode(&result)
 
-	json.NewEncoder(w).Encode(result)
+	opts.SetSort(sort).SetProjection(bson.D{{Key: "password", Value: 0}, {Key: "picture", Value: 0}, {Key: "gallery", Value: 0}})
+	return m.users.Find(ctx, filter, opts)
 }
 
-func UploadProfileImageMongo(w http.ResponseWriter, r *http.Request) {
+func (m *mongoStore) CountProfiles(ctx context.Context) (int, error) {
+	count, err := m.users.CountDocuments(ctx, bson.D{})
+	return int(count), err
+}
 
-	w.Header().Set("Content-Type", "multipart/form-data")
+// Update d'un utilisateur sur son état
 
-	// Parse le corps de la requête pour récupérer le formulaire multipart
-	err := r.ParseMultipartForm(16 << 20) // taille maximale du fichier : 16 Mo
-	if err != nil {
-		http.Error(w, "Erreur lors de la lecture du formulaire", http.StatusBadRequest)
-		return
+func (m *mongoStore) UpdateProfileState(ctx context.Context, email string, state bool) (Profile, error) {
+	filter := bson.D{{Key: "email", Value: email}} // on filtre sur l'email pour trouver l'utilisateur à modifier
+	after := options.After                         // on veut que le document soit retourné après la modification
+	returnOpt := options.FindOneAndUpdateOptions{
+		ReturnDocument: &after,
 	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "state", Value: state}}}} // on met à jour l'état de l'utilisateur
 
-	// On lit le fichier image envoyé
-	file, handler, err := r.FormFile("image")
+	var user userMongo
+	err := m.users.FindOneAndUpdate(ctx, filter, update, &returnOpt).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Profile{}, ErrProfileNotFound
+	}
 	if err != nil {
-		fmt.Println("Erreur : recupération du fichier impossible")
-		fmt.Println(err)
-		return
-	}
-	defer file.Close()
-
-	// On vérifie que le fichier est bien une image
-	if handler.Header.Get("Content-Type") != "image/jpeg" && handler.Header.Get("Content-Type") != "image/png" && handler.Header.Get("Content-Type") != "image/jpg" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Le fichier n'est pas une image"}`))
-		return
-	}
-
-	// Lire les bytes de l'image
-	var imageBytes []byte
-	buf := make([]byte, 1024) // créer un tampon de 1 Ko pour lire les données du fichier par morceaux
-	for {
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			fmt.Println("Erreur : lecture des bytes de l'image impossible")
-			fmt.Println(err)
-			return
-		}
-		if n == 0 {
-			break
-		}
-		imageBytes = append(imageBytes, buf[:n]...)
+		return Profile{}, err
 	}
+	return user.toProfile(), nil
+}
 
-	fileName := handler.Filename
-	fileExtension := filepath.Ext(fileName)
-
-	fmt.Println("Extension  : ", fileExtension)
+// Changement du mot de passe d'un utilisateur, passwordHash est déjà haché
 
-	// Créer un nouveau document ImageBinaryMongo avec les données de l'image
-	imageBinary := ImageBinaryMongo{
-		Data:      imageBytes,
-		Extension: fileExtension,
-		Type: primitive.Binary{
-			Subtype: 0x00,
-			Data:    imageBytes,
-		},
+func (m *mongoStore) UpdateProfilePassword(ctx context.Context, email string, passwordHash string, changedAt time.Time) error {
+	filter := bson.D{{Key: "email", Value: email}}
+	fields := bson.D{{Key: "password", Value: passwordHash}}
+	if !changedAt.IsZero() {
+		fields = append(fields, bson.E{Key: "passwordchangedat", Value: createdAtNanos(changedAt)})
 	}
+	update := bson.D{{Key: "$set", Value: fields}}
 
-	fmt.Println("L'extension de l'image qu'on veut enregistrer est : ", imageBinary.Extension)
-
-	// On récupère l'email de l'utilisateur
-	email := r.FormValue("email")
-	// Si l'email n'existe pas dans userCollectionMongo, on renvoie une erreur
-	var resultEmail primitive.M
-	err = userCollectionMongo.FindOne(context.TODO(), bson.D{{Key: "email", Value: email}}).Decode(&resultEmail)
+	res, err := m.users.UpdateOne(ctx, filter, update)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email non trouvé"}`))
-		return
+		return err
 	}
-
-	// On met à jour l'image de l'utilisateur
-	filter := bson.D{{Key: "email", Value: email}} // on filtre sur l'email pour trouver l'utilisateur à modifier
-	after := options.After                         // on veut que le document soit retourné après la modification
-	returnOpt := options.FindOneAndUpdateOptions{
-
-		ReturnDocument: &after,
+	if res.MatchedCount == 0 {
+		return ErrProfileNotFound
 	}
-
-	update := bson.D{{Key: "$set", Value: bson.D{{Key: "picture", Value: imageBinary}}}} // on met à jour l'image de l'utilisateur
-	updateResult := userCollectionMongo.FindOneAndUpdate(context.TODO(), filter, update, &returnOpt)
-
-	var result primitive.M
-	_ = updateResult.Decode(&result)
-
-	// on envoie un message de succès
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Image envoyée"}`))
+	if changedAt.IsZero() {
+		return nil
+	}
+	_, err = m.resets.DeleteMany(ctx, bson.D{{Key: "email", Value: email}})
+	return err
 }
 
-func GetProfileImageMongo(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// Suppression d'un utilisateur
 
-	type response struct {
-		Email string `json:"email"`
+func (m *mongoStore) DeleteProfile(ctx context.Context, email string) error {
+	res, err := m.users.DeleteOne(ctx, bson.D{{Key: "email", Value: email}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrProfileNotFound
 	}
+	_, err = m.resets.DeleteMany(ctx, bson.D{{Key: "email", Value: email}})
+	return err
+}
 
-	// Récupérer l'email de l'utilisateur
-	var body response
-	err := json.NewDecoder(r.Body).Decode(&body)
+func (m *mongoStore) DeleteAllProfiles(ctx context.Context) error {
+	_, err := m.users.DeleteMany(ctx, bson.D{})
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Email non trouvé"}`))
-		return
+		return err
 	}
+	_, err = m.resets.DeleteMany(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	_, err = m.blobRefs.DeleteMany(ctx, bson.D{})
+	return err
+}
 
-	email := body.Email
+func (m *mongoStore) PutProfileImage(ctx context.Context, email string, image ProfileImage) error {
+
+	// Le sous-document remplace entièrement l'ancien, y compris les données des images d'avant le BlobStore
+	imageBinary := toImageBinaryMongo(image)
 
-	// Rechercher l'utilisateur dans la base de données
-	var userMongo userMongo
 	filter := bson.D{{Key: "email", Value: email}}
-	err = userCollectionMongo.FindOne(context.TODO(), filter).Decode(&userMongo)
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "picture", Value: imageBinary}}}} // on met à jour l'image de l'utilisateur
+	res, err := m.users.UpdateOne(ctx, filter, update)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Utilisateur non trouvé"}`))
-		return
+		return err
 	}
+	if res.MatchedCount == 0 {
+		return ErrProfileNotFound
+	}
+	return nil
+}
 
-	// Récupérer les données d'image
-	imageBinary := userMongo.Picture
-	imageBytes := imageBinary.Data
-
-	// Récupérer l'extension du fichier
-	fileExtension := imageBinary.Extension
-	fmt.Println("Extension du fichier image à charger :", fileExtension)
+func (m *mongoStore) GetProfileImage(ctx context.Context, email string) (ProfileImage, error) {
+	user, err := m.findUser(ctx, email)
+	if err != nil {
+		return ProfileImage{}, err
+	}
+	if user.Picture.Key == "" && len(user.Picture.Data) == 0 {
+		return ProfileImage{}, ErrImageNotFound
+	}
+	return user.Picture.toProfileImage(), nil
+}
 
-	// Créer le nom du fichier
-	fileName := userMongo.Email + fileExtension
-	cleanFileName := filepath.Clean(fileName)
+func (m *mongoStore) ListGalleryImages(ctx context.Context, email string) ([]GalleryImage, error) {
+	user, err := m.findUser(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	images := make([]GalleryImage, 0, len(user.Gallery))
+	for _, image := range user.Gallery {
+		images = append(images, GalleryImage{
+			ID:       image.ID,
+			Caption:  image.Caption,
+			Position: image.Position,
+			Image:    image.Picture.toProfileImage(),
+		})
+	}
+	return sortGallery(images), nil
+}
 
-	// Créer le fichier dans l'arborescence du projet
-	filePath := path.Join("./images", cleanFileName) // Chemin du fichier dans l'arborescence du projet
-	fmt.Println("Chemin du dossier images :", path.Dir(filePath))
+// La limite fait partie du filtre : le document n'est modifié que si la galerie n'a pas d'élément
+// d'indice maxImages-1, la vérification et le $push sont une seule opération atomique.
+func (m *mongoStore) AddGalleryImage(ctx context.Context, email string, image GalleryImage, maxImages int) error {
+	entry := GalleryImageMongo{
+		ID:       image.ID,
+		Caption:  image.Caption,
+		Position: image.Position,
+		Picture:  toImageBinaryMongo(image.Image),
+	}
+	filter := bson.D{{Key: "email", Value: email}}
+	if maxImages > 0 {
+		filter = append(filter, bson.E{Key: "gallery." + strconv.Itoa(maxImages-1), Value: bson.D{{Key: "$exists", Value: false}}})
+	}
+	update := bson.D{{Key: "$push", Value: bson.D{{Key: "gallery", Value: entry}}}}
+	res, err := m.users.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		// Profil absent, ou galerie pleine
+		_, err = m.findUser(ctx, email)
+		if err != nil {
+			return err
+		}
+		return ErrGalleryFull
+	}
+	return nil
+}
 
-	// Créer le fichier
-	file, err := os.Create(filePath)
+// L'opérateur positionnel "gallery.$" modifie l'élément du tableau trouvé par le filtre
+func (m *mongoStore) UpdateGalleryImage(ctx context.Context, email string, image GalleryImage) error {
+	filter := bson.D{{Key: "email", Value: email}, {Key: "gallery.id", Value: image.ID}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "gallery.$.caption", Value: image.Caption},
+		{Key: "gallery.$.position", Value: image.Position},
+	}}}
+	res, err := m.users.UpdateOne(ctx, filter, update)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Impossible de créer le fichier d'image"}`))
-		fmt.Println(err)
-		return
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return m.galleryNotFound(ctx, email)
 	}
-	defer file.Close()
+	return nil
+}
 
-	// Écrire les données d'image dans le fichier
-	_, err = file.Write(imageBytes)
+func (m *mongoStore) DeleteGalleryImage(ctx context.Context, email string, id string) error {
+	filter := bson.D{{Key: "email", Value: email}, {Key: "gallery.id", Value: id}}
+	update := bson.D{{Key: "$pull", Value: bson.D{{Key: "gallery", Value: bson.D{{Key: "id", Value: id}}}}}}
+	res, err := m.users.UpdateOne(ctx, filter, update)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Impossible d'écrire les données d'image dans le fichier"}`))
-		fmt.Println(err)
-		return
+		return err
 	}
+	if res.MatchedCount == 0 {
+		return m.galleryNotFound(ctx, email)
+	}
+	return nil
+}
 
-	// On met un message de succès
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Image créée"}`))
+// galleryNotFound distingue un profil absent d'une image absente de la galerie
+func (m *mongoStore) galleryNotFound(ctx context.Context, email string) error {
+	_, err := m.findUser(ctx, email)
+	if err != nil {
+		return err
+	}
+	return ErrImageNotFound
 }
 
-// Suppression d'un utilisateur
+func toImageBinaryMongo(image ProfileImage) ImageBinaryMongo {
+	return ImageBinaryMongo{
+		Key:         image.Key,
+		Extension:   image.Extension,
+		UpdatedAt:   image.UpdatedAt,
+		VariantKeys: image.Variants,
+		GalleryID:   image.GalleryID,
+	}
+}
 
-func DeleteProfileMongo(w http.ResponseWriter, r *http.Request) {
+func (ib ImageBinaryMongo) toProfileImage() ProfileImage {
+	return ProfileImage{
+		Key:       ib.Key,
+		Extension: ib.Extension,
+		UpdatedAt: ib.UpdatedAt,
+		Variants:  ib.VariantKeys,
+		Data:      ib.Data,
+		GalleryID: ib.GalleryID,
+	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	params := mux.Vars(r)["id"] // on récupère l'id de l'utilisateur à supprimer dans l'url
+// $inc avec upsert est atomique : deux envois simultanés de la même image comptent bien deux références
+func (m *mongoStore) AcquireBlob(ctx context.Context, key string, now time.Time) error {
+	update := bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}},
+		{Key: "$set", Value: bson.D{{Key: "updatedat", Value: now}}},
+	}
+	_, err := m.blobRefs.UpdateOne(ctx, bson.D{{Key: "_id", Value: key}}, update, options.Update().SetUpsert(true))
+	return err
+}
 
-	// Si l'id n'existe pas, on renvoie une erreur
-	var result primitive.M
-	err := userCollectionMongo.FindOne(context.TODO(), bson.D{{Key: "_id", Value: params}}).Decode(&result)
+func (m *mongoStore) ReleaseBlob(ctx context.Context, key string, now time.Time) (int, error) {
+	var ref blobRefMongo
+	filter := bson.D{{Key: "_id", Value: key}, {Key: "count", Value: bson.D{{Key: "$gt", Value: 0}}}}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: -1}}}}
+	err := m.blobRefs.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&ref)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Id non trouvé"}`))
-		return
+		return 0, err
+	}
+	if ref.Count > 0 {
+		return ref.Count, nil
 	}
 
-	_id, err := primitive.ObjectIDFromHex(params) // on convertit l'id en ObjectID
+	// Date de libération, pour le délai de grâce du ramasse-miettes. Le filtre sur count évite
+	// de dater un compteur repris entre temps par un autre envoi.
+	_, err = m.blobRefs.UpdateOne(ctx, bson.D{{Key: "_id", Value: key}, {Key: "count", Value: bson.D{{Key: "$lte", Value: 0}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "updatedat", Value: now}}}})
+	return 0, err
+}
+
+func (m *mongoStore) ListBlobRefs(ctx context.Context) ([]BlobRef, error) {
+	cur, err := m.blobRefs.Find(ctx, bson.D{})
 	if err != nil {
-		fmt.Printf(err.Error())
+		return nil, err
 	}
-	opts := options.Delete().SetCollation(&options.Collation{})
-	res, err := userCollectionMongo.DeleteOne(context.TODO(), bson.D{{Key: "_id", Value: _id}}, opts)
-	if err != nil {
-		log.Fatal(err)
+	defer cur.Close(ctx)
+
+	var refs []BlobRef
+	for cur.Next(ctx) {
+		var ref blobRefMongo
+		err := cur.Decode(&ref)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, BlobRef{Key: ref.Key, Count: ref.Count, UpdatedAt: ref.UpdatedAt})
 	}
-	fmt.Printf("deleted %v documents\n", res.DeletedCount)
-	json.NewEncoder(w).Encode(res.DeletedCount) // on renvoie le nombre de documents supprimés (1 si tout s'est bien passé)
+	return refs, cur.Err()
+}
 
+func (m *mongoStore) SetBlobRef(ctx context.Context, ref BlobRef) error {
+	if ref.Count <= 0 {
+		_, err := m.blobRefs.DeleteOne(ctx, bson.D{{Key: "_id", Value: ref.Key}})
+		return err
+	}
+	_, err := m.blobRefs.ReplaceOne(ctx, bson.D{{Key: "_id", Value: ref.Key}},
+		blobRefMongo{Key: ref.Key, Count: ref.Count, UpdatedAt: ref.UpdatedAt}, options.Replace().SetUpsert(true))
+	return err
 }
 
-// Récupération de tous les utilisateurs
+func (m *mongoStore) CreatePasswordReset(ctx context.Context, reset PasswordReset) error {
+	_, err := m.resets.InsertOne(ctx, passwordResetMongo{
+		TokenHash: reset.TokenHash,
+		Email:     reset.Email,
+		ExpiresAt: reset.ExpiresAt,
+	})
+	return err
+}
 
-func GetAllUsersMongo(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var results []primitive.M
-	cur, err := userCollectionMongo.Find(context.TODO(), bson.D{{}}) // on récupère tous les documents de la collection users
+func (m *mongoStore) ConsumePasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error) {
+	// FindOneAndDelete est atomique : deux requêtes avec le même token ne peuvent pas réussir toutes les deux
+	var reset passwordResetMongo
+	err := m.resets.FindOneAndDelete(ctx, bson.D{{Key: "tokenhash", Value: tokenHash}}).Decode(&reset)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return PasswordReset{}, ErrResetNotFound
+	}
 	if err != nil {
+		return PasswordReset{}, err
+	}
+	return PasswordReset{TokenHash: reset.TokenHash, Email: reset.Email, ExpiresAt: reset.ExpiresAt}, nil
+}
 
-		fmt.Println(err)
+func (m *mongoStore) findUser(ctx context.Context, email string) (userMongo, error) {
+	var user userMongo
+	err := m.users.FindOne(ctx, bson.D{{Key: "email", Value: email}}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return userMongo{}, ErrProfileNotFound
+	}
+	return user, err
+}
 
+func (m *mongoStore) find(ctx context.Context, filter bson.D) ([]Profile, error) {
+	// Les images ne sont pas utiles aux listes (et picture contient encore les données des anciennes images)
+	projection := bson.D{{Key: "picture", Value: 0}, {Key: "gallery", Value: 0}}
+	cur, err := m.users.Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
 	}
-	for cur.Next(context.TODO()) { // itère sur le curseur jusqu'à ce qu'il n'y ait plus de documents
+	defer cur.Close(ctx) // on ferme le curseur pour libérer les ressources
 
-		var elem primitive.M
-		err := cur.Decode(&elem)
+	var profiles []Profile
+	for cur.Next(ctx) { // itère sur le curseur jusqu'à ce qu'il n'y ait plus de documents
+		var user userMongo
+		err := cur.Decode(&user)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-
-		results = append(results, elem) // on ajoute chaque document à la liste results
+		profiles = append(profiles, user.toProfile())
 	}
-	cur.Close(context.TODO()) // on ferme le curseur pour libérer les ressources
-	json.NewEncoder(w).Encode(results)
-}
-
-func hashPasswordMongo(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14) // on hash le mot de passe avec bcrypt
-	return string(bytes), err
+	return profiles, cur.Err()
 }
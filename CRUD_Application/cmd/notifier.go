@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Notifiers disponibles pour --notifier
+const (
+	notifierLog  = "log"
+	notifierFile = "file"
+)
+
+// Message envoyé à un utilisateur (réinitialisation de mot de passe...)
+type Notification struct {
+	Kind    string            `json:"kind"` // ex : "password-reset"
+	To      string            `json:"to"`   // email du destinataire
+	Subject string            `json:"subject"`
+	Body    string            `json:"body"`
+	Data    map[string]string `json:"data,omitempty"` // valeurs utiles aux scripts (token, expiration...)
+}
+
+// Notifier délivre les notifications aux utilisateurs. Les implémentations fournies sont faites
+// pour le développement ; un envoi par email ou SMS n'a qu'à implémenter cette interface.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// newNotifier crée le notifier choisi avec --notifier
+func newNotifier(cfg config) Notifier {
+	switch cfg.Notifier {
+	case notifierFile:
+		return &fileNotifier{path: cfg.NotifierFile}
+	default:
+		return logNotifier{}
+	}
+}
+
+// logNotifier écrit les notifications dans les logs du serveur
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, n Notification) error {
+	log.Printf("Notification %s pour %s : %s\n%s", n.Kind, n.To, n.Subject, n.Body)
+	return nil
+}
+
+// fileNotifier ajoute chaque notification sur une ligne JSON d'un fichier (boîte mail de développement)
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (f *fileNotifier) Notify(ctx context.Context, n Notification) error {
+	line, err := json.Marshal(struct {
+		Time time.Time `json:"time"`
+		Notification
+	}{time.Now().UTC(), n})
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(f.path), 0755)
+	if err != nil {
+		return err
+	}
+	// Le fichier contient des tokens de réinitialisation : lisible uniquement par le serveur
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
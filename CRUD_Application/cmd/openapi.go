@@ -0,0 +1,744 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Spécification OpenAPI 3 de l'API :
+//
+//	GET /api/openapi.json   le document, construit au démarrage à partir du routeur
+//	GET /api/docs           documentation lisible dans un navigateur, sans ressource externe
+//
+// Chaque route enregistrée dans newRouter (méthodes et modèle d'url) doit avoir son entrée dans
+// apiOperations : résumé, accès, paramètres, types Go du corps et des réponses. Les schémas sont générés
+// par réflexion à partir de ces types, ceux que les handlers décodent et encodent, en suivant leurs tags json.
+// Les types des backends (userMongo, Record, UserCockroach) ne sortent pas de l'API : tous sont convertis
+// en Profile, sans le hash du mot de passe, qui est le seul schéma de profil publié.
+//
+// "./main openapi --check" échoue si une route n'a pas d'entrée ou si une entrée ne correspond plus
+// à aucune route. La suite de conformité fait la même vérification avant de démarrer.
+
+//go:embed docs
+var embeddedDocs embed.FS
+
+// Description d'une route pour la spécification
+type apiOperation struct {
+	Summary      string
+	Description  string
+	Tag          string
+	Access       string      // qui peut appeler la route, vide pour une route publique
+	SignedLink   bool        // la route accepte aussi un lien signé (?sig=...) à la place du token
+	Query        []apiParam  // paramètres de l'url, ceux du chemin sont lus dans son modèle
+	Body         interface{} // valeur du type du corps JSON, nil sans corps
+	OptionalBody bool        // le corps JSON peut être absent
+	Form         []apiParam  // champs du formulaire multipart, de type "binary" pour un fichier
+	BodyTypes    string      // types du corps envoyé tel quel (fichier), séparés par ", "
+	Responses    []apiResponse
+	Successor    string // route qui remplace une ancienne route dépréciée
+}
+
+type apiParam struct {
+	Name        string
+	Type        string // "string", "integer", "boolean" ou "binary"
+	Required    bool
+	Description string
+}
+
+type apiResponse struct {
+	Status      int
+	Description string
+	Body        interface{}   // valeur du type du corps JSON
+	OneOf       []interface{} // types possibles du corps JSON, à la place de Body
+	ContentType string        // type du corps quand il n'est pas JSON (ex : "image/*"), plusieurs séparés par ", "
+}
+
+// Accès des routes, dans les termes des policies de roles.go
+const (
+	accessUser          = "tout utilisateur connecté"
+	accessAdmin         = "admin"
+	accessModeratorSelf = "le profil lui-même, ou un moderator"
+	accessAdminSelf     = "le profil lui-même, ou un admin"
+)
+
+// Réponses communes
+func errorReply(status int, description string) apiResponse {
+	return apiResponse{Status: status, Description: description, Body: errorResponse{}}
+}
+
+func messageReply(status int, description string) apiResponse {
+	return apiResponse{Status: status, Description: description, Body: messageResponse{}}
+}
+
+var (
+	replyBadBody      = errorReply(http.StatusBadRequest, "Corps de la requête illisible")
+	replyNotFound     = errorReply(http.StatusNotFound, "Profil introuvable")
+	replyImageMissing = errorReply(http.StatusNotFound, "Profil ou image introuvable")
+	replyStoreError   = errorReply(http.StatusInternalServerError, "Erreur de la base de données")
+	replyProfile      = apiResponse{Status: http.StatusOK, Description: "Le profil", Body: Profile{}}
+	replyProfiles     = apiResponse{Status: http.StatusOK, Description: "Les profils, triés par email", Body: []Profile{}}
+	replyGallery      = apiResponse{Status: http.StatusOK, Description: "La galerie, dans son ordre", Body: []galleryItem{}}
+)
+
+// Réponses d'un envoi d'image refusé, voir imagecheck.go
+var imageUploadErrors = []apiResponse{
+	{Status: http.StatusRequestEntityTooLarge, Description: "Image trop lourde", Body: imageErrorResponse{}},
+	{Status: http.StatusUnsupportedMediaType, Description: "Format d'image non accepté", Body: imageErrorResponse{}},
+	{Status: http.StatusUnprocessableEntity, Description: "Image corrompue, trop grande ou extension incohérente", Body: imageErrorResponse{}},
+}
+
+// Envoi des images : GET et HEAD, ?size= et négociation du format avec Accept
+var (
+	imageQuery = []apiParam{
+		{Name: "size", Type: "string", Description: "nom de la variante redimensionnée, une des tailles de --image-variants (64, 256...), l'original si absent"},
+	}
+	imageReplies = []apiResponse{
+		{Status: http.StatusOK, Description: "L'image, au format demandé par Accept (WebP, PNG ou JPEG) s'il est disponible", ContentType: "image/*"},
+		{Status: http.StatusPartialContent, Description: "Partie de l'image demandée avec Range", ContentType: "image/*"},
+		{Status: http.StatusNotModified, Description: "Image inchangée (If-None-Match, If-Modified-Since)"},
+		{Status: http.StatusBadRequest, Description: "Taille inconnue", Body: imageErrorResponse{}},
+		replyImageMissing,
+	}
+	imageForm = apiParam{Name: "image", Type: "binary", Required: true, Description: "PNG, JPEG ou GIF"}
+)
+
+// Routes v2, reprises par les anciennes routes qui les ont précédées
+var (
+	opListProfiles = apiOperation{
+		Summary: "Liste paginée des profils", Tag: "profils",
+		Access: "admin, ou moderator avec le filtre userType",
+		Description: "Le champ next de la réponse, absent sur la dernière page, se passe en cursor pour lire la page suivante, " +
+			"avec les mêmes sort, state et userType.",
+		Query: []apiParam{
+			{Name: "limit", Type: "integer", Description: "taille de la page, de 1 à 500, 50 par défaut"},
+			{Name: "sort", Type: "string", Description: "email (par défaut) ou createdAt, précédé de - pour l'ordre décroissant"},
+			{Name: "state", Type: "boolean", Description: "uniquement les profils dans cet état"},
+			{Name: "userType", Type: "integer", Description: "uniquement les profils de ce type (1 user, 2 moderator, 3 admin)"},
+			{Name: "cursor", Type: "string", Description: "le champ next de la page précédente"},
+		},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "Une page de profils", Body: profileListResponse{}},
+			errorReply(http.StatusBadRequest, "Paramètre invalide, ou curseur invalide ou produit par une autre requête"),
+			replyStoreError},
+	}
+	// Liste complète, sans pagination, des anciennes routes
+	opListAllProfiles = apiOperation{
+		Summary: "Liste des profils", Tag: "profils",
+		Access: "admin, ou moderator avec le filtre userType",
+		Query:  []apiParam{{Name: "userType", Type: "integer", Description: "uniquement les profils de ce type (1 user, 2 moderator, 3 admin)"}},
+		Responses: []apiResponse{replyProfiles,
+			errorReply(http.StatusBadRequest, "userType n'est pas un entier"), replyStoreError},
+	}
+	opCreateProfile = apiOperation{
+		Summary: "Création d'un profil", Tag: "profils",
+		Description: "Publique pour un profil user. Seul un admin connecté peut créer un profil moderator ou admin. " +
+			"Un userType hors de 1 à 3 devient 1.",
+		Body: createProfileRequest{},
+		Responses: []apiResponse{
+			{Status: http.StatusCreated, Description: "Le profil créé, son url dans le header Location", Body: Profile{}},
+			errorReply(http.StatusBadRequest, "Email manquant, invalide ou déjà utilisé"),
+			errorReply(http.StatusForbidden, "Rôle réservé aux admins"), replyStoreError},
+	}
+	opGetProfile = apiOperation{
+		Summary: "Lecture d'un profil", Tag: "profils", Access: accessModeratorSelf,
+		Responses: []apiResponse{replyProfile, replyNotFound, replyStoreError},
+	}
+	opUpdateProfile = apiOperation{
+		Summary: "Activation ou désactivation d'un profil", Tag: "profils", Access: accessModeratorSelf,
+		Body: updateProfileRequest{},
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "Le profil modifié", Body: Profile{}},
+			errorReply(http.StatusBadRequest, "state manquant"), replyNotFound, replyStoreError},
+	}
+	opDeleteProfile = apiOperation{
+		Summary: "Suppression d'un profil et de ses images", Tag: "profils", Access: accessAdminSelf,
+		Responses: []apiResponse{messageReply(http.StatusOK, "Profil supprimé"), replyNotFound, replyStoreError},
+	}
+	opPutImage = apiOperation{
+		Summary: "Envoi de l'avatar", Tag: "images", Access: accessModeratorSelf,
+		Description: "Remplace l'avatar. Les métadonnées (EXIF, XMP...) sont retirées et les variantes générées.",
+		Form:        []apiParam{imageForm},
+		Responses: append([]apiResponse{
+			{Status: http.StatusOK, Description: "Image enregistrée, avec les métadonnées retirées", Body: imageUploadResponse{}},
+			replyNotFound, replyStoreError}, imageUploadErrors...),
+	}
+	opGetImage = apiOperation{
+		Summary: "Avatar du profil", Tag: "images", Access: accessModeratorSelf, SignedLink: true,
+		Query: imageQuery, Responses: imageReplies,
+	}
+	opDeleteImage = apiOperation{
+		Summary: "Suppression de l'avatar", Tag: "images", Access: accessModeratorSelf,
+		Description: "Retire aussi l'image de la galerie. Aucune autre image ne devient l'avatar.",
+		Responses:   []apiResponse{messageReply(http.StatusOK, "Image supprimée"), replyImageMissing, replyStoreError},
+	}
+	opListGallery = apiOperation{
+		Summary: "Galerie du profil", Tag: "galerie", Access: accessModeratorSelf,
+		Responses: []apiResponse{replyGallery, replyNotFound, replyStoreError},
+	}
+	opAddGallery = apiOperation{
+		Summary: "Ajout d'une image à la galerie", Tag: "galerie", Access: accessModeratorSelf,
+		Form: []apiParam{imageForm,
+			{Name: "caption", Type: "string", Description: "légende"},
+			{Name: "primary", Type: "boolean", Description: "l'image devient l'avatar"}},
+		Responses: append([]apiResponse{
+			{Status: http.StatusCreated, Description: "Image ajoutée", Body: galleryAddResponse{}},
+			errorReply(http.StatusBadRequest, "Légende trop longue, ou galerie pleine (--gallery-max-images)"),
+			replyNotFound, replyStoreError}, imageUploadErrors...),
+	}
+	opReorderGallery = apiOperation{
+		Summary: "Ordre de la galerie", Tag: "galerie", Access: accessModeratorSelf,
+		Body: galleryOrderRequest{},
+		Responses: []apiResponse{replyGallery,
+			errorReply(http.StatusBadRequest, "Liste d'ids incomplète ou inconnue"), replyNotFound, replyStoreError},
+	}
+	opGetGalleryImage = apiOperation{
+		Summary: "Image de la galerie", Tag: "galerie", Access: accessModeratorSelf, SignedLink: true,
+		Query: imageQuery, Responses: imageReplies,
+	}
+	opUpdateGalleryImage = apiOperation{
+		Summary: "Légende d'une image, ou choix comme avatar", Tag: "galerie", Access: accessModeratorSelf,
+		Body: galleryUpdateRequest{},
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "L'image modifiée", Body: galleryItem{}},
+			errorReply(http.StatusBadRequest, "Légende trop longue, ou avatar retiré sans remplaçant"),
+			replyImageMissing, replyStoreError},
+	}
+	opDeleteGalleryImage = apiOperation{
+		Summary: "Suppression d'une image de la galerie", Tag: "galerie", Access: accessModeratorSelf,
+		Description: "Si c'était l'avatar, la première image restante le devient.",
+		Responses:   []apiResponse{messageReply(http.StatusOK, "Image supprimée de la galerie"), replyImageMissing, replyStoreError},
+	}
+)
+
+// legacy décrit une ancienne route à partir de la route v2 qui la remplace
+func legacy(op apiOperation, successor string, body interface{}, form ...apiParam) apiOperation {
+	op.Successor = successor
+	op.Tag = "anciennes routes"
+	if body != nil {
+		op.Body = body
+	}
+	if len(form) > 0 {
+		op.Form = form
+	}
+	return op
+}
+
+// Toutes les routes de newRouter, indexées par "MÉTHODES /modèle" (méthodes triées, séparées par des virgules)
+var apiOperations = map[string]apiOperation{
+	"GET /api/v2/profiles":                          opListProfiles,
+	"POST /api/v2/profiles":                         opCreateProfile,
+	"GET /api/v2/profiles/{email}":                  opGetProfile,
+	"PATCH /api/v2/profiles/{email}":                opUpdateProfile,
+	"DELETE /api/v2/profiles/{email}":               opDeleteProfile,
+	"PUT /api/v2/profiles/{email}/image":            opPutImage,
+	"GET,HEAD /api/v2/profiles/{email}/image":       opGetImage,
+	"DELETE /api/v2/profiles/{email}/image":         opDeleteImage,
+	"GET /api/v2/profiles/{email}/images":           opListGallery,
+	"POST /api/v2/profiles/{email}/images":          opAddGallery,
+	"PUT /api/v2/profiles/{email}/images/order":     opReorderGallery,
+	"GET,HEAD /api/v2/profiles/{email}/images/{id}": opGetGalleryImage,
+	"PATCH /api/v2/profiles/{email}/images/{id}":    opUpdateGalleryImage,
+	"DELETE /api/v2/profiles/{email}/images/{id}":   opDeleteGalleryImage,
+
+	"POST /api/login": {
+		Summary: "Connexion", Tag: "session",
+		Description: "Renvoie le token de session à passer dans le header Authorization: Bearer <token>.",
+		Body:        loginRequest{},
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "Token de session", Body: sessionResponse{}},
+			replyBadBody, errorReply(http.StatusUnauthorized, "Email ou mot de passe incorrect")},
+	},
+	"POST /api/requestPasswordReset": {
+		Summary: "Demande de réinitialisation du mot de passe", Tag: "session",
+		Description: "Le token est envoyé par le notifier. La réponse est la même que le compte existe ou non.",
+		Body:        emailRequest{},
+		Responses:   []apiResponse{messageReply(http.StatusAccepted, "Demande prise en compte"), replyBadBody},
+	},
+	"POST /api/resetPassword": {
+		Summary: "Réinitialisation du mot de passe avec le token reçu", Tag: "session",
+		Body: resetPasswordRequest{},
+		Responses: []apiResponse{messageReply(http.StatusOK, "Mot de passe réinitialisé"),
+			errorReply(http.StatusBadRequest, "Nouveau mot de passe manquant, token invalide, expiré ou déjà utilisé")},
+	},
+	"GET /api/me": {
+		Summary: "Profil de l'utilisateur connecté", Tag: "session", Access: accessUser,
+		Responses: []apiResponse{replyProfile},
+	},
+	"POST /api/changePassword": {
+		Summary: "Changement de mot de passe", Tag: "session", Access: accessUser,
+		Body: changePasswordRequest{},
+		Responses: []apiResponse{messageReply(http.StatusOK, "Mot de passe changé"),
+			errorReply(http.StatusBadRequest, "Nouveau mot de passe manquant"),
+			errorReply(http.StatusForbidden, "Ancien mot de passe incorrect")},
+	},
+	"GET /api/profiles/export": {
+		Summary: "Export de tous les profils", Tag: "profils",
+		Access: "admin, ou moderator avec le filtre userType",
+		Description: "Une ligne par profil, envoyée au fur et à mesure, sans hash de mot de passe ni image. " +
+			"NDJSON : un objet Profile par ligne. CSV : en-tête email,state,userType,createdAt, cellules commençant par = + - @ préfixées d'une apostrophe. " +
+			"Une erreur en cours d'export coupe la connexion.",
+		Query: []apiParam{
+			{Name: "format", Type: "string", Description: "ndjson (par défaut) ou csv"},
+			{Name: "sort", Type: "string", Description: "comme la liste paginée"},
+			{Name: "state", Type: "boolean", Description: "uniquement les profils dans cet état"},
+			{Name: "userType", Type: "integer", Description: "uniquement les profils de ce type (1 user, 2 moderator, 3 admin)"},
+		},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "Les profils, en NDJSON ou en CSV selon format", ContentType: "application/x-ndjson, text/csv"},
+			errorReply(http.StatusBadRequest, "Format ou filtre invalide"), replyStoreError},
+	},
+	"POST /api/profiles/import": {
+		Summary: "Import de profils en masse", Tag: "profils", Access: accessAdmin,
+		Description: "Le corps est le fichier : CSV avec en-tête (email, password, state, userType) ou NDJSON " +
+			"(un objet comme pour la création par ligne), choisi par format ou par le Content-Type. " +
+			"Chaque ligne est validée, les profils valides sont insérés par lots. 32 Mio au plus.",
+		Query: []apiParam{
+			{Name: "format", Type: "string", Description: "csv ou ndjson, par défaut d'après le Content-Type"},
+			{Name: "dryRun", Type: "boolean", Description: "valide le fichier sans rien insérer"},
+		},
+		BodyTypes: "text/csv, application/x-ndjson",
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "Le résultat de chaque ligne", Body: importReport{}},
+			errorReply(http.StatusBadRequest, "Format inconnu, fichier illisible ou vide"),
+			errorReply(http.StatusRequestEntityTooLarge, "Fichier trop gros"), replyStoreError},
+	},
+	"DELETE /api/deleteAllDatabase": {
+		Summary: "Vidage de la base", Tag: "administration", Access: accessAdmin,
+		Description: "En deux appels : {\"dryRun\": true} (ou ?dryRun=true) renvoie un token de confirmation, " +
+			"puis {\"confirm\": \"<token>\"} sauvegarde les profils et les supprime. Le compte admin configuré est recréé.",
+		Body: wipeRequest{}, OptionalBody: true,
+		Query: []apiParam{{Name: "dryRun", Type: "boolean", Description: "comme dryRun dans le corps"}},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "Avec dryRun : wipePreview, sinon wipeResponse", OneOf: []interface{}{wipePreview{}, wipeResponse{}}},
+			errorReply(http.StatusBadRequest, "Confirmation absente, invalide ou expirée"), replyStoreError},
+	},
+
+	"POST /api/createProfile":           legacy(opCreateProfile, "/api/v2/profiles", nil),
+	"GET /api/getAllUsers":              legacy(opListAllProfiles, "/api/v2/profiles", nil),
+	"POST /api/getAllUsersState":        legacy(opListAllProfiles, "/api/v2/profiles", userTypeRequest{}),
+	"POST /api/getUserProfile":          legacy(opGetProfile, "/api/v2/profiles/{email}", emailRequest{}),
+	"PUT /api/updateProfile":            legacy(opUpdateProfile, "/api/v2/profiles/{email}", nil),
+	"DELETE /api/deleteProfile":         legacy(opDeleteProfile, "/api/v2/profiles/{email}", emailRequest{}),
+	"DELETE /api/deleteProfile/{email}": legacy(opDeleteProfile, "/api/v2/profiles/{email}", nil),
+	"POST /api/uploadProfileImage": legacy(opPutImage, "/api/v2/profiles/{email}/image", nil, imageForm,
+		apiParam{Name: "email", Type: "string", Required: true, Description: "profil visé"}),
+	"POST /api/getProfileImage":                  legacy(opGetImage, "/api/v2/profiles/{email}/image", emailRequest{}),
+	"GET,HEAD /api/profiles/{email}/image":       legacy(opGetImage, "/api/v2/profiles/{email}/image", nil),
+	"GET /api/profiles/{email}/images":           legacy(opListGallery, "/api/v2/profiles/{email}/images", nil),
+	"POST /api/profiles/{email}/images":          legacy(opAddGallery, "/api/v2/profiles/{email}/images", nil),
+	"PUT /api/profiles/{email}/images/order":     legacy(opReorderGallery, "/api/v2/profiles/{email}/images/order", nil),
+	"GET,HEAD /api/profiles/{email}/images/{id}": legacy(opGetGalleryImage, "/api/v2/profiles/{email}/images/{id}", nil),
+	"PATCH /api/profiles/{email}/images/{id}":    legacy(opUpdateGalleryImage, "/api/v2/profiles/{email}/images/{id}", nil),
+	"DELETE /api/profiles/{email}/images/{id}":   legacy(opDeleteGalleryImage, "/api/v2/profiles/{email}/images/{id}", nil),
+	"POST /api/createHtmlPage": legacy(apiOperation{
+		Summary: "Écriture de la page HTML du profil dans html_pages sur le serveur", Access: accessModeratorSelf,
+		Responses: []apiResponse{messageReply(http.StatusOK, "Fichier créé"),
+			errorReply(http.StatusBadRequest, "Email inutilisable comme nom de fichier"), replyNotFound, replyStoreError},
+	}, "/profiles/{email}", emailRequest{}),
+
+	"GET /api/openapi.json": {
+		Summary: "Ce document", Tag: "documentation",
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "Spécification OpenAPI 3", ContentType: "application/json"}},
+	},
+	"GET /api/docs": {
+		Summary: "Documentation lisible de l'API", Tag: "documentation",
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "Page HTML", ContentType: "text/html"}},
+	},
+	"GET /api/docs/app.js": {
+		Summary: "Script de la documentation", Tag: "documentation",
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "Script", ContentType: "text/javascript"}},
+	},
+	"GET,HEAD /profiles/{email}": {
+		Summary: "Page HTML publique d'un profil actif", Tag: "pages",
+		Description: "Les images de la page sont liées avec un lien signé. Un profil inactif répond comme un profil inconnu.",
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "Page HTML", ContentType: "text/html"},
+			{Status: http.StatusNotFound, Description: "Profil inconnu ou inactif", ContentType: "text/plain"}},
+	},
+}
+
+// Ordre des groupes de routes dans la documentation
+var apiTags = []jsonObject{
+	{"name": "profils"}, {"name": "images"}, {"name": "galerie"}, {"name": "session"},
+	{"name": "administration"}, {"name": "pages"}, {"name": "documentation"},
+	{"name": "anciennes routes", "description": "Remplacées par les routes /api/v2, toujours disponibles"},
+}
+
+// Document JSON, construit avec des maps : encoding/json trie leurs clés, le document est stable
+type jsonObject = map[string]interface{}
+
+var pathParameter = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// buildOpenAPI parcourt les routes du routeur et construit le document à partir de leurs entrées.
+// problems liste les routes sans entrée et les entrées sans route.
+func buildOpenAPI(router *mux.Router, operations map[string]apiOperation) (jsonObject, []string) {
+	schemas := schemaSet{}
+	paths := jsonObject{}
+	used := make(map[string]bool)
+	var problems []string
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil // préfixes des sous-routeurs, qui n'ont pas de méthode
+		}
+		sort.Strings(methods)
+		key := strings.Join(methods, ",") + " " + template
+		op, ok := operations[key]
+		if !ok {
+			problems = append(problems, "route sans entrée dans la spécification : "+key)
+			return nil
+		}
+		used[key] = true
+
+		path := pathParameter.ReplaceAllString(template, "{$1}")
+		item, _ := paths[path].(jsonObject)
+		if item == nil {
+			item = jsonObject{}
+			paths[path] = item
+		}
+		for _, method := range methods {
+			item[strings.ToLower(method)] = op.document(method, template, schemas)
+		}
+		return nil
+	})
+
+	for key := range operations {
+		if !used[key] {
+			problems = append(problems, "entrée de la spécification sans route : "+key)
+		}
+	}
+	sort.Strings(problems)
+
+	doc := jsonObject{
+		"openapi": "3.0.3",
+		"info": jsonObject{
+			"title":   "CRUD_Application",
+			"version": "2",
+			"description": "Profils utilisateurs, avatars et galeries d'images. Les erreurs sont renvoyées sous la forme " +
+				"{\"Erreur\": \"...\"}. Les anciennes routes sont dépréciées : leurs réponses ont les headers Deprecation et Link.",
+		},
+		"tags":  apiTags,
+		"paths": paths,
+		"components": jsonObject{
+			"schemas": schemas,
+			"securitySchemes": jsonObject{
+				"session": jsonObject{"type": "http", "scheme": "bearer", "description": "token renvoyé par POST /api/login"},
+				"imageLink": jsonObject{"type": "apiKey", "in": "query", "name": "sig",
+					"description": "lien signé des images des pages de profil, valable pour un seul profil"},
+			},
+		},
+	}
+	return doc, problems
+}
+
+// document renvoie l'objet Operation de la route pour une de ses méthodes
+func (op apiOperation) document(method, template string, schemas schemaSet) jsonObject {
+	doc := jsonObject{
+		"operationId": operationID(method, template),
+		"summary":     op.Summary,
+	}
+	if op.Tag != "" {
+		doc["tags"] = []string{op.Tag}
+	}
+
+	var description []string
+	if op.Description != "" {
+		description = append(description, op.Description)
+	}
+	if op.Access != "" {
+		description = append(description, "Accès : "+op.Access+".")
+	}
+	if op.Successor != "" {
+		description = append(description, "Dépréciée, remplacée par "+op.Successor+".")
+		doc["deprecated"] = true
+	}
+	if len(description) > 0 {
+		doc["description"] = strings.Join(description, "\n\n")
+	}
+
+	var params []jsonObject
+	for _, match := range pathParameter.FindAllStringSubmatch(template, -1) {
+		params = append(params, jsonObject{"name": match[1], "in": "path", "required": true, "schema": jsonObject{"type": "string"}})
+	}
+	for _, param := range op.Query {
+		params = append(params, jsonObject{"name": param.Name, "in": "query", "required": param.Required,
+			"description": param.Description, "schema": paramSchema(param.Type)})
+	}
+	if len(params) > 0 {
+		doc["parameters"] = params
+	}
+
+	head := method == http.MethodHead
+	if !head && op.Body != nil {
+		doc["requestBody"] = jsonObject{"required": !op.OptionalBody, "content": jsonObject{
+			"application/json": jsonObject{"schema": schemas.of(reflect.TypeOf(op.Body))},
+		}}
+	}
+	if !head && len(op.Form) > 0 {
+		properties := jsonObject{}
+		var required []string
+		for _, field := range op.Form {
+			schema := paramSchema(field.Type)
+			schema["description"] = field.Description
+			properties[field.Name] = schema
+			if field.Required {
+				required = append(required, field.Name)
+			}
+		}
+		form := jsonObject{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			form["required"] = required
+		}
+		doc["requestBody"] = jsonObject{"required": true, "content": jsonObject{"multipart/form-data": jsonObject{"schema": form}}}
+	}
+	if !head && op.BodyTypes != "" {
+		content := jsonObject{}
+		for _, contentType := range strings.Split(op.BodyTypes, ", ") {
+			content[contentType] = jsonObject{"schema": jsonObject{"type": "string"}}
+		}
+		doc["requestBody"] = jsonObject{"required": true, "content": content}
+	}
+
+	responses := jsonObject{}
+	for _, reply := range op.Responses {
+		responses[strconv.Itoa(reply.Status)] = reply.document(head, schemas)
+	}
+	if op.Access != "" {
+		for _, reply := range []apiResponse{
+			errorReply(http.StatusUnauthorized, "Authentification requise, ou token invalide ou expiré"),
+			errorReply(http.StatusForbidden, "Accès refusé"),
+		} {
+			if _, ok := responses[strconv.Itoa(reply.Status)]; !ok {
+				responses[strconv.Itoa(reply.Status)] = reply.document(head, schemas)
+			}
+		}
+		security := []jsonObject{{"session": []string{}}}
+		if op.SignedLink {
+			security = append(security, jsonObject{"imageLink": []string{}})
+		}
+		doc["security"] = security
+	}
+	doc["responses"] = responses
+	return doc
+}
+
+func (reply apiResponse) document(head bool, schemas schemaSet) jsonObject {
+	doc := jsonObject{"description": reply.Description}
+	if head {
+		return doc // les réponses à HEAD n'ont pas de corps
+	}
+	switch {
+	case len(reply.OneOf) > 0:
+		var alternatives []jsonObject
+		for _, body := range reply.OneOf {
+			alternatives = append(alternatives, schemas.of(reflect.TypeOf(body)))
+		}
+		doc["content"] = jsonObject{"application/json": jsonObject{"schema": jsonObject{"oneOf": alternatives}}}
+	case reply.Body != nil:
+		doc["content"] = jsonObject{"application/json": jsonObject{"schema": schemas.of(reflect.TypeOf(reply.Body))}}
+	case reply.ContentType == "application/json":
+		doc["content"] = jsonObject{reply.ContentType: jsonObject{"schema": jsonObject{"type": "object"}}}
+	case reply.ContentType != "":
+		content := jsonObject{}
+		for _, contentType := range strings.Split(reply.ContentType, ", ") {
+			schema := jsonObject{"type": "string"}
+			if strings.HasPrefix(contentType, "image/") {
+				schema["format"] = "binary"
+			}
+			content[contentType] = jsonObject{"schema": schema}
+		}
+		doc["content"] = content
+	}
+	return doc
+}
+
+func paramSchema(kind string) jsonObject {
+	if kind == "binary" {
+		return jsonObject{"type": "string", "format": "binary"}
+	}
+	return jsonObject{"type": kind}
+}
+
+// operationID donne un identifiant stable à partir de la route, ex : getApiV2ProfilesEmailImage
+func operationID(method, template string) string {
+	id := strings.ToLower(method)
+	for _, segment := range strings.FieldsFunc(pathParameter.ReplaceAllString(template, "$1"), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) {
+		id += strings.ToUpper(segment[:1]) + segment[1:]
+	}
+	return id
+}
+
+// Schémas des types nommés, dans components/schemas
+type schemaSet map[string]interface{}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// of renvoie le schéma d'un type Go, tel que encoding/json l'encode.
+// Les structs nommées sont ajoutées aux composants et référencées par leur nom Go.
+func (s schemaSet) of(t reflect.Type) jsonObject {
+	if t == timeType {
+		return jsonObject{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.of(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = jsonObject{} // réservé avant les champs, pour les types récursifs
+			s[t.Name()] = s.object(t)
+		}
+		return jsonObject{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonObject{"type": "string", "format": "byte"}
+		}
+		return jsonObject{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	}
+	return jsonObject{} // interface{} : n'importe quelle valeur
+}
+
+func (s schemaSet) object(t reflect.Type) jsonObject {
+	properties := jsonObject{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.of(field.Type)
+	}
+	return jsonObject{"type": "object", "properties": properties}
+}
+
+// Spécification servie par l'API, construite une fois toutes les routes enregistrées
+type apiDocs struct {
+	spec []byte
+}
+
+// build construit le document à partir du routeur. Une route sans entrée est signalée sans empêcher
+// le démarrage : "./main openapi --check" et la suite de conformité, eux, échouent.
+func (d *apiDocs) build(router *mux.Router) {
+	doc, problems := buildOpenAPI(router, apiOperations)
+	for _, problem := range problems {
+		log.Println("ATTENTION : OpenAPI :", problem)
+	}
+	spec, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		log.Println("ERREUR : OpenAPI :", err)
+		return
+	}
+	d.spec = spec
+}
+
+func (d *apiDocs) ServeSpec(w http.ResponseWriter, r *http.Request) {
+	if d.spec == nil {
+		writeError(w, http.StatusInternalServerError, "Spécification indisponible")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(d.spec)
+}
+
+// La page de documentation lit /api/openapi.json avec son script, sans aucune ressource externe
+
+func (d *apiDocs) ServeUI(w http.ResponseWriter, r *http.Request) {
+	serveDocsFile(w, "docs/index.html", "text/html; charset=utf-8")
+}
+
+func (d *apiDocs) ServeScript(w http.ResponseWriter, r *http.Request) {
+	serveDocsFile(w, "docs/app.js", "text/javascript; charset=utf-8")
+}
+
+func serveDocsFile(w http.ResponseWriter, name, contentType string) {
+	data, err := embeddedDocs.ReadFile(name)
+	if err != nil {
+		http.Error(w, "Fichier introuvable", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'self'; connect-src 'self'; style-src 'unsafe-inline'")
+	w.Write(data)
+}
+
+// openAPIProblems construit le routeur de l'API sur un backend en mémoire et renvoie les routes sans entrée
+// dans la spécification et les entrées sans route
+func openAPIProblems(cfg config) []string {
+	_, problems := buildOpenAPI(newRouter(cfg, newMemoryStore(), nil), apiOperations)
+	return problems
+}
+
+// Sous-commande "openapi" : écrit la spécification sur la sortie standard.
+// Avec --check, vérifie seulement que chaque route a son entrée.
+//
+//	./main openapi > openapi.json
+//	./main openapi --check
+func runOpenAPI(args []string) int {
+	var cfg config
+	fs := configFlagSet("openapi", &cfg)
+	check := fs.Bool("check", false, "échoue si une route n'a pas d'entrée dans la spécification, ou une entrée pas de route")
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	doc, problems := buildOpenAPI(newRouter(cfg, newMemoryStore(), nil), apiOperations)
+	if *check {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "ERREUR :", problem)
+		}
+		if len(problems) > 0 {
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, "Spécification OpenAPI : toutes les routes sont décrites")
+		return 0
+	}
+
+	for _, problem := range problems {
+		log.Println("ATTENTION :", problem)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(doc)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+	return 0
+}
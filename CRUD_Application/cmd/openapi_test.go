@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+// Chaque route du routeur doit avoir son entrée dans la spécification, et chaque entrée sa route
+func TestOpenAPICoversRoutes(t *testing.T) {
+	var cfg config
+	fs := configFlagSet("openapi", &cfg)
+	err := fs.Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, problem := range openAPIProblems(cfg) {
+		t.Error(problem)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pages HTML des profils : GET /profiles/{email}
+//
+// Les pages sont rendues avec html/template, qui échappe tout ce qui vient des profils (email, légendes).
+// Le dossier des templates (--template-dir, ceux intégrés au binaire par défaut) contient :
+//
+//	layouts/*.html   squelette commun, doit définir "base" qui appelle "title" et "content"
+//	partials/*.html  morceaux réutilisables ("avatar", "gallery", "pagination")
+//	pages/*.html     une page par fichier, qui définit "title" et "content" : profile.html, et index.html
+//	                 pour l'export statique (sous-commande "export")
+//
+// Un navigateur n'envoie pas de header Authorization pour une balise <img> : les images de la page
+// pointent vers les routes de l'API avec un lien signé (?sig=...), valable uniquement pour ce profil.
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// Durée de validité des liens d'images signés
+const imageLinkTTL = time.Hour
+
+// Usage (typ) des liens d'images : un lien ne sert pas de token de session, et un token de session
+// ne sert pas de lien d'image
+const imageLinkType = "image-link"
+
+// Templates des pages, indexés par nom de fichier sans extension (ex : "profile")
+type pageTemplates map[string]*template.Template
+
+// loadPageTemplates lit les templates du dossier, ou ceux intégrés au binaire si dir est vide
+func loadPageTemplates(dir string) (pageTemplates, error) {
+	var files fs.FS
+	if dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("templates : dossier %s introuvable", dir)
+		}
+		files = os.DirFS(dir)
+	} else {
+		files, _ = fs.Sub(embeddedTemplates, "templates")
+	}
+
+	shared := template.New("")
+	for _, pattern := range []string{"layouts/*.html", "partials/*.html"} {
+		matches, err := fs.Glob(files, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		shared, err = shared.ParseFS(files, matches...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if shared.Lookup("base") == nil {
+		return nil, fmt.Errorf("templates : aucun layout ne définit \"base\"")
+	}
+
+	pages, err := fs.Glob(files, "pages/*.html")
+	if err != nil {
+		return nil, err
+	}
+	templates := make(pageTemplates, len(pages))
+	for _, page := range pages {
+		t, err := shared.Clone()
+		if err != nil {
+			return nil, err
+		}
+		t, err = t.ParseFS(files, page)
+		if err != nil {
+			return nil, err
+		}
+		templates[strings.TrimSuffix(path.Base(page), ".html")] = t
+	}
+	if _, ok := templates["profile"]; !ok {
+		return nil, fmt.Errorf("templates : pages/profile.html manquant")
+	}
+	return templates, nil
+}
+
+// render exécute la page dans le layout "base". La page est rendue en entier avant d'être renvoyée,
+// pour pouvoir encore répondre une erreur 500 si un template échoue.
+func (p pageTemplates) render(name string, data interface{}) ([]byte, error) {
+	t, ok := p[name]
+	if !ok {
+		return nil, fmt.Errorf("page %q inconnue", name)
+	}
+	var buf bytes.Buffer
+	err := t.ExecuteTemplate(&buf, "base", data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Données passées au template d'une page de profil. Le mot de passe n'y est jamais.
+type profilePage struct {
+	Email    string
+	State    bool
+	UserType int
+	Role     string
+	Avatar   *pageImage
+	Gallery  []pageImage
+	Home     string // lien vers l'index des profils, vide hors de l'export statique
+}
+
+// Image d'une page : URL de l'image entière et de la miniature affichée
+type pageImage struct {
+	URL       string
+	Thumbnail string
+	Caption   string
+	Primary   bool
+}
+
+// imageLink donne l'URL d'une image du profil : id vide pour l'avatar, size vide pour l'original
+type imageLink func(id, size string) string
+
+func newProfilePage(profile Profile, gallery []GalleryImage, avatar ProfileImage, thumbnail string, link imageLink) profilePage {
+	page := profilePage{
+		Email:    profile.Email,
+		State:    profile.State,
+		UserType: profile.UserType,
+		Role:     profileRole(profile).String(),
+	}
+	if avatar.Key != "" || len(avatar.Data) > 0 {
+		page.Avatar = &pageImage{URL: link("", ""), Thumbnail: link("", thumbnail), Caption: "Avatar de " + profile.Email, Primary: true}
+	}
+	for _, entry := range gallery {
+		page.Gallery = append(page.Gallery, pageImage{
+			URL:       link(entry.ID, ""),
+			Thumbnail: link(entry.ID, thumbnail),
+			Caption:   entry.Caption,
+			Primary:   avatar.GalleryID == entry.ID,
+		})
+	}
+	return page
+}
+
+// pageThumbnail choisit la plus grande variante pour les miniatures des pages, l'original s'il n'y en a pas
+func pageThumbnail(sizes []int) string {
+	if len(sizes) == 0 {
+		return ""
+	}
+	return variantName(sizes[len(sizes)-1])
+}
+
+// apiImageLink renvoie les URLs des routes d'images de l'API, avec sig en paramètre s'il n'est pas vide
+func apiImageLink(email, sig string) imageLink {
+	return func(id, size string) string {
+		link := "/api/v2/profiles/" + url.PathEscape(email) + "/image"
+		if id != "" {
+			link = "/api/v2/profiles/" + url.PathEscape(email) + "/images/" + url.PathEscape(id)
+		}
+		query := url.Values{}
+		if size != "" {
+			query.Set("size", size)
+		}
+		if sig != "" {
+			query.Set("sig", sig)
+		}
+		if len(query) > 0 {
+			link += "?" + query.Encode()
+		}
+		return link
+	}
+}
+
+func (a *apiHandlers) imageLinks() *tokenIssuer {
+	return &tokenIssuer{secret: a.tokens.secret, ttl: imageLinkTTL, typ: imageLinkType}
+}
+
+// signImageLink signe un lien vers les images du profil. L'heure est arrondie à la demi-période :
+// la même signature est réutilisée pendant une demi-heure, le navigateur peut garder les images en cache,
+// et un lien reste valable au moins une demi-heure après l'affichage de la page.
+func (a *apiHandlers) signImageLink(email string, now time.Time) (string, error) {
+	token, _, err := a.imageLinks().Issue(email, now.Truncate(imageLinkTTL/2))
+	return token, err
+}
+
+// signedImageOr laisse passer les requêtes qui portent un lien signé pour le profil de l'url (?sig=...),
+// les autres passent par la policy comme pour le reste de l'API
+func (a *apiHandlers) signedImageOr(p policy, next http.HandlerFunc) http.HandlerFunc {
+	protected := authorize(p, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		sig := r.URL.Query().Get("sig")
+		if sig == "" {
+			protected(w, r)
+			return
+		}
+		claims, err := a.imageLinks().Verify(sig, time.Now())
+		if err != nil || claims.Subject != mux.Vars(r)["email"] {
+			writeError(w, http.StatusForbidden, "Lien d'image invalide ou expiré")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// loadProfilePage lit le profil et sa galerie et prépare les données de sa page
+func (a *apiHandlers) loadProfilePage(ctx context.Context, email string, link imageLink) (profilePage, error) {
+	profile, err := a.store.GetProfile(ctx, email)
+	if err != nil {
+		return profilePage{}, err
+	}
+	gallery, avatar, err := a.images.Gallery(ctx, email)
+	if err != nil {
+		return profilePage{}, err
+	}
+	return newProfilePage(profile, gallery, avatar, pageThumbnail(a.variantSizes()), link), nil
+}
+
+// Page publique d'un profil. Seuls les profils actifs (state à true) sont publiés,
+// les autres répondent comme un profil inconnu.
+
+func (a *apiHandlers) ProfilePage(w http.ResponseWriter, r *http.Request) {
+	if a.pages == nil {
+		http.Error(w, "Templates des pages indisponibles", http.StatusInternalServerError)
+		return
+	}
+
+	email := mux.Vars(r)["email"]
+	sig, err := a.signImageLink(email, time.Now())
+	if err != nil {
+		http.Error(w, "Impossible de signer les liens des images", http.StatusInternalServerError)
+		return
+	}
+
+	page, err := a.loadProfilePage(r.Context(), email, apiImageLink(email, sig))
+	if errors.Is(err, ErrProfileNotFound) || (err == nil && !page.State) {
+		http.Error(w, "Profil introuvable", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("ERREUR : page de", email, ":", err)
+		http.Error(w, "Erreur lors de la lecture du profil", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := a.pages.render("profile", page)
+	if err != nil {
+		log.Println("ERREUR : rendu de la page de", email, ":", err)
+		http.Error(w, "Erreur lors du rendu de la page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Défense en profondeur : même un contenu mal échappé par un template modifié ne peut pas lancer de script
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(body)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Liste paginée des profils : GET /api/v2/profiles
+//
+//	?limit=50          taille de la page, de 1 à 500
+//	?sort=-createdAt   "email" (par défaut) ou "createdAt", "-" devant pour l'ordre décroissant
+//	?state=true        filtre sur l'état
+//	?userType=2        filtre sur le type, combinable avec state
+//	?cursor=...        le champ "next" de la page précédente, avec les mêmes sort, state et userType
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Réponse de la liste paginée. Next est absent sur la dernière page.
+type profileListResponse struct {
+	Profiles []Profile `json:"profiles"`
+	Next     string    `json:"next,omitempty"`
+}
+
+// Contenu du token "next" : la position dans la liste, et la requête qui l'a produite pour refuser
+// un token réutilisé avec d'autres filtres ou un autre tri. Le token est opaque pour le client.
+type pageToken struct {
+	Sort       string `json:"sort"`
+	Descending bool   `json:"desc,omitempty"`
+	State      *bool  `json:"state,omitempty"`
+	UserType   *int   `json:"userType,omitempty"`
+	Email      string `json:"email,omitempty"`
+	CreatedAt  int64  `json:"createdAt,omitempty"`
+}
+
+func encodePageToken(query ProfileQuery, cursor *ProfileCursor) string {
+	token := pageToken{
+		Sort:       query.Sort,
+		Descending: query.Descending,
+		State:      query.State,
+		UserType:   query.UserType,
+		Email:      cursor.Email,
+		CreatedAt:  cursor.CreatedAt,
+	}
+	data, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageToken renvoie la position du token, s'il a été produit par la même requête
+func decodePageToken(value string, query ProfileQuery) (*ProfileCursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false
+	}
+	var token pageToken
+	err = json.Unmarshal(data, &token)
+	if err != nil {
+		return nil, false
+	}
+
+	sameQuery := token.Sort == query.Sort && token.Descending == query.Descending &&
+		reflect.DeepEqual(token.State, query.State) && reflect.DeepEqual(token.UserType, query.UserType)
+	if !sameQuery {
+		return nil, false
+	}
+	return &ProfileCursor{Email: token.Email, CreatedAt: token.CreatedAt}, true
+}
+
+// parseProfileQuery lit les paramètres de la liste, l'erreur est le message renvoyé au client
+func parseProfileQuery(r *http.Request) (ProfileQuery, string) {
+	values := r.URL.Query()
+	query := ProfileQuery{Sort: sortByEmail, Limit: defaultPageSize}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return query, "limit doit être un entier entre 1 et " + strconv.Itoa(maxPageSize)
+		}
+		query.Limit = limit
+	}
+
+	problem := parseProfileFilters(values, &query)
+	if problem != "" {
+		return query, problem
+	}
+
+	if value := values.Get("cursor"); value != "" {
+		after, ok := decodePageToken(value, query)
+		if !ok {
+			return query, "Curseur invalide"
+		}
+		query.After = after
+	}
+	return query, ""
+}
+
+// parseProfileFilters lit le tri et les filtres, communs à la liste et à l'export
+func parseProfileFilters(values url.Values, query *ProfileQuery) string {
+	if value := values.Get("sort"); value != "" {
+		query.Descending = strings.HasPrefix(value, "-")
+		query.Sort = strings.TrimPrefix(value, "-")
+		if query.Sort != sortByEmail && query.Sort != sortByCreated {
+			return "sort doit être email ou createdAt, précédé de - pour l'ordre décroissant"
+		}
+	}
+
+	if value := values.Get("state"); value != "" {
+		state, err := strconv.ParseBool(value)
+		if err != nil {
+			return "state doit être true ou false"
+		}
+		query.State = &state
+	}
+
+	if value := values.Get("userType"); value != "" {
+		userType, err := strconv.Atoi(value)
+		if err != nil {
+			return "userType doit être un entier"
+		}
+		query.UserType = &userType
+	}
+	return ""
+}
+
+// Récupération d'une page de profils. Les anciennes routes getAllUsers et getAllUsersState renvoient
+// toujours la liste complète (GetAllUsers, GetAllUsersType).
+
+func (a *apiHandlers) ListProfiles(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	query, problem := parseProfileQuery(r)
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+
+	page, err := a.store.ListProfilesPage(r.Context(), query)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	response := profileListResponse{Profiles: nonNilProfiles(page.Profiles)}
+	if page.Next != nil {
+		response.Next = encodePageToken(query, page.Next)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testPagedProfiles crée des profils créés à des dates connues, dans un ordre différent de celui des emails
+func testPagedProfiles(t *testing.T, store ProfileStore) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, email := range []string{"d@example.com", "b@example.com", "e@example.com", "a@example.com", "c@example.com"} {
+		profile := testProfile(email)
+		profile.CreatedAt = base.Add(time.Duration(i) * time.Hour)
+		profile.State = i%2 == 0
+		if email == "e@example.com" {
+			profile.UserType = int(roleAdmin)
+		}
+		err := store.CreateProfile(context.Background(), profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testAllPages suit les curseurs jusqu'à la dernière page et renvoie les emails dans l'ordre
+func testAllPages(t *testing.T, store ProfileStore, query ProfileQuery) []string {
+	var emails []string
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("trop de pages, le curseur n'avance pas")
+		}
+		page, err := store.ListProfilesPage(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Profiles) > query.Limit {
+			t.Fatalf("page de %d profils, au plus %d attendus", len(page.Profiles), query.Limit)
+		}
+		for _, profile := range page.Profiles {
+			if profile.Password != "" {
+				t.Errorf("hash du mot de passe de %s renvoyé dans la page", profile.Email)
+			}
+			emails = append(emails, profile.Email)
+		}
+		if page.Next == nil {
+			return emails
+		}
+		query.After = page.Next
+	}
+}
+
+func TestListProfilesPage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		testPagedProfiles(t, store)
+		active, admin := true, int(roleAdmin)
+
+		tests := []struct {
+			name  string
+			query ProfileQuery
+			want  []string
+		}{
+			{"par email", ProfileQuery{Sort: sortByEmail, Limit: 2},
+				[]string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}},
+			{"par email décroissant", ProfileQuery{Sort: sortByEmail, Descending: true, Limit: 2},
+				[]string{"e@example.com", "d@example.com", "c@example.com", "b@example.com", "a@example.com"}},
+			{"par date", ProfileQuery{Sort: sortByCreated, Limit: 3},
+				[]string{"d@example.com", "b@example.com", "e@example.com", "a@example.com", "c@example.com"}},
+			{"par date décroissante", ProfileQuery{Sort: sortByCreated, Descending: true, Limit: 5},
+				[]string{"c@example.com", "a@example.com", "e@example.com", "b@example.com", "d@example.com"}},
+			{"filtre sur l'état", ProfileQuery{Sort: sortByEmail, State: &active, Limit: 1},
+				[]string{"c@example.com", "d@example.com", "e@example.com"}},
+			{"filtres combinés", ProfileQuery{Sort: sortByCreated, State: &active, UserType: &admin, Limit: 1},
+				[]string{"e@example.com"}},
+		}
+		for _, test := range tests {
+			if got := testAllPages(t, store, test.query); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s : %v, %v attendu", test.name, got, test.want)
+			}
+		}
+	})
+}
+
+// Le curseur d'une page ne sert qu'avec le tri et les filtres qui l'ont produit
+func TestPageTokenRejectsOtherQuery(t *testing.T) {
+	active := true
+	query := ProfileQuery{Sort: sortByCreated, State: &active, Limit: 10}
+	token := encodePageToken(query, &ProfileCursor{Email: "a@example.com", CreatedAt: 42})
+
+	after, ok := decodePageToken(token, query)
+	if !ok || after.Email != "a@example.com" || after.CreatedAt != 42 {
+		t.Fatalf("decodePageToken(même requête) = %+v, %v", after, ok)
+	}
+	for _, other := range []ProfileQuery{
+		{Sort: sortByEmail, State: &active},
+		{Sort: sortByCreated, Descending: true, State: &active},
+		{Sort: sortByCreated},
+	} {
+		if _, ok := decodePageToken(token, other); ok {
+			t.Errorf("curseur accepté pour une autre requête : %+v", other)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/v2/profiles?sort=-createdAt&cursor="+token, nil)
+	if _, problem := parseProfileQuery(req); problem == "" {
+		t.Error("curseur accepté avec un autre tri")
+	}
+}
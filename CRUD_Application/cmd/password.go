@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Changement de mot de passe par l'utilisateur connecté, l'ancien mot de passe est demandé
+
+type changePasswordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+func (a *apiHandlers) ChangePassword(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var body changePasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Erreur lors de la lecture du corps de la requête")
+		return
+	}
+	if body.NewPassword == "" {
+		writeError(w, http.StatusBadRequest, "Nouveau mot de passe manquant")
+		return
+	}
+
+	caller, _ := currentProfile(r.Context())
+	match, _, err := a.passwords.Verify(caller.Password, body.OldPassword)
+	if err != nil {
+		log.Println("ERREUR : vérification du mot de passe de", caller.Email, ":", err)
+	}
+	if !match {
+		writeError(w, http.StatusForbidden, "Ancien mot de passe incorrect")
+		return
+	}
+
+	if !a.setPassword(w, r, caller.Email, body.NewPassword) {
+		return
+	}
+
+	log.Println("Mot de passe changé : ", caller.Email)
+	writeMessage(w, http.StatusOK, "Mot de passe changé")
+}
+
+// Demande de réinitialisation : un token à usage unique est envoyé par le notifier.
+// La réponse est la même que l'email existe ou non, pour ne pas révéler les comptes existants.
+
+func (a *apiHandlers) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	email, ok := decodeEmail(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.sendPasswordReset(r, email)
+	if err != nil {
+		// On log l'erreur sans la renvoyer, la réponse ne doit pas dépendre de l'existence du compte
+		log.Println("ERREUR : réinitialisation du mot de passe de", email, ":", err)
+	}
+
+	writeMessage(w, http.StatusAccepted, "Si le compte existe, un lien de réinitialisation a été envoyé")
+}
+
+func (a *apiHandlers) sendPasswordReset(r *http.Request, email string) error {
+	_, err := a.store.GetProfile(r.Context(), email)
+	if errors.Is(err, ErrProfileNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := newResetToken()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(a.cfg.ResetTokenTTL)
+	err = a.store.CreatePasswordReset(r.Context(), PasswordReset{
+		TokenHash: hashResetToken(token),
+		Email:     email,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return a.notifier.Notify(r.Context(), Notification{
+		Kind:    "password-reset",
+		To:      email,
+		Subject: "Réinitialisation de votre mot de passe",
+		Body: "Pour choisir un nouveau mot de passe, envoyez ce token à POST /api/resetPassword avant le " +
+			expiresAt.UTC().Format(time.RFC3339) + " :\n" + token,
+		Data: map[string]string{
+			"token":     token,
+			"expiresAt": expiresAt.UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+// Réinitialisation du mot de passe avec le token reçu, qui ne peut servir qu'une fois
+
+type resetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+func (a *apiHandlers) ResetPassword(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var body resetPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Erreur lors de la lecture du corps de la requête")
+		return
+	}
+	if body.NewPassword == "" {
+		writeError(w, http.StatusBadRequest, "Nouveau mot de passe manquant")
+		return
+	}
+
+	// Le token est consommé avant la vérification de l'expiration : un token expiré ne resservira pas non plus
+	reset, err := a.store.ConsumePasswordReset(r.Context(), hashResetToken(body.Token))
+	if errors.Is(err, ErrResetNotFound) || (err == nil && !time.Now().Before(reset.ExpiresAt)) {
+		writeError(w, http.StatusBadRequest, "Token de réinitialisation invalide ou expiré")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	if !a.setPassword(w, r, reset.Email, body.NewPassword) {
+		return
+	}
+
+	log.Println("Mot de passe réinitialisé : ", reset.Email)
+	writeMessage(w, http.StatusOK, "Mot de passe réinitialisé")
+}
+
+// setPassword hash et enregistre le nouveau mot de passe, écrit l'erreur et renvoie false en cas d'échec
+func (a *apiHandlers) setPassword(w http.ResponseWriter, r *http.Request, email, password string) bool {
+	hash, err := a.passwords.Hash(password)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Erreur lors du hashage du mot de passe")
+		return false
+	}
+
+	err = a.store.UpdateProfilePassword(r.Context(), email, hash, time.Now())
+	if err != nil {
+		writeStoreError(w, err)
+		return false
+	}
+	return true
+}
+
+// newResetToken génère un token aléatoire de 256 bits
+func newResetToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// hashResetToken donne la clé stockée en base : une fuite de la base ne donne pas de token utilisable
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testServer démarre l'API sur le store avec la configuration par défaut et un hash bcrypt rapide
+func testServer(t *testing.T, store ProfileStore) (*httptest.Server, config) {
+	var cfg config
+	err := configFlagSet("test", &cfg).Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PasswordHash = hashBcrypt
+	cfg.BcryptCost = bcrypt.MinCost
+	cfg.TokenSecret = "secret de test"
+
+	blobs, err := newFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newRouter(cfg, store, blobs))
+	t.Cleanup(server.Close)
+	return server, cfg
+}
+
+// testUser crée un profil utilisateur avec ce mot de passe
+func testUser(t *testing.T, store ProfileStore, cfg config, email, password string) {
+	hash, err := newPasswordHashing(cfg).Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := testProfile(email)
+	profile.Password = hash
+	err = store.CreateProfile(context.Background(), profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRequest envoie body en JSON avec le token de session s'il y en a un, et décode la réponse dans out
+func testRequest(t *testing.T, server *httptest.Server, method, path, token string, body, out interface{}) int {
+	var payload bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&payload).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, server.URL+path, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func testLogin(t *testing.T, server *httptest.Server, email, password string) string {
+	var session sessionResponse
+	status := testRequest(t, server, "POST", "/api/login", "", loginRequest{Email: email, Password: password}, &session)
+	if status != http.StatusOK || session.Token == "" {
+		t.Fatalf("connexion de %s : statut %d", email, status)
+	}
+	return session.Token
+}
+
+// Un token émis juste avant le changement de mot de passe, dans la même seconde, est révoqué
+func TestChangePasswordRevokesSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		server, cfg := testServer(t, store)
+		testUser(t, store, cfg, "user@example.com", "ancien")
+
+		old := testLogin(t, server, "user@example.com", "ancien")
+		status := testRequest(t, server, "POST", "/api/changePassword", old,
+			changePasswordRequest{OldPassword: "ancien", NewPassword: "nouveau"}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("changement du mot de passe : statut %d", status)
+		}
+
+		if status := testRequest(t, server, "GET", "/api/me", old, nil, nil); status != http.StatusUnauthorized {
+			t.Errorf("ancien token après le changement : statut %d, 401 attendu", status)
+		}
+		current := testLogin(t, server, "user@example.com", "nouveau")
+		if status := testRequest(t, server, "GET", "/api/me", current, nil, nil); status != http.StatusOK {
+			t.Errorf("token émis après le changement : statut %d, 200 attendu", status)
+		}
+	})
+}
+
+// Un changement du mot de passe annule les réinitialisations en cours, un simple rehash les garde
+func TestUpdateProfilePasswordDeletesPendingResets(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		ctx := context.Background()
+		err := store.CreateProfile(ctx, testProfile("user@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tokenHash := range []string{"rehash", "changement"} {
+			err = store.CreatePasswordReset(ctx, PasswordReset{TokenHash: tokenHash, Email: "user@example.com", ExpiresAt: time.Now().Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = store.UpdateProfilePassword(ctx, "user@example.com", "rehash", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.ConsumePasswordReset(ctx, "rehash")
+		if err != nil {
+			t.Fatalf("réinitialisation après un rehash : %v, gardée attendue", err)
+		}
+
+		err = store.UpdateProfilePassword(ctx, "user@example.com", "nouveau", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.ConsumePasswordReset(ctx, "changement")
+		if !errors.Is(err, ErrResetNotFound) {
+			t.Errorf("réinitialisation après un changement : %v, ErrResetNotFound attendue", err)
+		}
+	})
+}
+
+
+// Les réinitialisations en cours partent avec le profil
+func TestDeleteProfileDeletesPendingResets(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		ctx := context.Background()
+		err := store.CreateProfile(ctx, testProfile("user@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.CreatePasswordReset(ctx, PasswordReset{TokenHash: "demande", Email: "user@example.com", ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.DeleteProfile(ctx, "user@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.ConsumePasswordReset(ctx, "demande")
+		if !errors.Is(err, ErrResetNotFound) {
+			t.Errorf("réinitialisation après la suppression du profil : %v, ErrResetNotFound attendue", err)
+		}
+	})
+}
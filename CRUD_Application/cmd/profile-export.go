@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export de tous les profils : GET /api/profiles/export?format=ndjson|csv
+//
+// Les filtres et le tri sont ceux de la liste paginée (state, userType, sort). Les profils sont lus
+// avec le curseur du backend (StreamProfiles) et envoyés au fur et à mesure : la mémoire utilisée
+// ne dépend pas du nombre de profils.
+// Les hash des mots de passe et les images ne sont jamais exportés.
+//
+// En CSV, une cellule qui commence par = + - @, une tabulation ou un retour chariot est précédée
+// d'une apostrophe : un tableur l'affiche comme du texte au lieu de l'exécuter comme une formule.
+
+// Nombre de lignes entre deux envois au client
+const exportFlushRows = 500
+
+// Colonnes de l'export CSV, dans l'ordre
+var exportCSVHeader = []string{"email", "state", "userType", "createdAt"}
+
+// exportWriter se souvient si des données sont parties vers le client : après, une erreur
+// ne peut plus changer le statut de la réponse
+type exportWriter struct {
+	w    http.ResponseWriter
+	sent bool
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	e.sent = true
+	return e.w.Write(p)
+}
+
+// exportFormat écrit une ligne par profil dans le tampon, flush vide le tampon vers le client
+type exportFormat struct {
+	contentType string
+	extension   string
+	row         func(Profile) error
+	flush       func() error
+}
+
+func newExportFormat(name string, out io.Writer) (exportFormat, bool) {
+	switch name {
+	case "", "ndjson":
+		buf := bufio.NewWriterSize(out, 64*1024)
+		enc := json.NewEncoder(buf)
+		return exportFormat{
+			contentType: "application/x-ndjson",
+			extension:   ".ndjson",
+			row:         func(p Profile) error { return enc.Encode(p) },
+			flush:       buf.Flush,
+		}, true
+	case "csv":
+		// csv.Writer a son propre tampon, l'en-tête y reste jusqu'au premier envoi
+		cw := csv.NewWriter(out)
+		cw.Write(exportCSVHeader)
+		return exportFormat{
+			contentType: "text/csv; charset=utf-8",
+			extension:   ".csv",
+			row:         func(p Profile) error { return cw.Write(exportCSVRow(p)) },
+			flush: func() error {
+				cw.Flush()
+				return cw.Error()
+			},
+		}, true
+	}
+	return exportFormat{}, false
+}
+
+// Date de création au format RFC 3339, vide quand elle est inconnue
+func exportCSVRow(p Profile) []string {
+	createdAt := ""
+	if !p.CreatedAt.IsZero() {
+		createdAt = p.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	row := []string{p.Email, strconv.FormatBool(p.State), strconv.Itoa(p.UserType), createdAt}
+	for i, cell := range row {
+		row[i] = csvSafeCell(cell)
+	}
+	return row
+}
+
+// Préfixe d'une apostrophe les cellules qu'un tableur prendrait pour une formule
+func csvSafeCell(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// Export des profils, mêmes droits que la liste : admin, ou moderator avec le filtre userType
+
+func (a *apiHandlers) ExportProfiles(w http.ResponseWriter, r *http.Request) {
+
+	query := ProfileQuery{Sort: sortByEmail}
+	problem := parseProfileFilters(r.URL.Query(), &query)
+	if problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+
+	out := &exportWriter{w: w}
+	format, ok := newExportFormat(r.URL.Query().Get("format"), out)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "format doit être ndjson ou csv")
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="profiles`+format.extension+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, _ := w.(http.Flusher)
+
+	rows := 0
+	err := a.store.StreamProfiles(r.Context(), query, func(p Profile) error {
+		err := format.row(p)
+		if err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			err = format.flush()
+			if err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = format.flush()
+	}
+	if err == nil {
+		return
+	}
+
+	if !out.sent {
+		w.Header().Del("Content-Disposition")
+		writeStoreError(w, err)
+		return
+	}
+	// Le statut 200 est déjà parti : on coupe la connexion pour que le client voie un export incomplet
+	// plutôt qu'un fichier tronqué qui aurait l'air complet
+	log.Println("ERREUR : export des profils interrompu après", rows, "lignes :", err)
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+// Une cellule qui commence comme une formule de tableur est exportée comme du texte
+func TestExportCSVRowNeutralisesFormulas(t *testing.T) {
+	cells := map[string]string{
+		"alice@example.com":          "alice@example.com",
+		"=HYPERLINK(\"x\")@evil.com": "'=HYPERLINK(\"x\")@evil.com",
+		"+33@example.com":            "'+33@example.com",
+		"-1@example.com":             "'-1@example.com",
+		"@sum@example.com":           "'@sum@example.com",
+		"\tcmd@example.com":          "'\tcmd@example.com",
+		"\rcmd@example.com":          "'\rcmd@example.com",
+	}
+	for email, want := range cells {
+		row := exportCSVRow(Profile{Email: email, State: true, UserType: int(roleUser)})
+		if row[0] != want {
+			t.Errorf("exportCSVRow(%q) : cellule %q, %q attendue", email, row[0], want)
+		}
+	}
+
+	// Les autres colonnes ne commencent jamais par un de ces caractères et restent lisibles
+	createdAt := time.Date(2026, 10, 18, 9, 12, 3, 0, time.UTC)
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(exportCSVRow(Profile{Email: "+1@example.com", State: false, UserType: int(roleAdmin), CreatedAt: createdAt}))
+	cw.Flush()
+	want := "'+1@example.com,false,3,2026-10-18T09:12:03Z\n"
+	if buf.String() != want {
+		t.Errorf("ligne CSV %q, %q attendue", buf.String(), want)
+	}
+}
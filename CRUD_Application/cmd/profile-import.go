@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Import de profils en masse : POST /api/profiles/import (admin) et la sous-commande "import".
+//
+// Le fichier est en CSV, avec une ligne d'en-tête (email et password obligatoires, state et userType
+// facultatifs, dans n'importe quel ordre), ou en NDJSON avec un objet par ligne, les mêmes champs que
+// POST /api/v2/profiles. Chaque ligne est validée : format de l'email, email en double dans le fichier
+// ou déjà utilisé, mot de passe présent, userType entre 1 et 3 (absent : user). Les mots de passe des
+// lignes valides sont hashés par un pool de workers, puis les profils sont insérés par lots
+// (CreateProfiles). Le rapport donne le résultat de chaque ligne ; avec dryRun, rien n'est hashé
+// ni inséré, le rapport dit ce qui le serait.
+
+const (
+	importFormatCSV    = "csv"
+	importFormatNDJSON = "ndjson"
+
+	importMaxBytes  = 32 << 20 // taille maximale du fichier envoyé à l'API
+	importBatchSize = 500      // profils passés à CreateProfiles à la fois
+)
+
+// Résultat d'une ligne du fichier
+const (
+	importAccepted = "accepted"
+	importRejected = "rejected"
+)
+
+// Une ligne lue dans le fichier. Problem est renseigné quand la ligne est illisible.
+type importRow struct {
+	Line     int
+	Email    string
+	Password string
+	State    bool
+	UserType int
+	Problem  string
+}
+
+type importRowReport struct {
+	Line   int    `json:"line"` // numéro de la ligne dans le fichier, l'en-tête CSV est la ligne 1
+	Email  string `json:"email"`
+	Status string `json:"status"` // "accepted" ou "rejected"
+	Reason string `json:"reason,omitempty"`
+}
+
+// Rapport d'import, renvoyé par l'API et écrit par la sous-commande
+type importReport struct {
+	DryRun   bool              `json:"dryRun"`
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Rows     []importRowReport `json:"rows"`
+}
+
+// readImportRows lit toutes les lignes du fichier. Une ligne invalide est gardée avec son problème ;
+// seul un fichier illisible (en-tête CSV, guillemets mal fermés) renvoie une erreur.
+func readImportRows(r io.Reader, format string) ([]importRow, error) {
+	switch format {
+	case importFormatCSV:
+		return readImportCSV(r)
+	case importFormatNDJSON:
+		return readImportNDJSON(r)
+	}
+	return nil, fmt.Errorf("format d'import inconnu %q, csv ou ndjson", format)
+}
+
+func readImportCSV(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("en-tête CSV illisible : %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"email", "password"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("colonne %q absente de l'en-tête CSV", required)
+		}
+	}
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, fmt.Errorf("CSV illisible : %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			rows = append(rows, importRow{Line: line, Email: field(record, "email"), Problem: "nombre de colonnes différent de l'en-tête"})
+			continue
+		}
+
+		row := importRow{Line: line, Email: field(record, "email"), Password: field(record, "password")}
+		if value := field(record, "state"); value != "" {
+			row.State, err = strconv.ParseBool(value)
+			if err != nil {
+				row.Problem = "state doit être true ou false"
+			}
+		}
+		if value := field(record, "usertype"); value != "" && row.Problem == "" {
+			row.UserType, err = strconv.Atoi(value)
+			if err != nil {
+				row.Problem = "userType doit être un entier"
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func readImportNDJSON(r io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var rows []importRow
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var body createProfileRequest
+		err := json.Unmarshal([]byte(text), &body)
+		if err != nil {
+			rows = append(rows, importRow{Line: line, Problem: "JSON invalide"})
+			continue
+		}
+		rows = append(rows, importRow{Line: line, Email: body.Email, Password: body.Password, State: body.State, UserType: body.UserType})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("NDJSON illisible : %w", err)
+	}
+	return rows, nil
+}
+
+// profileImporter valide, hashe et insère les lignes d'un import
+type profileImporter struct {
+	store     ProfileStore
+	passwords *passwordHashing
+	workers   int
+}
+
+func newProfileImporter(store ProfileStore, passwords *passwordHashing) profileImporter {
+	return profileImporter{store: store, passwords: passwords, workers: runtime.NumCPU()}
+}
+
+// Import renvoie le rapport de toutes les lignes. L'erreur n'est renvoyée que si la base ne répond pas
+// pendant la validation : rien n'a alors été inséré.
+func (imp profileImporter) Import(ctx context.Context, rows []importRow, dryRun bool) (importReport, error) {
+	report := importReport{DryRun: dryRun, Rows: make([]importRowReport, len(rows))}
+	reject := func(i int, reason string) {
+		report.Rows[i] = importRowReport{Line: rows[i].Line, Email: rows[i].Email, Status: importRejected, Reason: reason}
+	}
+
+	// Vérifications sans la base, dans l'ordre du fichier. Un email n'est pris que par une ligne valide :
+	// le doublon est la seconde occurrence valide, une ligne refusée avant n'empêche pas sa correction plus bas.
+	firstLine := map[string]int{}
+	var candidates []int
+	for i, row := range rows {
+		switch {
+		case row.Problem != "":
+			reject(i, row.Problem)
+		case !validEmail(row.Email):
+			reject(i, "email invalide")
+		case firstLine[row.Email] != 0:
+			reject(i, fmt.Sprintf("email en double, déjà à la ligne %d", firstLine[row.Email]))
+		case row.Password == "":
+			reject(i, "mot de passe manquant")
+		case row.UserType != 0 && !validUserType(row.UserType):
+			reject(i, "userType doit être entre 1 et 3")
+		default:
+			firstLine[row.Email] = row.Line
+			candidates = append(candidates, i)
+		}
+	}
+
+	profiles, err := imp.prepare(ctx, rows, candidates, dryRun, reject)
+	if err != nil {
+		return importReport{}, err
+	}
+
+	if !dryRun {
+		imp.insert(ctx, rows, profiles, reject)
+	}
+	for i := range report.Rows {
+		if report.Rows[i].Status == "" {
+			report.Rows[i] = importRowReport{Line: rows[i].Line, Email: rows[i].Email, Status: importAccepted}
+		}
+		if report.Rows[i].Status == importAccepted {
+			report.Accepted++
+		} else {
+			report.Rejected++
+		}
+	}
+	return report, nil
+}
+
+// prepare vérifie dans la base que les emails sont libres et hashe les mots de passe (sauf dryRun),
+// avec imp.workers workers. Renvoie les profils à insérer, indexés par ligne.
+func (imp profileImporter) prepare(ctx context.Context, rows []importRow, candidates []int, dryRun bool, reject func(int, string)) (map[int]Profile, error) {
+	type result struct {
+		index   int
+		profile Profile
+		reason  string
+		err     error
+	}
+
+	jobs := make(chan int)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for w := 0; w < imp.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				row := rows[i]
+				_, err := imp.store.GetProfile(ctx, row.Email)
+				if err == nil {
+					results <- result{index: i, reason: "email déjà utilisé"}
+					continue
+				}
+				if !errors.Is(err, ErrProfileNotFound) {
+					results <- result{index: i, err: err}
+					continue
+				}
+
+				profile := Profile{Email: row.Email, State: row.State, UserType: row.UserType, CreatedAt: time.Now().UTC()}
+				if profile.UserType == 0 {
+					profile.UserType = int(roleUser)
+				}
+				if !dryRun {
+					profile.Password, err = imp.passwords.Hash(row.Password)
+					if err != nil {
+						log.Println("ERREUR : hash du mot de passe de", row.Email, ":", err)
+						results <- result{index: i, reason: "erreur lors du hashage du mot de passe"}
+						continue
+					}
+				}
+				results <- result{index: i, profile: profile}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, i := range candidates {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	profiles := make(map[int]Profile, len(candidates))
+	var firstErr error
+	for res := range results {
+		switch {
+		case res.err != nil:
+			if firstErr == nil {
+				firstErr = res.err
+			}
+		case res.reason != "":
+			reject(res.index, res.reason)
+		default:
+			profiles[res.index] = res.profile
+		}
+	}
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return profiles, firstErr
+}
+
+// insert insère les profils par lots, dans l'ordre du fichier. Quand un lot échoue, les profils qu'il
+// n'a pas insérés sont repris un par un pour savoir lesquels sont refusés.
+func (imp profileImporter) insert(ctx context.Context, rows []importRow, profiles map[int]Profile, reject func(int, string)) {
+	var indexes []int
+	for i := range rows {
+		if _, ok := profiles[i]; ok {
+			indexes = append(indexes, i)
+		}
+	}
+
+	for start := 0; start < len(indexes); start += importBatchSize {
+		chunk := indexes[start:min(start+importBatchSize, len(indexes))]
+		batch := make([]Profile, 0, len(chunk))
+		for _, i := range chunk {
+			batch = append(batch, profiles[i])
+		}
+
+		inserted, err := imp.store.CreateProfiles(ctx, batch)
+		if err == nil {
+			continue
+		}
+		log.Println("ATTENTION : import : lot refusé, insertion ligne par ligne :", err)
+		for k, i := range chunk[inserted:] {
+			err := imp.store.CreateProfile(ctx, batch[inserted+k])
+			switch {
+			case errors.Is(err, ErrEmailAlreadyUsed):
+				reject(i, "email déjà utilisé")
+			case err != nil:
+				log.Println("ERREUR : import de", rows[i].Email, ":", err)
+				reject(i, "erreur de la base de données")
+			}
+		}
+	}
+}
+
+// importFormatOf choisit le format : le paramètre format, sinon le Content-Type
+func importFormatOf(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return importFormatCSV
+	case "application/x-ndjson", "application/jsonl", "application/json":
+		return importFormatNDJSON
+	}
+	return ""
+}
+
+// Import de profils, réservé aux admins : le fichier est le corps de la requête
+
+func (a *apiHandlers) ImportProfiles(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	dryRun := false
+	if value := r.URL.Query().Get("dryRun"); value != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "dryRun doit être true ou false")
+			return
+		}
+	}
+
+	format := importFormatOf(r)
+	if format != importFormatCSV && format != importFormatNDJSON {
+		writeError(w, http.StatusBadRequest, "Format inconnu : format=csv ou ndjson, ou Content-Type text/csv ou application/x-ndjson")
+		return
+	}
+
+	rows, err := readImportRows(http.MaxBytesReader(w, r.Body, importMaxBytes), format)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Fichier trop gros (%d Mio maximum)", importMaxBytes>>20))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		writeError(w, http.StatusBadRequest, "Aucun profil dans le fichier")
+		return
+	}
+
+	report, err := newProfileImporter(a.store, a.passwords).Import(r.Context(), rows, dryRun)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// runImport importe un fichier de profils directement dans le backend configuré, sans passer par l'API.
+// Le rapport JSON est écrit sur la sortie standard ; le code de sortie est 1 si une ligne est refusée.
+func runImport(args []string) int {
+	var cfg config
+	fs := configFlagSet("import", &cfg)
+	format := fs.String("format", "", "format du fichier : csv ou ndjson (par défaut : d'après l'extension)")
+	dryRun := fs.Bool("dry-run", false, "valide le fichier sans rien insérer")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		log.Println("ERREUR : usage : import [flags] <fichier .csv ou .ndjson>")
+		return 2
+	}
+	err = cfg.validate()
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 2
+	}
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(fs.Arg(0))) {
+		case ".csv":
+			*format = importFormatCSV
+		case ".ndjson", ".jsonl":
+			*format = importFormatNDJSON
+		}
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+	defer file.Close()
+	rows, err := readImportRows(file, *format)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 2
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+
+	report, err := newProfileImporter(store, newPasswordHashing(cfg)).Import(context.Background(), rows, *dryRun)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if *dryRun {
+		log.Printf("Simulation : %d profils seraient importés, %d refusés", report.Accepted, report.Rejected)
+	} else {
+		log.Printf("%d profils importés, %d refusés", report.Accepted, report.Rejected)
+	}
+	if report.Rejected > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadImportCSV(t *testing.T) {
+	input := "userType, Email ,password,state\n" +
+		"3,admin@example.com,secret,true\n" +
+		"1,user@example.com,secret\n" +
+		"1,etat@example.com,secret,peut-être\n" +
+		"2,minimal@example.com,secret,\n"
+	rows, err := readImportRows(strings.NewReader(input), importFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []importRow{
+		{Line: 2, Email: "admin@example.com", Password: "secret", State: true, UserType: 3},
+		{Line: 3, Email: "user@example.com", Problem: "nombre de colonnes différent de l'en-tête"},
+		{Line: 4, Email: "etat@example.com", Password: "secret", UserType: 0, Problem: "state doit être true ou false"},
+		{Line: 5, Email: "minimal@example.com", Password: "secret", UserType: 2},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("lignes lues :\n%+v\n%+v attendu", rows, want)
+	}
+
+	_, err = readImportRows(strings.NewReader("email,state\na@example.com,true\n"), importFormatCSV)
+	if err == nil {
+		t.Error("en-tête sans colonne password accepté")
+	}
+}
+
+func TestReadImportNDJSON(t *testing.T) {
+	input := `{"email":"a@example.com","password":"secret","state":true,"userType":2}` + "\n\n" +
+		`{"email":` + "\n" +
+		`{"email":"b@example.com","password":"secret"}` + "\n"
+	rows, err := readImportRows(strings.NewReader(input), importFormatNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []importRow{
+		{Line: 1, Email: "a@example.com", Password: "secret", State: true, UserType: 2},
+		{Line: 3, Problem: "JSON invalide"},
+		{Line: 4, Email: "b@example.com", Password: "secret"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("lignes lues :\n%+v\n%+v attendu", rows, want)
+	}
+}
+
+// Chaque ligne a son résultat dans le rapport ; en dry run rien n'est inséré
+func TestImportReport(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		ctx := context.Background()
+		err := store.CreateProfile(ctx, testProfile("existant@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := config{PasswordHash: hashBcrypt, BcryptCost: 4}
+		importer := newProfileImporter(store, newPasswordHashing(cfg))
+
+		rows := []importRow{
+			{Line: 2, Email: "a@example.com", Password: "secret", State: true},
+			{Line: 3, Email: "Nom <b@example.com>", Password: "secret"},
+			{Line: 4, Email: "a@example.com", Password: "autre"},
+			{Line: 5, Email: "c@example.com"},
+			{Line: 6, Email: "d@example.com", Password: "secret", UserType: 7},
+			{Line: 7, Email: "existant@example.com", Password: "secret"},
+			{Line: 8, Email: "e@example.com", Password: "secret", UserType: int(roleAdmin)},
+		}
+		wantStatus := []string{importAccepted, importRejected, importRejected, importRejected, importRejected, importRejected, importAccepted}
+
+		for _, dryRun := range []bool{true, false} {
+			report, err := importer.Import(ctx, rows, dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.DryRun != dryRun || report.Accepted != 2 || report.Rejected != 5 || len(report.Rows) != len(rows) {
+				t.Fatalf("rapport (dry run %v) : %+v", dryRun, report)
+			}
+			for i, row := range report.Rows {
+				if row.Line != rows[i].Line || row.Status != wantStatus[i] || (row.Status == importRejected) != (row.Reason != "") {
+					t.Errorf("ligne %d (dry run %v) : %+v, statut %s attendu", rows[i].Line, dryRun, row, wantStatus[i])
+				}
+			}
+
+			_, err = store.GetProfile(ctx, "a@example.com")
+			if dryRun && !errors.Is(err, ErrProfileNotFound) {
+				t.Fatalf("profil inséré par le dry run : %v", err)
+			}
+			if !dryRun && err != nil {
+				t.Fatalf("profil importé absent : %v", err)
+			}
+		}
+
+		profile, err := store.GetProfile(ctx, "e@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, _, err := newPasswordHashing(cfg).Verify(profile.Password, "secret")
+		if err != nil || !ok || profile.UserType != int(roleAdmin) {
+			t.Errorf("profil importé : %+v, mot de passe vérifié %v (%v)", profile, ok, err)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rôles associés aux valeurs de UserType stockées dans les backends.
+// Les valeurs sont ordonnées : un rôle a tous les droits des rôles inférieurs.
+type role int
+
+const (
+	roleUser      role = 1
+	roleModerator role = 2
+	roleAdmin     role = 3
+)
+
+func (r role) String() string {
+	switch r {
+	case roleUser:
+		return "user"
+	case roleModerator:
+		return "moderator"
+	case roleAdmin:
+		return "admin"
+	}
+	return "inconnu"
+}
+
+func profileRole(profile Profile) role {
+	return role(profile.UserType)
+}
+
+// validUserType indique si la valeur correspond à un rôle connu
+func validUserType(userType int) bool {
+	return userType >= int(roleUser) && userType <= int(roleAdmin)
+}
+
+// Une policy décide si le profil connecté peut appeler une route
+type policy func(r *http.Request, caller Profile) bool
+
+// authorize applique une policy devant un handler : 401 sans token, 403 si la policy refuse
+func authorize(p policy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := currentProfile(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "Authentification requise")
+			return
+		}
+		if !p(r, caller) {
+			writeError(w, http.StatusForbidden, "Accès refusé")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// minRole autorise les profils qui ont au moins ce rôle
+func minRole(min role) policy {
+	return func(r *http.Request, caller Profile) bool {
+		return profileRole(caller) >= min
+	}
+}
+
+// selfOrMinRole autorise le propriétaire du profil visé, ou les profils qui ont au moins ce rôle
+func selfOrMinRole(min role) policy {
+	return func(r *http.Request, caller Profile) bool {
+		if profileRole(caller) >= min {
+			return true
+		}
+		return targetEmail(r) == caller.Email
+	}
+}
+
+// targetEmail retrouve l'email du profil visé par la requête : dans l'url, le formulaire multipart
+// ou le corps JSON. Le corps est remis en place pour que le handler puisse le relire.
+// Le formulaire n'est lu que sur les routes d'envoi d'image (maxUploadSize), avec leur limite de taille.
+func targetEmail(r *http.Request) string {
+	if email, ok := mux.Vars(r)["email"]; ok {
+		return email
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		limits, ok := r.Context().Value(imageLimitsContextKey).(imageLimits)
+		if !ok {
+			return ""
+		}
+		if err := r.ParseMultipartForm(limits.MaxBytes); err != nil {
+			return ""
+		}
+		return r.FormValue("email")
+	}
+
+	if r.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var payload struct {
+		Email string `json:"email"`
+	}
+	json.Unmarshal(body, &payload)
+	return payload.Email
+}
+
+// ensureAdminProfile crée le compte administrateur configuré (--admin-email / --admin-password)
+// s'il n'existe pas encore, pour ne jamais perdre l'accès aux routes réservées aux admins
+func ensureAdminProfile(ctx context.Context, store ProfileStore, cfg config) error {
+	if cfg.AdminEmail == "" {
+		return nil
+	}
+
+	_, err := store.GetProfile(ctx, cfg.AdminEmail)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrProfileNotFound) {
+		return err
+	}
+
+	hash, err := newPasswordHashing(cfg).Hash(cfg.AdminPassword)
+	if err != nil {
+		return err
+	}
+
+	err = store.CreateProfile(ctx, Profile{
+		Email:     cfg.AdminEmail,
+		Password:  hash,
+		State:     true,
+		UserType:  int(roleAdmin),
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil && !errors.Is(err, ErrEmailAlreadyUsed) {
+		return err
+	}
+
+	log.Println("Compte administrateur créé :", cfg.AdminEmail)
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testMultipartRequest(t *testing.T, email string) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("email", email)
+	part, err := form.CreateFormFile("image", "photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(bytes.Repeat([]byte{0}, 4096))
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/api/uploadProfileImage", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// Le formulaire multipart n'est lu par targetEmail que derrière maxUploadSize, avec la limite configurée
+func TestTargetEmailReadsFormWithUploadLimits(t *testing.T) {
+	if email := targetEmail(testMultipartRequest(t, "user@example.com")); email != "" {
+		t.Errorf("formulaire lu hors d'une route d'envoi : %q", email)
+	}
+
+	var seen string
+	limits := imageLimits{MaxBytes: 1024}
+	handler := maxUploadSize(limits, func(w http.ResponseWriter, r *http.Request) {
+		seen = targetEmail(r)
+		if r.MultipartForm == nil || len(r.MultipartForm.File["image"]) != 1 {
+			t.Error("le fichier du formulaire doit rester lisible par le handler")
+		}
+	})
+	handler(httptest.NewRecorder(), testMultipartRequest(t, "user@example.com"))
+	if seen != "user@example.com" {
+		t.Errorf("email du formulaire derrière maxUploadSize : %q", seen)
+	}
+}
@@ -1,60 +1,58 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"os"
-	"path"
-	"path/filepath"
+	"hash/fnv"
+	"sort"
+	"time"
 
 	"github.com/gocql/gocql"
 	"github.com/scylladb/gocqlx"
 	"github.com/scylladb/gocqlx/qb"
 	"github.com/scylladb/gocqlx/table"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
-// Définition d'un nouveau type pour représenter l'image sous forme de données binaires
+// Référence vers l'image du profil, les données sont dans le BlobStore
 type ImageBinaryScylla struct {
-	Data      []byte `db:"data" json:"data"`
-	Extension string `db:"extension" json:"extension"`
+	Key         string            `db:"key" json:"key"`
+	Extension   string            `db:"extension" json:"extension"`
+	UpdatedAt   time.Time         `db:"updatedat" json:"updatedAt"`
+	VariantKeys map[string]string `db:"variantkeys" json:"variantKeys"`
+	Data        []byte            `db:"data" json:"data"` // données des images envoyées avant le BlobStore
+	GalleryID   string            `db:"galleryid" json:"galleryId"`
+}
+
+// Format JSON de la colonne picture
+type imageBinaryScyllaJSON struct {
+	Key         string            `json:"key,omitempty"`
+	Extension   string            `json:"extension"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+	VariantKeys map[string]string `json:"variantKeys,omitempty"`
+	Data        []byte            `json:"data,omitempty"`
+	GalleryID   string            `json:"galleryId,omitempty"`
 }
 
 // MarshalCQL implémente la méthode de marshall pour la structure ImageBinaryScylla
 func (ib ImageBinaryScylla) MarshalCQL(info gocql.TypeInfo) ([]byte, error) {
-	// Utiliser un type intermédiaire pour la sérialisation
-	type ImageBinaryScyllaJSON struct {
-		Extension string `json:"extension"`
-		Data      []byte `json:"data"`
-	}
-	ibJSON := ImageBinaryScyllaJSON{
-		Data:      ib.Data,
-		Extension: ib.Extension,
-	}
-	return json.Marshal(ibJSON)
+	return json.Marshal(imageBinaryScyllaJSON(ib))
 }
 
 func (ib *ImageBinaryScylla) UnmarshalCQL(info gocql.TypeInfo, data []byte) error {
-	type ImageBinaryScyllaJSON struct {
-		Extension string `json:"extension"`
-		Data      []byte `json:"data"`
+	// Une colonne picture vide correspond à un profil sans image
+	if len(data) == 0 {
+		return nil
 	}
 
-	var ibJSON ImageBinaryScyllaJSON
+	// Les variantes des images d'avant le BlobStore ("variants") sont ignorées : elles sont recalculées
+	var ibJSON imageBinaryScyllaJSON
 	err := json.Unmarshal(data, &ibJSON)
 	if err != nil {
 		return err
 	}
-
-	ib.Extension = ibJSON.Extension
-	ib.Data = ibJSON.Data
-
+	*ib = ImageBinaryScylla(ibJSON)
 	return nil
 }
 
@@ -64,10 +62,13 @@ type query struct {
 }
 
 type statements struct {
-	del query
-	ins query
-	sel query
-	upd query
+	del    query
+	ins    query
+	get    query
+	sel    query
+	updSt  query
+	updPic query
+	updPw  query
 }
 
 type Record struct {
@@ -76,6 +77,10 @@ type Record struct {
 	Picture  *ImageBinaryScylla `db:"picture" json:"picture"`
 	State    bool               `db:"state"`
 	UserType int                `db:"usertype"`
+	// Date de création en nanosecondes Unix, null (0) pour les profils d'avant la colonne
+	CreatedAt int64 `db:"created_at"`
+	// Dernier changement du mot de passe en nanosecondes Unix, null (0) si le mot de passe n'a jamais changé
+	PasswordChangedAt int64 `db:"password_changed_at"`
 }
 
 var stmts = createStatements()
@@ -83,16 +88,19 @@ var stmts = createStatements()
 func createStatements() *statements {
 	m := table.Metadata{
 		Name:    "users",
-		Columns: []string{"email", "password", "picture", "state", "usertype"},
+		Columns: []string{"email", "password", "picture", "state", "usertype", "created_at", "password_changed_at"},
 		PartKey: []string{"email"},
 	}
 	tbl := table.New(m)
 	deleteStmt, deleteUser := tbl.Delete()
-	insertStmt, insertUser := tbl.Insert()
-	updateStmt, updateUser := tbl.Update(m.Columns[2], m.Columns[3])
-	// Normally a select statement such as this would use `tbl.Select()` to select by
-	// primary key but now we just want to display all the records...
-	selectStmt, selectUser := qb.Select(m.Name).Columns(m.Columns...).ToCql()
+	// IF NOT EXISTS : INSERT est un upsert dans Scylla, la transaction légère refuse un email déjà présent
+	insertStmt, insertUser := qb.Insert(m.Name).Columns(m.Columns...).Unique().ToCql()
+	getStmt, getUser := tbl.Get()
+	updateStateStmt, updateStateUser := tbl.Update(m.Columns[3])
+	updatePictureStmt, updatePictureUser := tbl.Update(m.Columns[2])
+	updatePasswordStmt, updatePasswordUser := tbl.Update(m.Columns[1], m.Columns[6])
+	// Le select sans clé primaire sert à afficher tous les enregistrements, sans la colonne picture
+	selectStmt, selectUser := qb.Select(m.Name).Columns("email", "password", "state", "usertype", "created_at").ToCql()
 
 	return &statements{
 		del: query{
@@ -103,544 +111,755 @@ func createStatements() *statements {
 			stmt:  insertStmt,
 			names: insertUser,
 		},
+		get: query{
+			stmt:  getStmt,
+			names: getUser,
+		},
 		sel: query{
 			stmt:  selectStmt,
 			names: selectUser,
 		},
-		upd: query{
-			stmt:  updateStmt,
-			names: updateUser,
+		updSt: query{
+			stmt:  updateStateStmt,
+			names: updateStateUser,
+		},
+		updPic: query{
+			stmt:  updatePictureStmt,
+			names: updatePictureUser,
+		},
+		updPw: query{
+			stmt:  updatePasswordStmt,
+			names: updatePasswordUser,
 		},
 	}
 }
 
-var session = db_scylladb()
-
-func DeleteProfileScylla(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Delete Profile Scylla")
+// Implémentation de ProfileStore pour ScyllaDB
+type scyllaStore struct {
+	session *gocql.Session
+}
 
-	// Lire le corps de la requête pour obtenir les données
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		// Gérer l'erreur de lecture du corps de la requête
-		http.Error(w, "ERREUR : erreur lors de la lecture de la requête", http.StatusBadRequest)
-		return
-	}
+func newScyllaStore(session *gocql.Session) *scyllaStore {
+	return &scyllaStore{session: session}
+}
 
-	// Définir une struct pour extraire les données du corps de la requête
-	type RequestData struct {
-		Email string `json:"email"`
+func (rec Record) toProfile() Profile {
+	return Profile{
+		Email:             rec.Email,
+		Password:          rec.Password,
+		State:             rec.State,
+		UserType:          rec.UserType,
+		CreatedAt:         createdAtTime(rec.CreatedAt),
+		PasswordChangedAt: createdAtTime(rec.PasswordChangedAt),
 	}
+}
 
-	// Décoder le corps de la requête dans la struct RequestData
-	var requestData RequestData
-	err = json.Unmarshal(body, &requestData)
-	if err != nil {
-		// Gérer l'erreur de décodage du corps de la requête
-		http.Error(w, "ERREUR : erreur lors du décodage de la requête", http.StatusBadRequest)
-		return
-	}
+// La table profile_order range chaque profil deux fois, une ligne par tri possible : les lignes y sont triées
+// par sort_key, ce que la table users (partitionnée par email) ne permet pas. Les lignes d'un tri sont réparties
+// sur profileOrderBuckets partitions selon l'email, pour qu'aucune partition ne grossisse avec le nombre de profils
+// au-delà de ce que Scylla supporte. Changer le nombre de partitions demande de vider la table (--scylla-reset).
+const (
+	profileOrderBuckets = 16
 
-	record := Record{
-		Email: requestData.Email,
-	}
+	insertOrderStmt = `INSERT INTO profile_order (sort_by, bucket, sort_key, email, state, usertype, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	updateOrderStmt = `UPDATE profile_order SET state = ? WHERE sort_by = ? AND bucket = ? AND sort_key = ?`
+	deleteOrderStmt = `DELETE FROM profile_order WHERE sort_by = ? AND bucket = ? AND sort_key = ?`
+)
 
-	err = gocqlx.Query(session.Query(stmts.del.stmt), stmts.del.names).BindStruct(record).ExecRelease()
-	if err != nil {
-		fmt.Println("delete catalog.users", err)
+// orderKey renvoie la clé du profil dans le tri. La date est écrite sur 20 chiffres pour que l'ordre
+// des textes soit celui des dates, l'email départage les profils créés au même instant.
+func orderKey(sortBy string, email string, createdAt int64) string {
+	if sortBy == sortByCreated {
+		return fmt.Sprintf("%020d|%s", createdAt, email)
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Profile supprimé"}`))
+	return email
 }
 
-func CreateProfileScylla(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Inserting Profile Scylla")
-
-	w.Header().Set("Content-Type", "application/json") // on définit le type de contenu de la réponse
-
-	// Lire le corps de la requête pour obtenir les données
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		// Gérer l'erreur de lecture du corps de la requête
-		http.Error(w, "ERREUR : erreur lors de la lecture de la requête", http.StatusBadRequest)
-		return
-	}
+// orderBucket renvoie la partition de profile_order du profil, la même pour tous les tris
+func orderBucket(email string) int {
+	h := fnv.New32a()
+	h.Write([]byte(email))
+	return int(h.Sum32() % profileOrderBuckets)
+}
 
-	// Définir une struct pour extraire les données du corps de la requête
-	type RequestData struct {
-		Email    string             `json:"email"`
-		Password string             `json:"password"`
-		Picture  *ImageBinaryScylla `json:"picture,omitempty"`
-		State    bool               `json:"state"`
-		UserType int                `json:"usertype"`
+// orderKeys renvoie la clé de chaque tri pour le profil
+func (rec Record) orderKeys() map[string]string {
+	return map[string]string{
+		sortByEmail:   orderKey(sortByEmail, rec.Email, rec.CreatedAt),
+		sortByCreated: orderKey(sortByCreated, rec.Email, rec.CreatedAt),
 	}
+}
 
-	// Décoder le corps de la requête dans la struct RequestData
-	var requestData RequestData
-	err = json.Unmarshal(body, &requestData)
-	if err != nil {
-		// Gérer l'erreur de décodage du corps de la requête
-		http.Error(w, "ERREUR : erreur lors du décodage de la requête", http.StatusBadRequest)
-		fmt.Println(err)
-		return
+// addOrderRows ajoute au batch les lignes de profile_order du profil
+func (rec Record) addOrderRows(batch *gocql.Batch) {
+	for sortBy, key := range rec.orderKeys() {
+		batch.Query(insertOrderStmt, sortBy, orderBucket(rec.Email), key, rec.Email, rec.State, rec.UserType, rec.CreatedAt)
 	}
+}
 
-	// Hash du mot de passe
-	hash, err := bcrypt.GenerateFromPassword([]byte(requestData.Password), 10)
+// migrate ajoute dans profile_order les profils qui n'y sont pas encore (profils d'avant la table,
+// ou table recréée avec ses partitions par db_scylladb)
+func (s *scyllaStore) migrate(ctx context.Context) error {
+	var users, ordered int
+	err := s.session.Query("SELECT COUNT(*) FROM users").WithContext(ctx).Scan(&users)
 	if err != nil {
-		http.Error(w, "ERREUR : erreur lors du hashage du mot de passe", http.StatusBadRequest)
-		return
+		return err
 	}
-
-	requestData.Password = string(hash)
-
-	record := Record{
-		Email:    requestData.Email,
-		Password: requestData.Password,
-		State:    requestData.State,
-		UserType: requestData.UserType,
+	for bucket := 0; bucket < profileOrderBuckets; bucket++ {
+		var count int
+		err = s.session.Query("SELECT COUNT(*) FROM profile_order WHERE sort_by = ? AND bucket = ?", sortByEmail, bucket).WithContext(ctx).Scan(&count)
+		if err != nil {
+			return err
+		}
+		ordered += count
 	}
-
-	if requestData.Picture != nil {
-		record.Picture = requestData.Picture
+	if users == ordered {
+		return nil
 	}
 
-	err = gocqlx.Query(session.Query(stmts.ins.stmt),
-		stmts.ins.names).BindStruct(record).ExecRelease()
+	records, err := s.selectRecords(ctx)
 	if err != nil {
-		fmt.Println("insert catalog.users", err)
+		return err
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Profil créé avec succès !"}`))
+	for _, rec := range records {
+		batch := s.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+		rec.addOrderRows(batch)
+		err := s.session.ExecuteBatch(batch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func GetUserProfileScylla(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Affichage du profil utilisateur")
-
-	w.Header().Set("Content-Type", "application/json") // on définit le type de contenu de la réponse
+// Profils par lot d'écriture de profile_order : 20 profils font 40 lignes, sous le seuil d'alerte de taille des batchs
+const scyllaOrderBatchSize = 20
 
-	// Lire le corps de la requête pour obtenir les données
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		// Gérer l'erreur de lecture du corps de la requête
-		http.Error(w, "ERREUR : erreur lors de la lecture de la requête", http.StatusBadRequest)
-		return
-	}
-
-	// Définir une struct pour extraire les données du corps de la requête
-	type RequestData struct {
-		Email string `json:"email"`
+func recordOf(profile Profile) Record {
+	return Record{
+		Email:     profile.Email,
+		Password:  profile.Password,
+		State:     profile.State,
+		UserType:  profile.UserType,
+		CreatedAt: createdAtNanos(profile.CreatedAt),
 	}
+}
 
-	// Décoder le corps de la requête dans la struct RequestData
-	var requestData RequestData
-	err = json.Unmarshal(body, &requestData)
+func (s *scyllaStore) CreateProfile(ctx context.Context, profile Profile) error {
+	record := recordOf(profile)
+	err := s.insertUser(ctx, record)
 	if err != nil {
-		// Gérer l'erreur de décodage du corps de la requête
-		http.Error(w, "ERREUR : erreur lors du décodage de la requête", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	// Utiliser les données récupérées dans la struct pour effectuer votre recherche dans la base de données
-	var record Record
-	err = gocqlx.Query(session.Query(stmts.sel.stmt), stmts.sel.names).BindMap(qb.M{
-		"email": requestData.Email, // Utiliser l'e-mail récupéré dans la requête
-	}).GetRelease(&record)
-	if err != nil {
-		fmt.Println("select catalog.users", err)
-		return
+	batch := s.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	record.addOrderRows(batch)
+	return s.session.ExecuteBatch(batch)
+}
+
+// Chaque email est réservé par sa transaction légère, qu'un batch ne peut pas regrouper sur plusieurs
+// partitions : le premier email déjà présent arrête l'insertion avec ErrEmailAlreadyUsed. Les lignes de
+// profile_order des profils insérés sont ensuite écrites par batchs non journalisés (sans garantie
+// d'atomicité, migrate complète profile_order au démarrage si un batch a échoué).
+func (s *scyllaStore) CreateProfiles(ctx context.Context, profiles []Profile) (int, error) {
+	inserted := 0
+	var insertErr error
+	for _, profile := range profiles {
+		insertErr = s.insertUser(ctx, recordOf(profile))
+		if insertErr != nil {
+			break
+		}
+		inserted++
 	}
 
-	// Vérifier si l'e-mail de l'enregistrement correspond à l'e-mail recherché dans la requête
-	if record.Email == requestData.Email {
-		// Encoder les données dans un format JSON
-		jsonBytes, err := json.Marshal(record)
+	for start := 0; start < inserted; start += scyllaOrderBatchSize {
+		batch := s.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+		for _, profile := range profiles[start:min(start+scyllaOrderBatchSize, inserted)] {
+			recordOf(profile).addOrderRows(batch)
+		}
+		err := s.session.ExecuteBatch(batch)
 		if err != nil {
-			http.Error(w, "ERREUR : erreur lors de l'encodage de la réponse", http.StatusInternalServerError)
-			return
+			return inserted, err
 		}
-
-		// Écrire les données encodées dans la réponse HTTP
-		w.Write(jsonBytes)
-	} else {
-		fmt.Println("ERREUR : aucune données pour cette email" + requestData.Email)
 	}
+	return inserted, insertErr
 }
 
-func GetAllUsersScylla(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Displaying Results:")
-
-	w.Header().Set("Content-Type", "application/json") // on définit le type de contenu de la réponse
+// insertUser insère la ligne de users si l'email est libre (INSERT ... IF NOT EXISTS)
+func (s *scyllaStore) insertUser(ctx context.Context, record Record) error {
+	q := gocqlx.Query(s.session.Query(stmts.ins.stmt).WithContext(ctx), stmts.ins.names).BindStruct(record)
+	defer q.Release()
+	if q.Err() != nil {
+		return q.Err()
+	}
 
-	// Utiliser les données récupérées dans la struct pour effectuer votre recherche dans la base de données
-	var records []Record // Utiliser un slice de Record pour stocker les enregistrements
-	err := gocqlx.Query(session.Query(stmts.sel.stmt), stmts.sel.names).SelectRelease(&records)
+	applied, err := q.MapScanCAS(map[string]interface{}{})
 	if err != nil {
-		fmt.Println("select catalog.users", err)
-		http.Error(w, "ERREUR : erreur lors de la recherche des profils", http.StatusInternalServerError)
-		return
+		return err
 	}
-
-	// Convertir les valeurs VARCHAR pour le champ `picture` en *main.ImageBinaryScylla
-	for i := range records {
-		if records[i].Picture == nil {
-			records[i].Picture = &ImageBinaryScylla{}
-		}
+	if !applied {
+		return ErrEmailAlreadyUsed
 	}
+	return nil
+}
 
-	// Encoder les données dans un format JSON
-	jsonBytes, err := json.Marshal(records)
+func (s *scyllaStore) GetProfile(ctx context.Context, email string) (Profile, error) {
+	record, err := s.getRecord(ctx, email)
 	if err != nil {
-		fmt.Println("ERREUR : erreur lors de l'encodage de la réponse", err)
-		http.Error(w, "ERREUR : erreur lors de l'encodage de la réponse", http.StatusInternalServerError)
-		return
+		return Profile{}, err
 	}
-
-	// Écrire les données encodées dans la réponse HTTP
-	w.Write(jsonBytes)
+	return record.toProfile(), nil
 }
 
-func getAllUsersTypeScylla(w http.ResponseWriter, r *http.Request) {
-
-	w.Header().Set("Content-Type", "application/json") // on définit le type de contenu de la réponse
-
-	// Lire le corps de la requête pour obtenir les données
-	body, err := ioutil.ReadAll(r.Body)
+func (s *scyllaStore) ListProfiles(ctx context.Context) ([]Profile, error) {
+	records, err := s.selectRecords(ctx)
 	if err != nil {
-		// Gérer l'erreur de lecture du corps de la requête
-		http.Error(w, "ERREUR : erreur lors de la lecture de la requête", http.StatusBadRequest)
-		return
+		return nil, err
 	}
 
-	// Définir une struct pour extraire les données du corps de la requête
-	type RequestData struct {
-		UserType int `json:"usertype"`
+	profiles := make([]Profile, 0, len(records))
+	for _, rec := range records {
+		profiles = append(profiles, rec.toProfile())
 	}
+	return profiles, nil
+}
 
-	// Décoder le corps de la requête dans la struct RequestData
-	var requestData RequestData
-	err = json.Unmarshal(body, &requestData)
+func (s *scyllaStore) ListProfilesByType(ctx context.Context, userType int) ([]Profile, error) {
+	records, err := s.selectRecords(ctx)
 	if err != nil {
-		// Gérer l'erreur de décodage du corps de la requête
-		http.Error(w, "ERREUR : erreur lors du décodage de la requête", http.StatusBadRequest)
-		return
+		return nil, err
 	}
 
-	var records []Record // Utiliser un slice de Record pour stocker les enregistrements
-	err = gocqlx.Query(session.Query(stmts.sel.stmt), stmts.sel.names).BindMap(qb.M{
-		"usertype": requestData.UserType,
-	}).SelectRelease(&records)
-	if err != nil {
-		fmt.Println("select catalog.users usertype : ", err)
-		http.Error(w, "ERREUR : erreur lors de la recherche des profils", http.StatusInternalServerError)
-		return
+	// usertype ne fait pas partie de la clé primaire, on filtre côté application
+	var profiles []Profile
+	for _, rec := range records {
+		if rec.UserType == userType {
+			profiles = append(profiles, rec.toProfile())
+		}
 	}
+	return profiles, nil
+}
 
-	var filteredRecords []Record
-	for _, r := range records {
-		if r.UserType == requestData.UserType {
-			filteredRecords = append(filteredRecords, r)
+// Les pages sont lues dans profile_order : chaque partition du tri renvoie au plus query.Limit+1 profils
+// après la clé du curseur, et les lignes des partitions sont fusionnées dans l'ordre du tri. La ligne
+// en trop indique qu'il reste des profils. Les filtres sur state et usertype sont faits par Scylla (ALLOW FILTERING).
+func (s *scyllaStore) ListProfilesPage(ctx context.Context, query ProfileQuery) (ProfilePage, error) {
+	var rows []orderRow
+	for bucket := 0; bucket < profileOrderBuckets; bucket++ {
+		stmt, values := profileOrderSelect(query, bucket)
+		iter := s.session.Query(stmt, values...).WithContext(ctx).Iter()
+		var row orderRow
+		for iter.Scan(&row.key, &row.record.Email, &row.record.State, &row.record.UserType, &row.record.CreatedAt) {
+			rows = append(rows, row)
+		}
+		err := iter.Close()
+		if err != nil {
+			return ProfilePage{}, err
 		}
 	}
+	return mergeOrderRows(rows, query), nil
+}
 
-	// Convertir les valeurs VARCHAR pour le champ `picture` en *main.ImageBinaryScylla
-	for i := range filteredRecords {
-		if filteredRecords[i].Picture == nil {
-			filteredRecords[i].Picture = &ImageBinaryScylla{}
+// Ligne de profile_order : la clé du tri et les colonnes du profil
+type orderRow struct {
+	key    string
+	record Record
+}
+
+// mergeOrderRows fusionne les lignes lues sur chaque partition (limit+1 au plus par partition) en une page :
+// les limit premières dans l'ordre du tri, et le curseur s'il reste au moins une ligne après
+func mergeOrderRows(rows []orderRow, query ProfileQuery) ProfilePage {
+	sort.Slice(rows, func(i, j int) bool {
+		if query.Descending {
+			return rows[i].key > rows[j].key
 		}
+		return rows[i].key < rows[j].key
+	})
+
+	page := ProfilePage{Profiles: []Profile{}}
+	for _, row := range rows {
+		if len(page.Profiles) == query.Limit {
+			page.Next = cursorOf(page.Profiles[len(page.Profiles)-1])
+			break
+		}
+		page.Profiles = append(page.Profiles, row.record.toProfile())
 	}
+	return page
+}
 
-	// Encoder les données dans un format JSON
-	jsonBytes, err := json.Marshal(filteredRecords)
-	if err != nil {
-		fmt.Println("ERREUR : erreur lors de l'encodage de la réponse", err)
-		http.Error(w, "ERREUR : erreur lors de l'encodage de la réponse", http.StatusInternalServerError)
-		return
+// Les profils sont lus par pages de 500, une seule page est en mémoire à la fois
+func (s *scyllaStore) StreamProfiles(ctx context.Context, query ProfileQuery, fn func(Profile) error) error {
+	query.Limit = 500
+	for {
+		page, err := s.ListProfilesPage(ctx, query)
+		if err != nil {
+			return err
+		}
+		for _, profile := range page.Profiles {
+			err = fn(profile)
+			if err != nil {
+				return err
+			}
+		}
+		if page.Next == nil {
+			return nil
+		}
+		query.After = page.Next
 	}
+}
 
-	// Écrire les données encodées dans la réponse HTTP
-	w.Write(jsonBytes)
+// profileOrderSelect construit la requête sur une partition de profile_order des profils filtrés et triés de la requête
+func profileOrderSelect(query ProfileQuery, bucket int) (string, []interface{}) {
+	stmt := "SELECT sort_key, email, state, usertype, created_at FROM profile_order WHERE sort_by = ? AND bucket = ?"
+	values := []interface{}{query.Sort, bucket}
+	if query.After != nil {
+		if query.Descending {
+			stmt += " AND sort_key < ?"
+		} else {
+			stmt += " AND sort_key > ?"
+		}
+		values = append(values, orderKey(query.Sort, query.After.Email, query.After.CreatedAt))
+	}
+	if query.State != nil {
+		stmt += " AND state = ?"
+		values = append(values, *query.State)
+	}
+	if query.UserType != nil {
+		stmt += " AND usertype = ?"
+		values = append(values, *query.UserType)
+	}
+	if query.Descending {
+		stmt += " ORDER BY sort_key DESC"
+	}
+	stmt += " LIMIT ?"
+	values = append(values, query.Limit+1)
+	if query.State != nil || query.UserType != nil {
+		stmt += " ALLOW FILTERING"
+	}
+	return stmt, values
 }
 
-func UpdateProfileScylla(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Updating Profile Scylla")
+func (s *scyllaStore) CountProfiles(ctx context.Context) (int, error) {
+	var count int
+	err := s.session.Query("SELECT COUNT(*) FROM catalog.users").WithContext(ctx).Scan(&count)
+	return count, err
+}
 
-	// Lire le corps de la requête pour obtenir les données
-	body, err := ioutil.ReadAll(r.Body)
+func (s *scyllaStore) UpdateProfileState(ctx context.Context, email string, state bool) (Profile, error) {
+	record, err := s.getRecord(ctx, email)
 	if err != nil {
-		// Gérer l'erreur de lecture du corps de la requête
-		http.Error(w, "ERREUR : erreur lors de la lecture de la requête", http.StatusBadRequest)
-		return
-	}
-
-	// Définir une struct pour extraire les données du corps de la requête
-	type RequestData struct {
-		Email string `json:"email"`
-		State bool   `json:"state"`
+		return Profile{}, err
 	}
 
-	// Décoder le corps de la requête dans la struct RequestData
-	var requestData RequestData
-	err = json.Unmarshal(body, &requestData)
+	record.State = state
+	err = gocqlx.Query(s.session.Query(stmts.updSt.stmt).WithContext(ctx), stmts.updSt.names).BindStruct(record).ExecRelease()
 	if err != nil {
-		// Gérer l'erreur de décodage du corps de la requête
-		http.Error(w, "ERREUR : erreur lors du décodage de la requête", http.StatusBadRequest)
-		return
+		return Profile{}, err
 	}
 
-	record := Record{
-		Email: requestData.Email,
-		State: requestData.State,
+	batch := s.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	for sortBy, key := range record.orderKeys() {
+		batch.Query(updateOrderStmt, state, sortBy, orderBucket(record.Email), key)
 	}
-
-	err = gocqlx.Query(session.Query(stmts.upd.stmt),
-		stmts.upd.names).BindStruct(record).ExecRelease()
+	err = s.session.ExecuteBatch(batch)
 	if err != nil {
-		fmt.Println("update catalog.users", err)
+		return Profile{}, err
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Profil mis à jour avec succès !"}`))
+	return record.toProfile(), nil
 }
 
-func CreateHTLMPageScylla(w http.ResponseWriter, r *http.Request) {
-
-	w.Header().Set("Content-Type", "application/json")
-
-	// Lire le corps de la requête pour obtenir les données
-	body, err := ioutil.ReadAll(r.Body)
+func (s *scyllaStore) UpdateProfilePassword(ctx context.Context, email string, passwordHash string, changedAt time.Time) error {
+	record, err := s.getRecord(ctx, email)
 	if err != nil {
-		// Gérer l'erreur de lecture du corps de la requête
-		http.Error(w, "ERREUR : erreur lors de la lecture de la requête", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	// Définir une struct pour extraire les données du corps de la requête
-	type RequestData struct {
-		Email string `json:"email"`
+	record.Password = passwordHash
+	if changedAt.IsZero() {
+		return gocqlx.Query(s.session.Query(stmts.updPw.stmt).WithContext(ctx), stmts.updPw.names).BindStruct(record).ExecRelease()
 	}
-
-	// Décoder le corps de la requête dans la struct RequestData
-	var requestData RequestData
-	err = json.Unmarshal(body, &requestData)
+	record.PasswordChangedAt = createdAtNanos(changedAt)
+	err = gocqlx.Query(s.session.Query(stmts.updPw.stmt).WithContext(ctx), stmts.updPw.names).BindStruct(record).ExecRelease()
 	if err != nil {
-		// Gérer l'erreur de décodage du corps de la requête
-		http.Error(w, "ERREUR : erreur lors du décodage de la requête", http.StatusBadRequest)
-		return
+		return err
 	}
+	return s.deletePasswordResets(ctx, email)
+}
 
-	record := Record{
-		Email: requestData.Email,
+func (s *scyllaStore) DeleteProfile(ctx context.Context, email string) error {
+	record, err := s.getRecord(ctx, email)
+	if err != nil {
+		return err
 	}
 
-	// Utiliser les données récupérées dans la struct pour effectuer votre recherche dans la base de données
-	var userScylla []Record // Modifier ici pour déclarer une slice de Record
-	err = gocqlx.Query(session.Query(stmts.sel.stmt), stmts.sel.names).BindStruct(record).SelectRelease(&userScylla)
+	err = gocqlx.Query(s.session.Query(stmts.del.stmt).WithContext(ctx), stmts.del.names).BindStruct(record).ExecRelease()
 	if err != nil {
-		fmt.Println("select catalog.users", err)
-		http.Error(w, "ERREUR : erreur lors de la recherche des profils", http.StatusInternalServerError)
-		return
+		return err
 	}
-
-	// Vérifier si le résultat de la requête est vide
-	if userScylla[0].Email == "" {
-		// Gérer le cas où aucun profil n'a été trouvé
-		http.Error(w, "ERREUR : aucun profil trouvé", http.StatusNotFound)
-		return
+	batch := s.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	for sortBy, key := range record.orderKeys() {
+		batch.Query(deleteOrderStmt, sortBy, orderBucket(record.Email), key)
 	}
-
-	// On crée le fichier HTML
-	file, err := os.Create("./html_pages/" + userScylla[0].Email + ".html")
+	err = s.session.ExecuteBatch(batch)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer file.Close()
-
-	// On écrit le contenu du fichier HTML
-	_, err = io.WriteString(file, "<html><head><title>Page de profil</title></head><body><h1>Page de profil</h1><p>Email : "+userScylla[0].Email+"</p><p>Etat : "+fmt.Sprint(userScylla[0].State)+"</p><p>Type d'utilisateur : "+fmt.Sprint(userScylla[0].UserType)+"</p><img src='../images/"+userScylla[0].Email+userScylla[0].Picture.Extension+"' /></body></html>")
+	err = s.deletePasswordResets(ctx, email)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return s.session.Query(`DELETE FROM gallery_images WHERE email = ?`, email).WithContext(ctx).Exec()
+}
 
-	// On met un message de succès
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Fichier HTML créer avec succès, dans le répertoire html_pages"}`))
-
+// deletePasswordResets supprime les demandes de réinitialisation en cours du profil (index sur email)
+func (s *scyllaStore) deletePasswordResets(ctx context.Context, email string) error {
+	iter := s.session.Query(`SELECT token_hash FROM password_resets WHERE email = ?`, email).WithContext(ctx).Iter()
+	var tokenHash string
+	for iter.Scan(&tokenHash) {
+		err := s.session.Query(`DELETE FROM password_resets WHERE token_hash = ?`, tokenHash).WithContext(ctx).Exec()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
 }
 
-func UploadProfileImageScylla(w http.ResponseWriter, r *http.Request) {
+// Tables qui ne contiennent que des données de profils : vidées par DeleteAllProfiles, supprimées par --scylla-reset
+var scyllaProfileTables = []string{"users", "profile_order", "gallery_images", "password_resets", "image_refs"}
 
-	w.Header().Set("Content-Type", "multipart/form-data")
+func (s *scyllaStore) DeleteAllProfiles(ctx context.Context) error {
+	// Exécuter la requête CQL de suppression de tous les enregistrements dans chaque table
+	for _, table := range scyllaProfileTables {
+		err := s.session.Query("TRUNCATE catalog." + table).WithContext(ctx).Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Parse le corps de la requête pour récupérer le formulaire multipart
-	err := r.ParseMultipartForm(16 << 20) // taille maximale du fichier : 16 Mo
+func (s *scyllaStore) PutProfileImage(ctx context.Context, email string, image ProfileImage) error {
+	record, err := s.getRecord(ctx, email)
 	if err != nil {
-		http.Error(w, "Erreur lors de la lecture du formulaire", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	// On lit le fichier image envoyé
-	file, handler, err := r.FormFile("image")
+	record.Picture = toImageBinaryScylla(image)
+	return gocqlx.Query(s.session.Query(stmts.updPic.stmt).WithContext(ctx), stmts.updPic.names).BindStruct(record).ExecRelease()
+}
+
+func (s *scyllaStore) GetProfileImage(ctx context.Context, email string) (ProfileImage, error) {
+	record, err := s.getRecord(ctx, email)
 	if err != nil {
-		fmt.Println("Erreur : récupération du fichier impossible")
-		fmt.Println(err)
-		return
+		return ProfileImage{}, err
 	}
-	defer file.Close()
-
-	// On vérifie que le fichier est bien une image
-	if handler.Header.Get("Content-Type") != "image/jpeg" && handler.Header.Get("Content-Type") != "image/png" && handler.Header.Get("Content-Type") != "image/jpg" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"Erreur": "Le fichier n'est pas une image"}`))
-		return
+	if record.Picture == nil || (record.Picture.Key == "" && len(record.Picture.Data) == 0) {
+		return ProfileImage{}, ErrImageNotFound
 	}
+	return record.Picture.toProfileImage(), nil
+}
 
-	// Lire les données binaires du fichier
-	var pictureData bytes.Buffer
-	_, err = io.Copy(&pictureData, file)
+// La galerie est dans la table gallery_images, partitionnée par email : une galerie se lit en une requête
+func (s *scyllaStore) ListGalleryImages(ctx context.Context, email string) ([]GalleryImage, error) {
+	_, err := s.getRecord(ctx, email)
 	if err != nil {
-		fmt.Println("ERREUR : impossible de lire les données binaires de l'image", err)
-		http.Error(w, "ERREUR : impossible de lire les données binaires de l'image", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	fileName := handler.Filename
-	fileExtension := filepath.Ext(fileName)
+	iter := s.session.Query(`SELECT id, caption, position, picture FROM gallery_images WHERE email = ?`, email).WithContext(ctx).Iter()
+	var images []GalleryImage
+	var image GalleryImage
+	var picture ImageBinaryScylla
+	for iter.Scan(&image.ID, &image.Caption, &image.Position, &picture) {
+		image.Image = picture.toProfileImage()
+		images = append(images, image)
+		picture = ImageBinaryScylla{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return sortGallery(images), nil
+}
 
-	fmt.Println("Extension  : ", fileExtension)
+const insertGalleryImageStmt = `INSERT INTO gallery_images (email, id, caption, position, picture) VALUES (?, ?, ?, ?, ?)`
 
-	// On récupère l'email de l'utilisateur
-	email := r.FormValue("email")
+// Le nombre d'images est gardé dans la colonne statique images de la partition. L'ajout est un batch
+// conditionnel sur la partition (IF images = ?) : le compteur et la nouvelle ligne sont écrits ensemble,
+// et deux envois simultanés ne peuvent pas ajouter chacun la dernière image autorisée.
+func (s *scyllaStore) AddGalleryImage(ctx context.Context, email string, image GalleryImage, maxImages int) error {
+	_, err := s.getRecord(ctx, email)
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("Email : ", email)
+	for attempt := 0; attempt < scyllaCASAttempts; attempt++ {
+		count, counted, err := s.gallerySize(ctx, email)
+		if err != nil {
+			return err
+		}
+		if maxImages > 0 && count >= maxImages {
+			return ErrGalleryFull
+		}
 
-	// Charger l'utilisateur existant depuis la base de données
-	existingRecord := &Record{}
-	err = gocqlx.Query(session.Query(stmts.sel.stmt), stmts.sel.names).BindMap(qb.M{
-		"email": email,
-	}).GetRelease(existingRecord)
-	if err != nil {
-		fmt.Println("ERREUR : impossible de charger l'utilisateur depuis la base de données", err)
-		http.Error(w, "ERREUR : impossible de charger l'utilisateur depuis la base de données", http.StatusInternalServerError)
-		return
+		batch := s.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+		if counted {
+			batch.Query(`UPDATE gallery_images SET images = ? WHERE email = ? IF images = ?`, count+1, email, count)
+		} else {
+			batch.Query(`UPDATE gallery_images SET images = ? WHERE email = ? IF images = null`, count+1, email)
+		}
+		batch.Query(insertGalleryImageStmt, email, image.ID, image.Caption, image.Position, toImageBinaryScylla(image.Image))
+		applied, iter, err := s.session.MapExecuteBatchCAS(batch, map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		iter.Close()
+		if applied {
+			return nil
+		}
 	}
+	return errGalleryContention
+}
 
-	// Initialize existingRecord.Picture if it's nil
-	if existingRecord.Picture == nil {
-		existingRecord.Picture = &ImageBinaryScylla{}
+// IF EXISTS évite de recréer une ligne supprimée entre temps (un UPDATE Scylla est un upsert)
+func (s *scyllaStore) UpdateGalleryImage(ctx context.Context, email string, image GalleryImage) error {
+	applied, err := s.session.Query(`UPDATE gallery_images SET caption = ?, position = ? WHERE email = ? AND id = ? IF EXISTS`,
+		image.Caption, image.Position, email, image.ID).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return s.galleryNotFound(ctx, email)
 	}
+	return nil
+}
 
-	// Mettre à jour les données de l'image dans l'utilisateur existant
-	existingRecord.Picture.Data = pictureData.Bytes()
-	existingRecord.Picture.Extension = fileExtension
+// La suppression décrémente le compteur de la partition dans le même batch conditionnel que l'ajout
+func (s *scyllaStore) DeleteGalleryImage(ctx context.Context, email string, id string) error {
+	for attempt := 0; attempt < scyllaCASAttempts; attempt++ {
+		count, counted, err := s.gallerySize(ctx, email)
+		if err != nil {
+			return err
+		}
+		if !counted {
+			// Galerie d'avant le compteur : il sera calculé au prochain ajout
+			applied, err := s.session.Query(`DELETE FROM gallery_images WHERE email = ? AND id = ? IF EXISTS`,
+				email, id).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+			if err != nil {
+				return err
+			}
+			if !applied {
+				return s.galleryNotFound(ctx, email)
+			}
+			return nil
+		}
 
-	// On créer un record pour mettre à jour l'image dans la base de données
-	newRecord := &Record{
-		Email:    email,
-		Password: existingRecord.Password,
-		Picture:  existingRecord.Picture,
-		State:    existingRecord.State,
-		UserType: existingRecord.UserType,
+		batch := s.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+		batch.Query(`DELETE FROM gallery_images WHERE email = ? AND id = ? IF EXISTS`, email, id)
+		batch.Query(`UPDATE gallery_images SET images = ? WHERE email = ? IF images = ?`, count-1, email, count)
+		applied, iter, err := s.session.MapExecuteBatchCAS(batch, map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		iter.Close()
+		if applied {
+			return nil
+		}
+
+		// Image absente, ou compteur modifié entre temps : on recommence
+		var found string
+		err = s.session.Query(`SELECT id FROM gallery_images WHERE email = ? AND id = ?`, email, id).
+			WithContext(ctx).Consistency(gocql.Quorum).Scan(&found)
+		if errors.Is(err, gocql.ErrNotFound) {
+			return s.galleryNotFound(ctx, email)
+		}
+		if err != nil {
+			return err
+		}
 	}
+	return errGalleryContention
+}
 
-	// Mettre à jour l'image dans la base de données de l'utilisateur
-	err = gocqlx.Query(session.Query(stmts.upd.stmt), stmts.upd.names).BindStruct(newRecord).ExecRelease()
+var errGalleryContention = errors.New("galerie modifiée en continu, réessayer")
+
+// gallerySize lit le compteur d'images de la partition. Les galeries créées avant lui n'en ont pas
+// (counted faux) : le nombre renvoyé est alors celui des lignes.
+func (s *scyllaStore) gallerySize(ctx context.Context, email string) (count int, counted bool, err error) {
+	iter := s.session.Query(`SELECT images, id FROM gallery_images WHERE email = ?`, email).
+		WithContext(ctx).Consistency(gocql.Quorum).Iter()
+	var images *int
+	var id string
+	rows := 0
+	for iter.Scan(&images, &id) {
+		// Une partition dont toutes les images ont été supprimées renvoie une ligne sans id, pour la colonne statique
+		if id != "" {
+			rows++
+		}
+		id = ""
+	}
+	err = iter.Close()
+	if err != nil || images == nil {
+		return rows, false, err
+	}
+	return *images, true, nil
+}
+
+// galleryNotFound distingue un profil absent d'une image absente de la galerie
+func (s *scyllaStore) galleryNotFound(ctx context.Context, email string) error {
+	_, err := s.getRecord(ctx, email)
 	if err != nil {
-		fmt.Println("ERREUR : impossible de mettre à jour l'image dans la base de données", err)
-		http.Error(w, "ERREUR : impossible de mettre à jour l'image dans la base de données", http.StatusInternalServerError)
-		return
+		return err
 	}
+	return ErrImageNotFound
+}
 
-	fmt.Println("Image du profil mise à jour avec succès")
-	w.Write([]byte("Image du profil mise à jour avec succès"))
+func toImageBinaryScylla(image ProfileImage) *ImageBinaryScylla {
+	return &ImageBinaryScylla{
+		Key:         image.Key,
+		Extension:   image.Extension,
+		UpdatedAt:   image.UpdatedAt,
+		VariantKeys: image.Variants,
+		GalleryID:   image.GalleryID,
+	}
 }
 
-func GetProfileImageScylla(w http.ResponseWriter, r *http.Request) {
+func (ib ImageBinaryScylla) toProfileImage() ProfileImage {
+	return ProfileImage{
+		Key:       ib.Key,
+		Extension: ib.Extension,
+		UpdatedAt: ib.UpdatedAt,
+		Variants:  ib.VariantKeys,
+		Data:      ib.Data,
+		GalleryID: ib.GalleryID,
+	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
+// Nombre d'essais des mises à jour conditionnelles des compteurs avant d'abandonner
+const scyllaCASAttempts = 20
 
-	// Lire le corps de la requête pour obtenir les données
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		// Gérer l'erreur de lecture du corps de la requête
-		http.Error(w, "ERREUR : erreur lors de la lecture de la requête", http.StatusBadRequest)
-		return
-	}
+var errBlobRefContention = errors.New("compteur de références modifié en continu, réessayer")
 
-	// Définir une struct pour extraire les données du corps de la requête
-	type RequestData struct {
-		Email string `json:"email"`
-	}
+// Les compteurs sont modifiés par compare-and-set (IF refs = ?) : deux envois simultanés
+// de la même image ne peuvent pas écraser la référence l'un de l'autre
+func (s *scyllaStore) AcquireBlob(ctx context.Context, key string, now time.Time) error {
+	for attempt := 0; attempt < scyllaCASAttempts; attempt++ {
+		current, found, err := s.blobRefCount(ctx, key)
+		if err != nil {
+			return err
+		}
 
-	// Décoder le corps de la requête dans la struct RequestData
-	var requestData RequestData
-	err = json.Unmarshal(body, &requestData)
-	if err != nil {
-		// Gérer l'erreur de décodage du corps de la requête
-		http.Error(w, "ERREUR : erreur lors du décodage de la requête", http.StatusBadRequest)
-		return
+		var applied bool
+		if !found {
+			applied, err = s.session.Query(`INSERT INTO image_refs (blob_key, refs, updated_at) VALUES (?, 1, ?) IF NOT EXISTS`,
+				key, now).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+		} else {
+			applied, err = s.session.Query(`UPDATE image_refs SET refs = ?, updated_at = ? WHERE blob_key = ? IF refs = ?`,
+				current+1, now, key, current).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+		}
+		if err != nil || applied {
+			return err
+		}
 	}
+	return errBlobRefContention
+}
 
-	// On récupère l'email de l'utilisateur
-	email := requestData.Email
+func (s *scyllaStore) ReleaseBlob(ctx context.Context, key string, now time.Time) (int, error) {
+	for attempt := 0; attempt < scyllaCASAttempts; attempt++ {
+		current, found, err := s.blobRefCount(ctx, key)
+		if err != nil || !found || current <= 0 {
+			return 0, err
+		}
 
-	// On récupère l'image de profil de l'utilisateur dans la base de données
-	stmt := fmt.Sprintf(`SELECT picture FROM catalog.users WHERE email = ?`)
+		var applied bool
+		if current == 1 {
+			// Date de libération, pour le délai de grâce du ramasse-miettes
+			applied, err = s.session.Query(`UPDATE image_refs SET refs = 0, updated_at = ? WHERE blob_key = ? IF refs = ?`,
+				now, key, current).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+		} else {
+			applied, err = s.session.Query(`UPDATE image_refs SET refs = ? WHERE blob_key = ? IF refs = ?`,
+				current-1, key, current).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+		}
+		if err != nil {
+			return 0, err
+		}
+		if applied {
+			return current - 1, nil
+		}
+	}
+	return 0, errBlobRefContention
+}
 
-	var imageBinary ImageBinaryScylla
-	err = session.Query(stmt, email).Scan(&imageBinary)
-	if err != nil {
-		fmt.Println("Erreur lors de la récupération de l'image de profil :", err)
-		return
+func (s *scyllaStore) blobRefCount(ctx context.Context, key string) (int, bool, error) {
+	var count int
+	err := s.session.Query(`SELECT refs FROM image_refs WHERE blob_key = ?`, key).WithContext(ctx).
+		Consistency(gocql.Quorum).Scan(&count)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return 0, false, nil
 	}
+	return count, err == nil, err
+}
 
-	// On convertit les données de l'image de profil en bytes
+func (s *scyllaStore) ListBlobRefs(ctx context.Context) ([]BlobRef, error) {
+	iter := s.session.Query(`SELECT blob_key, refs, updated_at FROM image_refs`).WithContext(ctx).Iter()
+	var refs []BlobRef
+	var ref BlobRef
+	for iter.Scan(&ref.Key, &ref.Count, &ref.UpdatedAt) {
+		refs = append(refs, ref)
+	}
+	return refs, iter.Close()
+}
 
-	// On crée le fichier image
-	fileExtension := imageBinary.Extension
-	fileName := email + fileExtension
+func (s *scyllaStore) SetBlobRef(ctx context.Context, ref BlobRef) error {
+	if ref.Count <= 0 {
+		return s.session.Query(`DELETE FROM image_refs WHERE blob_key = ?`, ref.Key).WithContext(ctx).Exec()
+	}
+	return s.session.Query(`INSERT INTO image_refs (blob_key, refs, updated_at) VALUES (?, ?, ?)`,
+		ref.Key, ref.Count, ref.UpdatedAt).WithContext(ctx).Exec()
+}
 
-	filePath := path.Join("./images", fileName) // Chemin du fichier dans l'arborescence du projet
-	fmt.Println("Chemin du dossier images :", path.Dir(filePath))
+func (s *scyllaStore) CreatePasswordReset(ctx context.Context, reset PasswordReset) error {
+	// Le TTL fait disparaître la ligne d'elle-même une fois le token expiré
+	ttl := int(time.Until(reset.ExpiresAt).Seconds()) + 1
+	return s.session.Query(`INSERT INTO password_resets (token_hash, email, expires_at) VALUES (?, ?, ?) USING TTL ?`,
+		reset.TokenHash, reset.Email, reset.ExpiresAt, ttl).WithContext(ctx).Exec()
+}
 
-	// Créer le fichier
-	file, err := os.Create(filePath)
+func (s *scyllaStore) ConsumePasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error) {
+	reset := PasswordReset{TokenHash: tokenHash}
+	err := s.session.Query(`SELECT email, expires_at FROM password_resets WHERE token_hash = ?`, tokenHash).
+		WithContext(ctx).Scan(&reset.Email, &reset.ExpiresAt)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return PasswordReset{}, ErrResetNotFound
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Impossible de créer le fichier d'image"}`))
-		fmt.Println(err)
-		return
+		return PasswordReset{}, err
 	}
-	defer file.Close()
 
-	// On écrit les bytes de l'image dans le fichier
-	_, err = file.Write(imageBinary.Data)
+	// DELETE ... IF EXISTS (transaction légère) : une seule requête peut consommer le token
+	applied, err := s.session.Query(`DELETE FROM password_resets WHERE token_hash = ? IF EXISTS`, tokenHash).
+		WithContext(ctx).ScanCAS()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"Erreur": "Impossible d'écrire les données d'image dans le fichier"}`))
-		fmt.Println(err)
-		return
+		return PasswordReset{}, err
 	}
-
-	// On envoie un message de succès
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Image envoyée"}`))
+	if !applied {
+		return PasswordReset{}, ErrResetNotFound
+	}
+	return reset, nil
 }
 
-func DeleteAllDatabaseScylla(w http.ResponseWriter, r *http.Request) {
-
-	// Exécuter la requête CQL de suppression de tous les enregistrements dans la table
-	query := "TRUNCATE catalog.users"
-	if err := session.Query(query).Exec(); err != nil {
-		fmt.Println("Erreur lors de la suppression de tous les enregistrements :", err)
+func (s *scyllaStore) getRecord(ctx context.Context, email string) (Record, error) {
+	var record Record
+	err := gocqlx.Query(s.session.Query(stmts.get.stmt).WithContext(ctx), stmts.get.names).BindMap(qb.M{
+		"email": email,
+	}).GetRelease(&record)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return Record{}, ErrProfileNotFound
 	}
+	return record, err
+}
 
-	// On envoie un message de succès
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"Message": "Tous les enregistrements ont été supprimés"}`))
+func (s *scyllaStore) selectRecords(ctx context.Context) ([]Record, error) {
+	var records []Record // Utiliser un slice de Record pour stocker les enregistrements
+	err := gocqlx.Query(s.session.Query(stmts.sel.stmt).WithContext(ctx), stmts.sel.names).SelectRelease(&records)
+	return records, err
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Dans le tri par date, l'ordre des clés (texte) est celui des dates, puis celui des emails
+func TestOrderKeySortsByDate(t *testing.T) {
+	keys := []string{
+		orderKey(sortByCreated, "b@example.com", 1_000_000_000_000_000_000),
+		orderKey(sortByCreated, "a@example.com", 20),
+		orderKey(sortByCreated, "z@example.com", 0),
+		orderKey(sortByCreated, "a@example.com", 1_000_000_000_000_000_000),
+		orderKey(sortByCreated, "a@example.com", 3),
+	}
+	sort.Strings(keys)
+	want := []string{
+		"00000000000000000000|z@example.com",
+		"00000000000000000003|a@example.com",
+		"00000000000000000020|a@example.com",
+		"01000000000000000000|a@example.com",
+		"01000000000000000000|b@example.com",
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("clés triées %v, %v attendu", keys, want)
+	}
+	if key := orderKey(sortByEmail, "a@example.com", 3); key != "a@example.com" {
+		t.Errorf("clé du tri par email : %q", key)
+	}
+}
+
+// Chaque profil a une partition fixe, et les profils sont répartis sur toutes les partitions
+func TestOrderBucketSpreadsProfiles(t *testing.T) {
+	used := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		email := fmt.Sprintf("user-%d@example.com", i)
+		bucket := orderBucket(email)
+		if bucket < 0 || bucket >= profileOrderBuckets || bucket != orderBucket(email) {
+			t.Fatalf("partition de %s : %d", email, bucket)
+		}
+		used[bucket]++
+	}
+	if len(used) != profileOrderBuckets {
+		t.Errorf("%d partitions utilisées sur %d : %v", len(used), profileOrderBuckets, used)
+	}
+}
+
+func TestProfileOrderSelect(t *testing.T) {
+	state := true
+	stmt, values := profileOrderSelect(ProfileQuery{Sort: sortByEmail, Limit: 10}, 3)
+	want := "SELECT sort_key, email, state, usertype, created_at FROM profile_order WHERE sort_by = ? AND bucket = ? LIMIT ?"
+	if stmt != want || !reflect.DeepEqual(values, []interface{}{sortByEmail, 3, 11}) {
+		t.Errorf("première page : %q %v", stmt, values)
+	}
+
+	query := ProfileQuery{Sort: sortByCreated, Descending: true, Limit: 10, State: &state,
+		After: &ProfileCursor{Email: "a@example.com", CreatedAt: 5}}
+	stmt, values = profileOrderSelect(query, 0)
+	want = "SELECT sort_key, email, state, usertype, created_at FROM profile_order WHERE sort_by = ? AND bucket = ?" +
+		" AND sort_key < ? AND state = ? ORDER BY sort_key DESC LIMIT ? ALLOW FILTERING"
+	wantValues := []interface{}{sortByCreated, 0, "00000000000000000005|a@example.com", true, 11}
+	if stmt != want || !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("page suivante filtrée : %q %v", stmt, values)
+	}
+}
+
+// Les lignes de plusieurs partitions sont fusionnées dans l'ordre du tri, le curseur suit la dernière ligne gardée
+func TestMergeOrderRows(t *testing.T) {
+	rowsOf := func(emails ...string) []orderRow {
+		var rows []orderRow
+		for _, email := range emails {
+			rows = append(rows, orderRow{key: email, record: Record{Email: email}})
+		}
+		return rows
+	}
+	emailsOf := func(page ProfilePage) []string {
+		var emails []string
+		for _, profile := range page.Profiles {
+			emails = append(emails, profile.Email)
+		}
+		return emails
+	}
+
+	// Lignes de trois partitions, dans l'ordre de lecture
+	page := mergeOrderRows(rowsOf("b", "e", "a", "d", "c"), ProfileQuery{Sort: sortByEmail, Limit: 3})
+	if got := emailsOf(page); !reflect.DeepEqual(got, []string{"a", "b", "c"}) || page.Next == nil || page.Next.Email != "c" {
+		t.Errorf("page croissante : %v, curseur %+v", got, page.Next)
+	}
+
+	page = mergeOrderRows(rowsOf("b", "e", "a", "d", "c"), ProfileQuery{Sort: sortByEmail, Descending: true, Limit: 2})
+	if got := emailsOf(page); !reflect.DeepEqual(got, []string{"e", "d"}) || page.Next == nil || page.Next.Email != "d" {
+		t.Errorf("page décroissante : %v, curseur %+v", got, page.Next)
+	}
+
+	page = mergeOrderRows(rowsOf("b", "a"), ProfileQuery{Sort: sortByEmail, Limit: 2})
+	if got := emailsOf(page); !reflect.DeepEqual(got, []string{"a", "b"}) || page.Next != nil {
+		t.Errorf("dernière page : %v, curseur %+v", got, page.Next)
+	}
+
+	page = mergeOrderRows(nil, ProfileQuery{Sort: sortByEmail, Limit: 2})
+	if page.Profiles == nil || len(page.Profiles) != 0 || page.Next != nil {
+		t.Errorf("page vide : %+v", page)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Profil tel qu'il est manipulé par les handlers, indépendamment de la base de données utilisée
+type Profile struct {
+	Email    string `json:"email"`
+	Password string `json:"-"` // le hash du mot de passe n'est jamais renvoyé au client
+	State    bool   `json:"state"`
+	UserType int    `json:"userType"`
+	// Date de création, zéro pour les profils créés avant qu'elle soit enregistrée
+	CreatedAt time.Time `json:"createdAt"`
+	// Dernier changement ou réinitialisation du mot de passe : les tokens de session émis avant sont refusés
+	PasswordChangedAt time.Time `json:"-"`
+}
+
+// Les backends rangent la date de création en nanosecondes Unix (0 : inconnue), une clé de tri exacte
+// et comparable de la même façon dans toutes les bases
+func createdAtNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func createdAtTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos).UTC()
+}
+
+// Tris possibles des pages de profils. L'email départage les profils créés au même instant.
+const (
+	sortByEmail   = "email"
+	sortByCreated = "createdAt"
+)
+
+// ProfileQuery décrit une page de profils : filtres combinés, tri, taille et position
+type ProfileQuery struct {
+	State      *bool // nil : tous les états
+	UserType   *int  // nil : tous les types
+	Sort       string
+	Descending bool
+	Limit      int
+	After      *ProfileCursor // nil pour la première page
+}
+
+// ProfileCursor est la position après le dernier profil d'une page : chaque backend reprend
+// après la clé (CreatedAt, Email), ou après l'email pour le tri par email.
+type ProfileCursor struct {
+	Email     string
+	CreatedAt int64 // nanosecondes Unix
+}
+
+// Une page de profils, sans les hash des mots de passe. Next est nil sur la dernière page.
+type ProfilePage struct {
+	Profiles []Profile
+	Next     *ProfileCursor
+}
+
+// matches indique si le profil passe les filtres de la requête
+func (q ProfileQuery) matches(p Profile) bool {
+	return (q.State == nil || *q.State == p.State) && (q.UserType == nil || *q.UserType == p.UserType)
+}
+
+// cursorOf renvoie la position après le profil, pour les backends qui paginent par clé
+func cursorOf(p Profile) *ProfileCursor {
+	return &ProfileCursor{Email: p.Email, CreatedAt: createdAtNanos(p.CreatedAt)}
+}
+
+// Référence vers l'image de profil, gardée par le backend. Les données sont dans le BlobStore :
+// lister les profils ne charge plus les images.
+type ProfileImage struct {
+	Key       string    // clé de l'original dans le BlobStore
+	Extension string    // l'extension de l'image (ex : ".png")
+	UpdatedAt time.Time // date de l'envoi, zéro pour les images envoyées avant qu'elle soit enregistrée
+	// Clés des versions réduites de l'image indexées par nom de variante (ex : "64"), dans le même format que l'original
+	Variants map[string]string
+	// Données des images envoyées avant le BlobStore, encore rangées dans la ligne du profil.
+	// Toujours vide pour les nouvelles images, remplacé au prochain envoi.
+	Data []byte
+	// Identifiant de l'image de la galerie choisie comme avatar, vide pour les images d'avant la galerie
+	GalleryID string
+}
+
+// Image de la galerie d'un profil. L'avatar (image principale) est une copie de la référence
+// d'une des images de la galerie, gardée comme image de profil : les routes d'une seule image restent inchangées.
+type GalleryImage struct {
+	ID       string
+	Caption  string
+	Position int // ordre d'affichage croissant
+	Image    ProfileImage
+}
+
+// Compteur de références d'une donnée du BlobStore. Les images sont rangées par empreinte SHA-256 :
+// une même image envoyée par plusieurs profils n'est stockée qu'une fois.
+type BlobRef struct {
+	Key       string
+	Count     int       // nombre de références depuis les profils (original et variantes)
+	UpdatedAt time.Time // dernière prise de référence, le ramasse-miettes ne touche pas aux compteurs récents
+}
+
+// Demande de réinitialisation de mot de passe. Seul le hash SHA-256 du token est stocké,
+// le token lui-même n'est connu que du destinataire de la notification.
+type PasswordReset struct {
+	TokenHash string
+	Email     string
+	ExpiresAt time.Time
+}
+
+// Erreurs communes renvoyées par les backends
+var (
+	ErrProfileNotFound  = errors.New("profil non trouvé")
+	ErrEmailAlreadyUsed = errors.New("email déjà utilisé")
+	ErrImageNotFound    = errors.New("image non trouvée")
+	ErrResetNotFound    = errors.New("demande de réinitialisation non trouvée")
+	ErrGalleryFull      = errors.New("nombre maximal d'images de la galerie atteint")
+)
+
+// ProfileStore est l'interface de stockage que chaque base de données (Mongo, Scylla, Cockroach...) implémente.
+// Les handlers HTTP de handlers.go ne parlent qu'à cette interface.
+type ProfileStore interface {
+	CreateProfile(ctx context.Context, profile Profile) error
+	// CreateProfiles insère des profils par lots. Un email déjà utilisé arrête l'insertion avec une erreur
+	// (ErrEmailAlreadyUsed quand le backend sait la reconnaître), sans jamais écraser le profil existant.
+	// Renvoie le nombre de profils insérés depuis le début de la liste avant l'erreur.
+	CreateProfiles(ctx context.Context, profiles []Profile) (int, error)
+	GetProfile(ctx context.Context, email string) (Profile, error)
+	ListProfiles(ctx context.Context) ([]Profile, error)
+	ListProfilesByType(ctx context.Context, userType int) ([]Profile, error)
+	// ListProfilesPage renvoie au plus query.Limit profils filtrés et triés, et la position de la page suivante
+	ListProfilesPage(ctx context.Context, query ProfileQuery) (ProfilePage, error)
+	// StreamProfiles appelle fn pour chaque profil filtré et trié comme query (Limit et After ignorés), sans hash
+	// de mot de passe ni image, en lisant le curseur de la base au fur et à mesure. Une erreur de fn arrête la lecture.
+	StreamProfiles(ctx context.Context, query ProfileQuery, fn func(Profile) error) error
+	CountProfiles(ctx context.Context) (int, error)
+	UpdateProfileState(ctx context.Context, email string, state bool) (Profile, error)
+	// UpdateProfilePassword remplace le hash du mot de passe. changedAt est la date du changement, zéro quand
+	// le même mot de passe est seulement rehashé (connexion) : la date du dernier changement est alors gardée.
+	// Un changement supprime aussi les demandes de réinitialisation en cours du profil.
+	UpdateProfilePassword(ctx context.Context, email string, passwordHash string, changedAt time.Time) error
+	DeleteProfile(ctx context.Context, email string) error
+	DeleteAllProfiles(ctx context.Context) error
+	// PutProfileImage avec une ProfileImage vide retire l'image du profil (dernière image de la galerie supprimée)
+	PutProfileImage(ctx context.Context, email string, image ProfileImage) error
+	GetProfileImage(ctx context.Context, email string) (ProfileImage, error)
+
+	// Galerie d'images du profil, supprimée avec le profil. ListGalleryImages trie par Position ;
+	// UpdateGalleryImage ne modifie que la légende et la position. AddGalleryImage renvoie ErrGalleryFull
+	// si la galerie a déjà maxImages images (0 : sans limite), vérifié par la même opération que l'ajout.
+	ListGalleryImages(ctx context.Context, email string) ([]GalleryImage, error)
+	AddGalleryImage(ctx context.Context, email string, image GalleryImage, maxImages int) error
+	UpdateGalleryImage(ctx context.Context, email string, image GalleryImage) error
+	DeleteGalleryImage(ctx context.Context, email string, id string) error
+
+	// AcquireBlob ajoute une référence à la clé, ReleaseBlob en retire une et renvoie le nombre restant.
+	// Une clé sans compteur compte pour zéro. Un compteur qui retombe à zéro est gardé avec la date
+	// de libération : c'est le ramasse-miettes qui le supprime, avec les données, après le délai de grâce.
+	AcquireBlob(ctx context.Context, key string, now time.Time) error
+	ReleaseBlob(ctx context.Context, key string, now time.Time) (int, error)
+	ListBlobRefs(ctx context.Context) ([]BlobRef, error)
+	// SetBlobRef corrige un compteur (ramasse-miettes), un Count à zéro le supprime
+	SetBlobRef(ctx context.Context, ref BlobRef) error
+
+	CreatePasswordReset(ctx context.Context, reset PasswordReset) error
+	// ConsumePasswordReset supprime la demande et la renvoie : un token ne sert qu'une seule fois
+	ConsumePasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forEachStore lance le test sur chaque backend qui tourne sans service externe, avec une base vide
+func forEachStore(t *testing.T, test func(t *testing.T, store ProfileStore)) {
+	t.Run(backendMemory, func(t *testing.T) {
+		test(t, newMemoryStore())
+	})
+	t.Run(backendSQLite, func(t *testing.T) {
+		db, err := db_sqlite(filepath.Join(t.TempDir(), "profiles.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := newGormStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			sqlDB, err := db.DB()
+			if err == nil {
+				sqlDB.Close()
+			}
+		})
+		test(t, store)
+	})
+}
+
+func testProfile(email string) Profile {
+	return Profile{Email: email, Password: "hash", State: true, UserType: int(roleUser), CreatedAt: time.Now().UTC()}
+}
+
+func TestCreateProfileRejectsUsedEmail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		ctx := context.Background()
+		err := store.CreateProfile(ctx, testProfile("a@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		duplicate := testProfile("a@example.com")
+		duplicate.UserType = int(roleAdmin)
+		err = store.CreateProfile(ctx, duplicate)
+		if !errors.Is(err, ErrEmailAlreadyUsed) {
+			t.Fatalf("CreateProfile(email déjà utilisé) : %v, ErrEmailAlreadyUsed attendue", err)
+		}
+
+		profile, err := store.GetProfile(ctx, "a@example.com")
+		if err != nil || profile.UserType != int(roleUser) {
+			t.Errorf("le profil existant a été modifié : %+v, %v", profile, err)
+		}
+	})
+}
+
+// Des créations simultanées du même email : une seule passe, les autres reçoivent ErrEmailAlreadyUsed
+func TestCreateProfileConcurrentDuplicates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		const attempts = 8
+		errs := make([]error, attempts)
+		var wg sync.WaitGroup
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = store.CreateProfile(context.Background(), testProfile("race@example.com"))
+			}(i)
+		}
+		wg.Wait()
+
+		created := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				created++
+			case !errors.Is(err, ErrEmailAlreadyUsed):
+				t.Errorf("CreateProfile simultané : %v, ErrEmailAlreadyUsed attendue", err)
+			}
+		}
+		if created != 1 {
+			t.Errorf("%d profils créés, un seul attendu", created)
+		}
+	})
+}
+
+func TestCreateProfilesStopsOnUsedEmail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ProfileStore) {
+		ctx := context.Background()
+		err := store.CreateProfile(ctx, testProfile("taken@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var batch []Profile
+		for i := 0; i < 3; i++ {
+			batch = append(batch, testProfile(fmt.Sprintf("new-%d@example.com", i)))
+		}
+		batch = append(batch, testProfile("taken@example.com"))
+
+		inserted, err := store.CreateProfiles(ctx, batch)
+		if !errors.Is(err, ErrEmailAlreadyUsed) {
+			t.Fatalf("CreateProfiles(lot avec un email déjà utilisé) : %v, ErrEmailAlreadyUsed attendue", err)
+		}
+		// Les profils insérés sont ceux du début de la liste, et seulement eux
+		for i, profile := range batch[:3] {
+			_, err := store.GetProfile(ctx, profile.Email)
+			if (i < inserted) != (err == nil) {
+				t.Errorf("%s : présent = %v, %d profils annoncés insérés", profile.Email, err == nil, inserted)
+			}
+		}
+	})
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Le vidage de la base se fait en deux appels :
+//  1. {"dryRun": true} renvoie le nombre de profils qui seraient supprimés et un token de confirmation
+//  2. {"confirm": "<token>"} sauvegarde tous les profils dans --snapshot-dir puis vide la base
+//
+// Le token de confirmation est signé avec la clé des tokens de session, il n'est valable
+// que quelques minutes, une seule fois, et uniquement pour l'admin qui l'a demandé.
+
+const wipeConfirmTTL = 5 * time.Minute
+
+// Type des tokens de confirmation (claim typ) : un token de session ne peut pas servir de confirmation,
+// ni un token de confirmation de session
+const wipeConfirmType = "wipe-confirm"
+
+// usedTokens garde les jti des tokens de confirmation déjà utilisés jusqu'à leur expiration
+type usedTokens struct {
+	mu  sync.Mutex
+	ids map[string]time.Time // jti -> expiration du token
+}
+
+func newUsedTokens() *usedTokens {
+	return &usedTokens{ids: make(map[string]time.Time)}
+}
+
+// consume marque le token comme utilisé, false s'il l'était déjà
+func (u *usedTokens) consume(claims tokenClaims, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for id, expiresAt := range u.ids {
+		if now.Unix() >= expiresAt.Unix() {
+			delete(u.ids, id)
+		}
+	}
+	if _, used := u.ids[claims.ID]; used || claims.ID == "" {
+		return false
+	}
+	u.ids[claims.ID] = time.Unix(claims.ExpiresAt, 0)
+	return true
+}
+
+// Corps de DELETE /api/deleteAllDatabase : d'abord {"dryRun": true}, puis {"confirm": "<confirmToken>"}
+type wipeRequest struct {
+	DryRun  bool   `json:"dryRun"`
+	Confirm string `json:"confirm"`
+}
+
+// Réponse à l'appel dryRun : nombre de profils qui seraient supprimés et token de confirmation
+type wipePreview struct {
+	DryRun       bool   `json:"dryRun"`
+	Count        int    `json:"count"`
+	ConfirmToken string `json:"confirmToken"`
+	ExpiresAt    string `json:"expiresAt"`
+}
+
+// Réponse au vidage : nombre de profils supprimés et fichier de sauvegarde
+type wipeResponse struct {
+	Message  string `json:"Message"`
+	Count    int    `json:"count"`
+	Snapshot string `json:"snapshot"`
+}
+
+func (a *apiHandlers) DeleteAllDatabase(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var body wipeRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "Erreur lors de la lecture du corps de la requête")
+		return
+	}
+	if dryRun, err := strconv.ParseBool(r.URL.Query().Get("dryRun")); err == nil {
+		body.DryRun = dryRun
+	}
+
+	caller, _ := currentProfile(r.Context())
+	confirmations := &tokenIssuer{secret: a.tokens.secret, ttl: wipeConfirmTTL, typ: wipeConfirmType, ids: true}
+
+	if body.DryRun {
+		count, err := a.store.CountProfiles(r.Context())
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		token, expiresAt, err := confirmations.Issue(caller.Email, time.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Impossible de créer le token de confirmation")
+			return
+		}
+
+		json.NewEncoder(w).Encode(wipePreview{
+			DryRun:       true,
+			Count:        count,
+			ConfirmToken: token,
+			ExpiresAt:    expiresAt.UTC().Format(time.RFC3339),
+		})
+		return
+	}
+
+	if body.Confirm == "" {
+		writeError(w, http.StatusBadRequest, "Confirmation requise : appeler d'abord avec {\"dryRun\": true} pour obtenir un token")
+		return
+	}
+	claims, err := confirmations.Verify(body.Confirm, time.Now())
+	if err != nil || claims.Subject != caller.Email {
+		writeError(w, http.StatusBadRequest, "Token de confirmation invalide ou expiré")
+		return
+	}
+	if !a.usedWipeTokens.consume(claims, time.Now()) {
+		writeError(w, http.StatusBadRequest, "Token de confirmation déjà utilisé")
+		return
+	}
+
+	// Sans sauvegarde on ne supprime rien
+	path, count, err := writeSnapshot(r.Context(), a.images, a.cfg.SnapshotDir, time.Now())
+	if err != nil {
+		log.Println("ERREUR : sauvegarde avant vidage impossible :", err)
+		writeError(w, http.StatusInternalServerError, "Impossible de sauvegarder les profils, rien n'a été supprimé")
+		return
+	}
+	log.Printf("Sauvegarde de %d profils avant vidage par %s : %s", count, caller.Email, path)
+
+	err = a.store.DeleteAllProfiles(r.Context())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	// Les profils sont supprimés : les données des images restantes ne sont plus référencées
+	err = a.images.RemoveAll(r.Context())
+	if err != nil {
+		log.Println("ERREUR : suppression des images après vidage :", err)
+	}
+
+	// Le compte administrateur configuré est recréé pour garder l'accès à l'API
+	err = ensureAdminProfile(r.Context(), a.store, a.cfg)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(wipeResponse{
+		Message:  "Tous les enregistrements ont été supprimés",
+		Count:    count,
+		Snapshot: path,
+	})
+}
+
+// Contenu d'un fichier de sauvegarde. Contrairement à Profile, le hash du mot de passe
+// et l'image sont inclus pour pouvoir tout restaurer.
+type snapshotFile struct {
+	CreatedAt time.Time         `json:"createdAt"`
+	Profiles  []snapshotProfile `json:"profiles"`
+}
+
+type snapshotProfile struct {
+	Email    string         `json:"email"`
+	Password string         `json:"password"`
+	State    bool           `json:"state"`
+	UserType int            `json:"userType"`
+	Image    *snapshotImage `json:"image,omitempty"`
+	// Date de création, zéro pour les sauvegardes d'avant la date de création
+	CreatedAt time.Time `json:"createdAt"`
+	// Galerie du profil, absente des sauvegardes d'avant la galerie : Image devient alors la seule image
+	Gallery []snapshotGalleryImage `json:"gallery,omitempty"`
+}
+
+type snapshotGalleryImage struct {
+	Caption  string        `json:"caption"`
+	Position int           `json:"position"`
+	Primary  bool          `json:"primary"`
+	Image    snapshotImage `json:"image"`
+}
+
+type snapshotImage struct {
+	Data      []byte            `json:"data"` // encodé en base64 par encoding/json
+	Extension string            `json:"extension"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	Variants  map[string][]byte `json:"variants,omitempty"`
+}
+
+func toSnapshotImage(image imageUpload) *snapshotImage {
+	return &snapshotImage{Data: image.Data, Extension: image.Extension, UpdatedAt: image.UpdatedAt, Variants: image.Variants}
+}
+
+func (s snapshotImage) toUpload() imageUpload {
+	return imageUpload{Data: s.Data, Extension: s.Extension, UpdatedAt: s.UpdatedAt, Variants: s.Variants}
+}
+
+// writeSnapshot sauvegarde tous les profils et leurs images dans un fichier JSON du dossier dir.
+// Le fichier est écrit à côté puis renommé, une sauvegarde n'est donc jamais à moitié écrite.
+func writeSnapshot(ctx context.Context, images profileImages, dir string, now time.Time) (string, int, error) {
+	profiles, err := images.store.ListProfiles(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+
+	snapshot := snapshotFile{CreatedAt: now.UTC(), Profiles: make([]snapshotProfile, 0, len(profiles))}
+	for _, profile := range profiles {
+		entry := snapshotProfile{
+			Email:     profile.Email,
+			Password:  profile.Password,
+			State:     profile.State,
+			UserType:  profile.UserType,
+			CreatedAt: profile.CreatedAt,
+		}
+
+		avatar, err := images.store.GetProfileImage(ctx, profile.Email)
+		if err == nil {
+			image, err := images.LoadImage(ctx, avatar)
+			if err != nil {
+				return "", 0, err
+			}
+			entry.Image = toSnapshotImage(image)
+		} else if !errors.Is(err, ErrImageNotFound) {
+			return "", 0, err
+		}
+
+		gallery, err := images.store.ListGalleryImages(ctx, profile.Email)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, galleryEntry := range gallery {
+			image, err := images.LoadImage(ctx, galleryEntry.Image)
+			if err != nil {
+				return "", 0, err
+			}
+			entry.Gallery = append(entry.Gallery, snapshotGalleryImage{
+				Caption:  galleryEntry.Caption,
+				Position: galleryEntry.Position,
+				Primary:  avatar.GalleryID == galleryEntry.ID,
+				Image:    *toSnapshotImage(image),
+			})
+		}
+
+		snapshot.Profiles = append(snapshot.Profiles, entry)
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Le fichier contient les hash des mots de passe : lisible uniquement par le serveur
+	tmp, err := os.CreateTemp(dir, ".snapshot-*.json")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name()) // sans effet une fois le fichier renommé
+
+	err = json.NewEncoder(tmp).Encode(snapshot)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("profiles-%s.json", now.UTC().Format("20060102T150405.000000000Z")))
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, len(snapshot.Profiles), nil
+}
+
+// restoreSnapshot recrée les profils d'une sauvegarde. Les profils déjà présents sont ignorés.
+func restoreSnapshot(ctx context.Context, images profileImages, path string) (restored int, skipped int, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var snapshot snapshotFile
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return 0, 0, fmt.Errorf("sauvegarde illisible %s : %w", path, err)
+	}
+
+	for _, entry := range snapshot.Profiles {
+		err := images.store.CreateProfile(ctx, Profile{
+			Email:     entry.Email,
+			Password:  entry.Password,
+			State:     entry.State,
+			UserType:  entry.UserType,
+			CreatedAt: entry.CreatedAt,
+		})
+		if errors.Is(err, ErrEmailAlreadyUsed) {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return restored, skipped, fmt.Errorf("restauration de %s : %w", entry.Email, err)
+		}
+
+		primary := false
+		for _, galleryEntry := range entry.Gallery {
+			primary = primary || galleryEntry.Primary
+			added, err := images.add(ctx, entry.Email, galleryEntry.Image.toUpload(), galleryEntry.Caption, galleryEntry.Position, 0)
+			if err == nil && galleryEntry.Primary {
+				err = images.SetPrimary(ctx, entry.Email, added)
+			}
+			if err != nil {
+				return restored, skipped, fmt.Errorf("restauration de la galerie de %s : %w", entry.Email, err)
+			}
+		}
+		// Avatar d'avant la galerie (ou sauvegarde d'avant la galerie) : il est ajouté à la galerie
+		if entry.Image != nil && !primary {
+			err = images.Put(ctx, entry.Email, entry.Image.toUpload())
+			if err != nil {
+				return restored, skipped, fmt.Errorf("restauration de l'image de %s : %w", entry.Email, err)
+			}
+		}
+		restored++
+	}
+	return restored, skipped, nil
+}
+
+// runRestore est le point d'entrée de la sous-commande "restore", renvoie le code de sortie
+//
+//	./main restore --backend=sqlite ./data/snapshots/profiles-20240101T120000.000000000Z.json
+func runRestore(args []string) int {
+	var cfg config
+	fs := configFlagSet("restore", &cfg)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		log.Println("ERREUR : usage : restore [flags] <fichier de sauvegarde>")
+		return 2
+	}
+	err = cfg.validate()
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 2
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+
+	blobs, err := openBlobStore(cfg)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+
+	restored, skipped, err := restoreSnapshot(context.Background(), profileImages{store: store, blobs: blobs}, fs.Arg(0))
+	log.Printf("%d profils restaurés, %d déjà présents", restored, skipped)
+	if err != nil {
+		log.Println("ERREUR :", err)
+		return 1
+	}
+	return 0
+}
@@ -1,8 +1,15 @@
 module CRUD_Appli
 
-go 1.20
+go 1.22.2
 
-require github.com/gorilla/mux v1.8.0
+require (
+	github.com/HugoSmits86/nativewebp v0.9.3
+	github.com/gorilla/mux v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.16
+	golang.org/x/image v0.10.0
+	gorm.io/driver/sqlite v1.5.0
+	gorm.io/gorm v1.25.0
+)
 
 require (
 	github.com/google/go-cmp v0.5.5 // indirect
@@ -11,12 +18,6 @@ require (
 	github.com/jackc/pgx/v5 v5.3.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
-	github.com/kr/pretty v0.3.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.16 // indirect
-	github.com/rogpeppe/go-internal v1.9.0 // indirect
-	github.com/stretchr/testify v1.8.1 // indirect
-	gorm.io/driver/sqlite v1.5.0 // indirect
-	gorm.io/gorm v1.25.0 // indirect
 )
 
 require (
@@ -38,7 +39,7 @@ require (
 	golang.org/x/crypto v0.6.0
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
-	golang.org/x/text v0.7.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gorm.io/driver/postgres v1.5.0
 )